@@ -4,21 +4,24 @@ import (
 	"context"
 	"flag"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/nikolay-makurin/replicator/internal/admin"
 	"github.com/nikolay-makurin/replicator/internal/config"
-	"github.com/nikolay-makurin/replicator/internal/pipeline"
-	"github.com/nikolay-makurin/replicator/internal/sink"
-	"github.com/nikolay-makurin/replicator/internal/source/postgres"
 	"github.com/nikolay-makurin/replicator/internal/telemetry"
-	"github.com/nikolay-makurin/replicator/pkg/types"
 )
 
 func main() {
 	configPath := flag.String("config", "", "Path to config file")
+	replayFiles := flag.String("replay", "", "Comma-separated globs of change files to replay into the targets instead of reading the source")
+	pipelineName := flag.String("pipeline", "", "Pipeline to replay into; required with several pipelines")
 	flag.Parse()
 
 	// 1. Config
@@ -28,92 +31,125 @@ func main() {
 		os.Exit(1)
 	}
 
-	// 2. Telemetry
-	telemetry.Init(cfg.Telemetry.Address)
-	slog.Info("Starting Replicator", "source_slot", cfg.Source.SlotName)
+	// 2. Telemetry, and the admin API next to it
+	var adminServer *admin.Server
+	if cfg.Admin.Token != "" {
+		adminServer = admin.NewServer(cfg.Admin.Token)
+		http.Handle("/admin/", adminServer)
+	}
+	telemetry.Init(cfg.Telemetry)
+	shutdownTracing, err := telemetry.InitTracing(context.Background(), cfg.Telemetry.Tracing)
+	if err != nil {
+		slog.Error("Failed to init tracing", "error", err)
+		os.Exit(1)
+	}
+	defer flushTraces(shutdownTracing)
+	slog.Info("Starting Replicator", "pipelines", len(cfg.PipelineSpecs()))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// 3. Checkpoint Manager
-	cm := pipeline.NewCheckpointManager(0)
+	specs := cfg.PipelineSpecs()
 
-	// 4. Sinks
-	var sinks []sink.Sink
-
-	// Initialize Postgres Sinks
-	for _, t := range cfg.Targets.Postgres {
-		s, err := sink.NewPostgresSink(ctx, t)
-		if err != nil {
-			slog.Error("Failed to init postgres sink", "name", t.Name, "error", err)
+	// Replay change files into one pipeline's targets and exit once they are written
+	if *replayFiles != "" {
+		spec, ok := replayPipeline(specs, *pipelineName)
+		if !ok {
+			slog.Error("Replay needs -pipeline naming one of the configured pipelines", "pipeline", *pipelineName)
 			os.Exit(1)
 		}
-		// Wrap with Retry
-		rs := sink.NewRetrySink(t.Name, s, t.Retry)
-		sinks = append(sinks, rs)
-		slog.Info("Initialized Postgres sink", "name", t.Name)
-	}
-
-	// Initialize ClickHouse Sinks
-	for _, t := range cfg.Targets.ClickHouse {
-		s, err := sink.NewClickHouseSink(t)
+		p, err := newPipelineRunner(ctx, spec)
 		if err != nil {
-			slog.Error("Failed to init clickhouse sink", "name", t.Name, "error", err)
+			slog.Error("Failed to init pipeline", "pipeline", spec.Name, "error", err)
 			os.Exit(1)
 		}
-		// Wrap with Retry
-		rs := sink.NewRetrySink(t.Name, s, t.Retry)
-		sinks = append(sinks, rs)
-		slog.Info("Initialized ClickHouse sink", "name", t.Name)
-	}
-
-	// Initialize Redis Sinks
-	for _, t := range cfg.Targets.Redis {
-		s, err := sink.NewRedisSink(t)
+		err = p.replay(ctx, strings.Split(*replayFiles, ","))
+		p.close()
 		if err != nil {
-			slog.Error("Failed to init redis sink", "name", t.Name, "error", err)
+			slog.Error("Replay failed", "pipeline", spec.Name, "error", err)
 			os.Exit(1)
 		}
-		// Wrap with Retry
-		rs := sink.NewRetrySink(t.Name, s, t.Retry)
-		sinks = append(sinks, rs)
-		slog.Info("Initialized Redis sink", "name", t.Name)
+		slog.Info("Replay finished", "pipeline", spec.Name)
+		return
+	}
+
+	// 3. Pipelines, each in its own failure domain: a pipeline that fails to
+	// start or whose source fails stops alone
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for _, spec := range specs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runPipeline(ctx, spec, adminServer); err != nil {
+				slog.Error("Pipeline failed", "pipeline", spec.Name, "error", err)
+				failed.Add(1)
+			}
+		}()
 	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
 
-	if len(sinks) == 0 {
-		slog.Error("No sinks configured")
+	// 4. Wait for Signal, or for every pipeline to have stopped
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sigCh:
+		slog.Info("Shutting down...")
+		cancel()
+		// Give pipelines time to flush their batches
+		select {
+		case <-stopped:
+		case <-time.After(shutdownTimeout):
+			slog.Warn("Pipelines did not stop in time", "timeout", shutdownTimeout)
+		}
+	case <-stopped:
+		slog.Error("All pipelines stopped", "failed", failed.Load())
+		flushTraces(shutdownTracing)
 		os.Exit(1)
 	}
+}
 
-	// Wrap in Broadcast
-	broadcastSink := sink.NewBroadcastSink(sinks)
-	defer broadcastSink.Close()
+// shutdownTimeout bounds how long pipelines may take to flush on shutdown.
+const shutdownTimeout = 10 * time.Second
 
-	// 5. Dispatcher
-	dispatcher := pipeline.NewDispatcher(cfg.Pipeline, broadcastSink, cm)
-	eventCh := make(chan *types.Event, cfg.Pipeline.BufferSize)
+// flushTraces exports the spans still buffered before the process exits.
+func flushTraces(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		slog.Warn("Failed to flush traces", "error", err)
+	}
+}
 
-	// 6. Source
-	src := postgres.NewSource(cfg.Source, cm, eventCh)
+// runPipeline runs one pipeline until ctx is cancelled or it fails. The
+// admin server, if any, controls it while it runs.
+func runPipeline(ctx context.Context, spec config.PipelineSpec, adminServer *admin.Server) error {
+	p, err := newPipelineRunner(ctx, spec)
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	if adminServer != nil {
+		adminServer.Register(spec.Name, p)
+	}
 
-	// 7. Start Components
-	go dispatcher.Start(ctx, eventCh)
+	up := telemetry.PipelineUp.WithLabelValues(spec.Name)
+	up.Set(1)
+	defer up.Set(0)
+	return p.run(ctx)
+}
 
-	// Start source (will block in main goroutine until shutdown)
-	go func() {
-		if err := src.Start(ctx); err != nil {
-			slog.Error("Source failed", "error", err)
-			cancel()
+// replayPipeline picks the pipeline to replay into: the named one, or the
+// only one.
+func replayPipeline(specs []config.PipelineSpec, name string) (config.PipelineSpec, bool) {
+	for _, spec := range specs {
+		if spec.Name == name || (name == "" && len(specs) == 1) {
+			return spec, true
 		}
-	}()
-
-	// 8. Wait for Signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-
-	slog.Info("Shutting down...")
-	cancel()
-	// Give goroutines time to clean up
-	time.Sleep(2 * time.Second)
+	}
+	return config.PipelineSpec{}, false
 }
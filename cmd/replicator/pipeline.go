@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/nikolay-makurin/replicator/internal/admin"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/pipeline"
+	"github.com/nikolay-makurin/replicator/internal/sink"
+	"github.com/nikolay-makurin/replicator/internal/source/postgres"
+	"github.com/nikolay-makurin/replicator/internal/source/replay"
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// pipelineRunner wires one pipeline: its checkpoint, its sinks behind a
+// broadcast and its worker pool. Pipelines share nothing but telemetry.
+// It implements admin.Pipeline.
+type pipelineRunner struct {
+	spec       config.PipelineSpec
+	log        *slog.Logger
+	checkpoint *pipeline.CheckpointManager
+	sink       sink.Sink
+	status     *telemetry.PipelineStatus
+	gates      map[string]*admin.Gate // Keyed by sink name
+
+	mu         sync.Mutex
+	src        *postgres.Source     // Set while running
+	dispatcher *pipeline.Dispatcher // Set while running
+}
+
+func newPipelineRunner(ctx context.Context, spec config.PipelineSpec) (*pipelineRunner, error) {
+	log := slog.With("pipeline", spec.Name)
+	cm := pipeline.NewCheckpointManager(0)
+	status := telemetry.Pipelines.Pipeline(spec.Name)
+	gates := make(map[string]*admin.Gate)
+	sinks, err := newSinks(ctx, log, spec.Targets, cm, status, gates)
+	if err != nil {
+		return nil, err
+	}
+	if len(sinks) == 0 {
+		return nil, errors.New("no sinks configured")
+	}
+	return &pipelineRunner{
+		spec:       spec,
+		log:        log,
+		checkpoint: cm,
+		sink:       sink.NewBroadcastSink(sinks),
+		status:     status,
+		gates:      gates,
+	}, nil
+}
+
+// run replicates from the pipeline's source until ctx is cancelled or the
+// source fails. Buffered batches are flushed before it returns.
+func (p *pipelineRunner) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dispatcher := pipeline.NewDispatcher(p.spec.PipelineConfig, p.sink, p.checkpoint)
+	p.status.Observe(p.checkpoint.GetSafeLSN, dispatcher.QueueDepths)
+	eventCh := make(chan *types.Event, p.spec.BufferSize)
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Start(ctx, eventCh)
+		close(done)
+	}()
+
+	src := postgres.NewSource(p.spec.Source, p.checkpoint, eventCh, p.status)
+	p.mu.Lock()
+	p.src, p.dispatcher = src, dispatcher
+	p.mu.Unlock()
+	p.log.Info("Starting pipeline", "source_slot", p.spec.Source.SlotName)
+	err := src.Start(ctx)
+	cancel()
+	<-done
+	p.mu.Lock()
+	p.src, p.dispatcher = nil, nil
+	p.mu.Unlock()
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// replay writes change files into the pipeline's targets and returns once
+// they are written.
+func (p *pipelineRunner) replay(ctx context.Context, files []string) error {
+	dispatcher := pipeline.NewDispatcher(p.spec.PipelineConfig, p.sink, p.checkpoint)
+	eventCh := make(chan *types.Event, p.spec.BufferSize)
+	src := replay.NewSource(files, p.checkpoint, eventCh)
+	var replayErr error
+	go func() {
+		replayErr = src.Start(ctx)
+		close(eventCh)
+	}()
+	dispatcher.Start(ctx, eventCh)
+	return replayErr
+}
+
+func (p *pipelineRunner) close() error {
+	return p.sink.Close()
+}
+
+func (p *pipelineRunner) running() (*postgres.Source, *pipeline.Dispatcher, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.src == nil {
+		return nil, nil, admin.ErrNotRunning
+	}
+	return p.src, p.dispatcher, nil
+}
+
+func (p *pipelineRunner) PauseSource() error {
+	src, _, err := p.running()
+	if err != nil {
+		return err
+	}
+	src.Pause()
+	p.log.Info("Paused source")
+	return nil
+}
+
+func (p *pipelineRunner) ResumeSource() error {
+	src, _, err := p.running()
+	if err != nil {
+		return err
+	}
+	src.Resume()
+	p.log.Info("Resumed source")
+	return nil
+}
+
+func (p *pipelineRunner) PauseSink(name string) error {
+	gate, ok := p.gates[name]
+	if !ok {
+		return fmt.Errorf("%w %s", admin.ErrUnknownSink, name)
+	}
+	gate.Pause()
+	p.status.Sink(name).SetPaused(true)
+	p.log.Info("Paused sink", "sink", name)
+	return nil
+}
+
+func (p *pipelineRunner) ResumeSink(name string) error {
+	gate, ok := p.gates[name]
+	if !ok {
+		return fmt.Errorf("%w %s", admin.ErrUnknownSink, name)
+	}
+	gate.Resume()
+	p.status.Sink(name).SetPaused(false)
+	p.log.Info("Resumed sink", "sink", name)
+	return nil
+}
+
+func (p *pipelineRunner) Resnapshot(table string) error {
+	src, _, err := p.running()
+	if err != nil {
+		return err
+	}
+	if err := src.Resnapshot(table); err != nil {
+		return err
+	}
+	p.log.Info("Queued snapshot", "table", table)
+	return nil
+}
+
+func (p *pipelineRunner) Skip(from, to types.LSN) error {
+	_, dispatcher, err := p.running()
+	if err != nil {
+		return err
+	}
+	dispatcher.Skip(from, to)
+	p.log.Warn("Skipping changes", "from", from, "to", to)
+	return nil
+}
+
+func (p *pipelineRunner) FlushCheckpoint(ctx context.Context) (types.LSN, error) {
+	src, dispatcher, err := p.running()
+	if err != nil {
+		return 0, err
+	}
+	if err := dispatcher.Flush(ctx); err != nil {
+		return 0, fmt.Errorf("failed to flush batches: %w", err)
+	}
+	if err := src.Confirm(ctx); err != nil {
+		return 0, fmt.Errorf("failed to confirm the safe LSN: %w", err)
+	}
+	return p.checkpoint.GetSafeLSN(), nil
+}
+
+// newSinks creates the sinks of targets, each wrapped with its retry
+// policy, reporting to the pipeline's status and paused by its gate.
+func newSinks(ctx context.Context, log *slog.Logger, targets config.TargetsConfig, cm *pipeline.CheckpointManager, status *telemetry.PipelineStatus, gates map[string]*admin.Gate) ([]sink.Sink, error) {
+	var sinks []sink.Sink
+	wrap := func(name string, s sink.Sink) sink.Sink {
+		gates[name] = &admin.Gate{}
+		return sink.NewGatedSink(sink.NewStatusSink(s, status.Sink(name)), gates[name])
+	}
+	labels := func(name, typ string) sink.Labels {
+		return sink.Labels{Pipeline: status.Name(), Name: name, Type: typ}
+	}
+
+	// Initialize Postgres Sinks
+	for _, t := range targets.Postgres {
+		s, err := sink.NewPostgresSink(ctx, t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init postgres sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "postgres"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized Postgres sink", "name", t.Name)
+	}
+
+	// Initialize ClickHouse Sinks
+	for _, t := range targets.ClickHouse {
+		s, err := sink.NewClickHouseSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init clickhouse sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "clickhouse"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized ClickHouse sink", "name", t.Name)
+	}
+
+	// Initialize Redis Sinks
+	for _, t := range targets.Redis {
+		s, err := sink.NewRedisSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init redis sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "redis"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized Redis sink", "name", t.Name)
+	}
+
+	// Initialize Kafka Sinks
+	for _, t := range targets.Kafka {
+		s, err := sink.NewKafkaSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init kafka sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "kafka"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized Kafka sink", "name", t.Name)
+	}
+
+	// Initialize S3 Sinks
+	for _, t := range targets.S3 {
+		s, err := sink.NewS3Sink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init s3 sink %s: %w", t.Name, err)
+		}
+		// Buffered files are not checkpointed until uploaded
+		cm.Hold(s)
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "s3"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized S3 sink", "name", t.Name)
+	}
+
+	// Initialize File Sinks
+	for _, t := range targets.File {
+		s, err := sink.NewFileSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init file sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "file"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized File sink", "name", t.Name)
+	}
+
+	// Initialize Webhook Sinks
+	for _, t := range targets.Webhook {
+		s, err := sink.NewWebhookSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init webhook sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "webhook"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized Webhook sink", "name", t.Name)
+	}
+
+	// Initialize NATS Sinks
+	for _, t := range targets.NATS {
+		s, err := sink.NewNatsSink(ctx, t, status.Name())
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init nats sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "nats"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized NATS sink", "name", t.Name)
+	}
+
+	// Initialize MySQL Sinks
+	for _, t := range targets.MySQL {
+		s, err := sink.NewMySQLSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init mysql sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "mysql"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized MySQL sink", "name", t.Name)
+	}
+
+	// Initialize Elasticsearch Sinks
+	for _, t := range targets.Elasticsearch {
+		s, err := sink.NewElasticsearchSink(t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init elasticsearch sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "elasticsearch"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized Elasticsearch sink", "name", t.Name)
+	}
+
+	// Initialize SQLite Sinks
+	for _, t := range targets.SQLite {
+		s, err := sink.NewSQLiteSink(ctx, t)
+		if err != nil {
+			closeSinks(sinks)
+			return nil, fmt.Errorf("failed to init sqlite sink %s: %w", t.Name, err)
+		}
+		// Wrap with Retry
+		rs := sink.NewRetrySink(labels(t.Name, "sqlite"), s, t.Retry)
+		sinks = append(sinks, wrap(t.Name, rs))
+		log.Info("Initialized SQLite sink", "name", t.Name, "applied_lsn", s.AppliedLSN())
+	}
+
+	return sinks, nil
+}
+
+func closeSinks(sinks []sink.Sink) {
+	for _, s := range sinks {
+		s.Close()
+	}
+}
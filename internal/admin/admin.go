@@ -0,0 +1,177 @@
+// Package admin serves an authenticated HTTP API to control running
+// pipelines: pausing and resuming the source or a sink, re-snapshotting a
+// table, skipping LSN ranges and flushing the checkpoint.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+var (
+	// ErrUnknownSink is returned for a sink the pipeline does not have.
+	ErrUnknownSink = errors.New("unknown sink")
+	// ErrNotRunning is returned for operations that need a running source.
+	ErrNotRunning = errors.New("pipeline is not running")
+)
+
+// Pipeline is the control surface of one pipeline.
+type Pipeline interface {
+	PauseSource() error
+	ResumeSource() error
+	PauseSink(name string) error
+	ResumeSink(name string) error
+	// Resnapshot queues a snapshot of table, "table" or "schema.table",
+	// whose rows are written as inserts.
+	Resnapshot(table string) error
+	// Skip drops the changes with LSNs in [from, to] without writing them.
+	Skip(from, to types.LSN) error
+	// FlushCheckpoint writes buffered batches, confirms the safe LSN to
+	// the source and returns it.
+	FlushCheckpoint(ctx context.Context) (types.LSN, error)
+}
+
+// Server routes admin requests to the registered pipelines. Every request
+// must carry the token as "Authorization: Bearer <token>".
+type Server struct {
+	token string
+	mux   *http.ServeMux
+
+	mu        sync.Mutex
+	pipelines map[string]Pipeline
+}
+
+func NewServer(token string) *Server {
+	s := &Server{token: token, mux: http.NewServeMux(), pipelines: make(map[string]Pipeline)}
+	s.handle("POST /admin/pipelines/{pipeline}/source/pause", func(r *http.Request, p Pipeline) (interface{}, error) {
+		return nil, p.PauseSource()
+	})
+	s.handle("POST /admin/pipelines/{pipeline}/source/resume", func(r *http.Request, p Pipeline) (interface{}, error) {
+		return nil, p.ResumeSource()
+	})
+	s.handle("POST /admin/pipelines/{pipeline}/sinks/{sink}/pause", func(r *http.Request, p Pipeline) (interface{}, error) {
+		return nil, p.PauseSink(r.PathValue("sink"))
+	})
+	s.handle("POST /admin/pipelines/{pipeline}/sinks/{sink}/resume", func(r *http.Request, p Pipeline) (interface{}, error) {
+		return nil, p.ResumeSink(r.PathValue("sink"))
+	})
+	s.handle("POST /admin/pipelines/{pipeline}/resnapshot", func(r *http.Request, p Pipeline) (interface{}, error) {
+		var req struct {
+			Table string `json:"table"`
+		}
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, err
+		}
+		if req.Table == "" {
+			return nil, badRequest("table is required")
+		}
+		return nil, p.Resnapshot(req.Table)
+	})
+	s.handle("POST /admin/pipelines/{pipeline}/skip", func(r *http.Request, p Pipeline) (interface{}, error) {
+		var req struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		}
+		if err := decodeRequest(r, &req); err != nil {
+			return nil, err
+		}
+		from, err := types.ParseLSN(req.From)
+		if err != nil {
+			return nil, badRequest("from: " + err.Error())
+		}
+		to, err := types.ParseLSN(req.To)
+		if err != nil {
+			return nil, badRequest("to: " + err.Error())
+		}
+		if from > to {
+			return nil, badRequest("from is after to")
+		}
+		return nil, p.Skip(from, to)
+	})
+	s.handle("POST /admin/pipelines/{pipeline}/checkpoint", func(r *http.Request, p Pipeline) (interface{}, error) {
+		lsn, err := p.FlushCheckpoint(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"safe_lsn": lsn.String()}, nil
+	})
+	return s
+}
+
+// Register makes a pipeline controllable under its name.
+func (s *Server) Register(name string, p Pipeline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipelines[name] = p
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(auth), []byte(s.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing token"})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handle registers an operation on the pipeline named in the path. A nil
+// result is answered with {"status": "ok"}.
+func (s *Server) handle(pattern string, op func(r *http.Request, p Pipeline) (interface{}, error)) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("pipeline")
+		s.mu.Lock()
+		p, ok := s.pipelines[name]
+		s.mu.Unlock()
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown pipeline %s", name)})
+			return
+		}
+
+		result, err := op(r, p)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var badReq badRequest
+			switch {
+			case errors.As(err, &badReq):
+				status = http.StatusBadRequest
+			case errors.Is(err, ErrUnknownSink):
+				status = http.StatusNotFound
+			case errors.Is(err, ErrNotRunning):
+				status = http.StatusConflict
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		if result == nil {
+			result = map[string]string{"status": "ok"}
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+}
+
+// badRequest is an invalid request body.
+type badRequest string
+
+func (e badRequest) Error() string { return string(e) }
+
+func decodeRequest(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return badRequest("invalid request body: " + err.Error())
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,139 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// fakePipeline records the operations it receives.
+type fakePipeline struct {
+	ops     []string
+	running bool
+}
+
+func (f *fakePipeline) do(op string) error {
+	if !f.running {
+		return ErrNotRunning
+	}
+	f.ops = append(f.ops, op)
+	return nil
+}
+
+func (f *fakePipeline) PauseSource() error  { return f.do("pause source") }
+func (f *fakePipeline) ResumeSource() error { return f.do("resume source") }
+
+func (f *fakePipeline) PauseSink(name string) error {
+	if name != "pg1" {
+		return fmt.Errorf("%w %s", ErrUnknownSink, name)
+	}
+	return f.do("pause " + name)
+}
+
+func (f *fakePipeline) ResumeSink(name string) error  { return f.do("resume " + name) }
+func (f *fakePipeline) Resnapshot(table string) error { return f.do("resnapshot " + table) }
+
+func (f *fakePipeline) Skip(from, to types.LSN) error {
+	return f.do(fmt.Sprintf("skip %s-%s", from, to))
+}
+
+func (f *fakePipeline) FlushCheckpoint(ctx context.Context) (types.LSN, error) {
+	return 0x16B3748, f.do("checkpoint")
+}
+
+func TestServer(t *testing.T) {
+	p := &fakePipeline{running: true}
+	s := NewServer("secret")
+	s.Register("orders", p)
+
+	request := func(token, path, body string) (int, map[string]string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		var resp map[string]string
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		body   string
+		status int
+	}{
+		{"missing token", "", "/admin/pipelines/orders/source/pause", "", http.StatusUnauthorized},
+		{"wrong token", "guess", "/admin/pipelines/orders/source/pause", "", http.StatusUnauthorized},
+		{"pause source", "secret", "/admin/pipelines/orders/source/pause", "", http.StatusOK},
+		{"resume source", "secret", "/admin/pipelines/orders/source/resume", "", http.StatusOK},
+		{"pause sink", "secret", "/admin/pipelines/orders/sinks/pg1/pause", "", http.StatusOK},
+		{"unknown sink", "secret", "/admin/pipelines/orders/sinks/nope/pause", "", http.StatusNotFound},
+		{"unknown pipeline", "secret", "/admin/pipelines/users/source/pause", "", http.StatusNotFound},
+		{"resnapshot", "secret", "/admin/pipelines/orders/resnapshot", `{"table":"public.users"}`, http.StatusOK},
+		{"resnapshot without table", "secret", "/admin/pipelines/orders/resnapshot", `{}`, http.StatusBadRequest},
+		{"skip", "secret", "/admin/pipelines/orders/skip", `{"from":"0/10","to":"0/20"}`, http.StatusOK},
+		{"skip reversed range", "secret", "/admin/pipelines/orders/skip", `{"from":"0/20","to":"0/10"}`, http.StatusBadRequest},
+		{"skip invalid LSN", "secret", "/admin/pipelines/orders/skip", `{"from":"x","to":"0/10"}`, http.StatusBadRequest},
+		{"checkpoint", "secret", "/admin/pipelines/orders/checkpoint", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, resp := request(tt.token, tt.path, tt.body); status != tt.status {
+				t.Errorf("Expected status %d, got %d (%v)", tt.status, status, resp)
+			}
+		})
+	}
+
+	want := []string{"pause source", "resume source", "pause pg1", "resnapshot public.users", "skip 0/10-0/20", "checkpoint"}
+	if strings.Join(p.ops, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected operations %v, got %v", want, p.ops)
+	}
+	if _, resp := request("secret", "/admin/pipelines/orders/checkpoint", ""); resp["safe_lsn"] != "0/16B3748" {
+		t.Errorf("Expected the safe LSN, got %v", resp)
+	}
+
+	p.running = false
+	if status, _ := request("secret", "/admin/pipelines/orders/source/pause", ""); status != http.StatusConflict {
+		t.Errorf("Expected 409 for a stopped pipeline, got %d", status)
+	}
+}
+
+func TestGate(t *testing.T) {
+	var g Gate
+	ctx := context.Background()
+	if err := g.Wait(ctx); err != nil {
+		t.Fatalf("Expected an open gate, got %v", err)
+	}
+
+	g.Pause()
+	if !g.Paused() {
+		t.Error("Expected the gate to be paused")
+	}
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := g.Wait(timeout); err == nil {
+		t.Error("Expected Wait to block while paused")
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Wait(ctx) }()
+	g.Resume()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected Wait to return on resume, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Wait did not return on resume")
+	}
+}
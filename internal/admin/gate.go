@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"context"
+	"sync"
+)
+
+// Gate holds back a stage of a pipeline, such as the source or a sink,
+// while it is paused. The zero value is an open gate.
+type Gate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // Closed on Resume; nil while open
+}
+
+// Pause closes the gate.
+func (g *Gate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+// Resume opens the gate, releasing everyone waiting on it.
+func (g *Gate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// Paused reports whether the gate is closed.
+func (g *Gate) Paused() bool {
+	return g.Resumed() != nil
+}
+
+// Resumed returns a channel that is closed when the gate opens, or nil if
+// it is open.
+func (g *Gate) Resumed() <-chan struct{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.resumed
+}
+
+// Wait blocks while the gate is closed.
+func (g *Gate) Wait(ctx context.Context) error {
+	resumed := g.Resumed()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
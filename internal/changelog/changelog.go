@@ -0,0 +1,328 @@
+// Package changelog reads and writes change events as newline-delimited
+// JSON or CSV, the format of file targets and the replay source.
+package changelog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// Record is one JSON line.
+type Record struct {
+	Op        types.EventType        `json:"op"`
+	Schema    string                 `json:"schema"`
+	Table     string                 `json:"table"`
+	LSN       string                 `json:"lsn"`
+	Timestamp time.Time              `json:"ts"`
+	Columns   map[string]interface{} `json:"columns,omitempty"`
+	Identity  map[string]interface{} `json:"identity,omitempty"`
+}
+
+// MarshalJSON renders an event as a JSON line, without the newline.
+func MarshalJSON(e *types.Event) ([]byte, error) {
+	return json.Marshal(Record{
+		Op:        e.Type,
+		Schema:    e.Schema,
+		Table:     e.Table,
+		LSN:       e.LSN.String(),
+		Timestamp: e.Timestamp,
+		Columns:   e.Columns,
+		Identity:  e.Identity,
+	})
+}
+
+// CSV metadata columns, followed by the table's columns. Deletes only set
+// their identity columns. NULL, and columns a row does not have, are
+// written as \N; values are read back as strings.
+const (
+	CSVOp       = "_op"
+	CSVLSN      = "_lsn"
+	CSVCommitTs = "_commit_ts"
+	CSVKey      = "_key" // Space-separated identity column names
+	CSVNull     = `\N`
+)
+
+// CSVHeader returns the header of a CSV file for the event's table: the
+// metadata columns and the event's columns, sorted.
+func CSVHeader(e *types.Event) []string {
+	row := e.Columns
+	if e.Type == types.EventDelete {
+		row = e.Identity
+	}
+	cols := make([]string, 0, len(row))
+	for col := range row {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return append([]string{CSVOp, CSVLSN, CSVCommitTs, CSVKey}, cols...)
+}
+
+// CSVRecord renders an event for a file with the given header. It returns
+// false if the event has a column the header does not.
+func CSVRecord(header []string, e *types.Event) ([]string, bool) {
+	row := e.Columns
+	if e.Type == types.EventDelete {
+		row = e.Identity
+	}
+	keys := make([]string, 0, len(e.Identity))
+	for col := range e.Identity {
+		keys = append(keys, col)
+	}
+	sort.Strings(keys)
+
+	rec := make([]string, len(header))
+	found := 0
+	for i, col := range header {
+		switch col {
+		case CSVOp:
+			rec[i] = string(e.Type)
+		case CSVLSN:
+			rec[i] = e.LSN.String()
+		case CSVCommitTs:
+			rec[i] = e.Timestamp.Format(time.RFC3339Nano)
+		case CSVKey:
+			rec[i] = strings.Join(keys, " ")
+		default:
+			v, ok := row[col]
+			switch {
+			case !ok || v == nil:
+				rec[i] = CSVNull
+			default:
+				rec[i] = csvValue(v)
+			}
+			if ok {
+				found++
+			}
+		}
+	}
+	return rec, found == len(row)
+}
+
+func csvValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprint(x)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// Extension returns the file name extension of a format and compression,
+// e.g. ".jsonl.gz".
+func Extension(format, compression string) string {
+	ext := "." + format
+	switch compression {
+	case "gzip":
+		ext += ".gz"
+	case "zstd":
+		ext += ".zst"
+	}
+	return ext
+}
+
+// Reader reads the events of one file.
+type Reader struct {
+	closers []io.Closer
+	lines   *bufio.Scanner // JSONL
+	csv     *csv.Reader    // CSV
+	header  []string
+	schema  string
+	table   string
+}
+
+// Open opens a file written by a file target. The format and compression
+// are taken from the extension. The schema and table of CSV files come
+// from their "<schema>.<table>" directory.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{closers: []io.Closer{f}}
+	var in io.Reader = f
+
+	name := path
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		r.closers = append(r.closers, gz)
+		in, name = gz, strings.TrimSuffix(name, ".gz")
+	case strings.HasSuffix(name, ".zst"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		r.closers = append(r.closers, zr.IOReadCloser())
+		in, name = zr, strings.TrimSuffix(name, ".zst")
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".jsonl"):
+		r.lines = bufio.NewScanner(in)
+		r.lines.Buffer(make([]byte, 64*1024), 64<<20)
+	case strings.HasSuffix(name, ".csv"):
+		schema, table, ok := strings.Cut(filepath.Base(filepath.Dir(path)), ".")
+		if !ok {
+			r.Close()
+			return nil, fmt.Errorf("csv file %s is not in a <schema>.<table> directory", path)
+		}
+		r.schema, r.table = schema, table
+		r.csv = csv.NewReader(in)
+		r.csv.FieldsPerRecord = -1
+	default:
+		r.Close()
+		return nil, fmt.Errorf("unknown change file format: %s", path)
+	}
+	return r, nil
+}
+
+// Next returns the next event, or io.EOF. A file cut short by a crash,
+// whose compressed stream has no trailer, ends at its last complete line.
+func (r *Reader) Next() (*types.Event, error) {
+	if r.lines != nil {
+		return r.nextJSON()
+	}
+	return r.nextCSV()
+}
+
+func (r *Reader) nextJSON() (*types.Event, error) {
+	for r.lines.Scan() {
+		line := r.lines.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(string(line)))
+		dec.UseNumber()
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			return nil, fmt.Errorf("invalid change line: %w", err)
+		}
+		lsn, err := types.ParseLSN(rec.LSN)
+		if err != nil {
+			return nil, err
+		}
+		return &types.Event{
+			Type:      rec.Op,
+			Schema:    rec.Schema,
+			Table:     rec.Table,
+			Columns:   numbers(rec.Columns),
+			Identity:  numbers(rec.Identity),
+			LSN:       lsn,
+			Timestamp: rec.Timestamp,
+		}, nil
+	}
+	if err := r.lines.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// numbers turns JSON numbers into int64 where they are integers and
+// float64 otherwise.
+func numbers(row map[string]interface{}) map[string]interface{} {
+	for col, v := range row {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i, err := n.Int64(); err == nil {
+			row[col] = i
+		} else if f, err := n.Float64(); err == nil {
+			row[col] = f
+		} else {
+			row[col] = n.String()
+		}
+	}
+	return row
+}
+
+func (r *Reader) nextCSV() (*types.Event, error) {
+	rec, err := r.csv.Read()
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.header == nil {
+		r.header = rec
+		return r.nextCSV()
+	}
+	if len(rec) != len(r.header) {
+		return nil, fmt.Errorf("csv record has %d fields, header has %d", len(rec), len(r.header))
+	}
+
+	e := &types.Event{Schema: r.schema, Table: r.table}
+	row := make(map[string]interface{})
+	var keys []string
+	for i, col := range r.header {
+		v := rec[i]
+		switch col {
+		case CSVOp:
+			e.Type = types.EventType(v)
+		case CSVLSN:
+			if e.LSN, err = types.ParseLSN(v); err != nil {
+				return nil, err
+			}
+		case CSVCommitTs:
+			if e.Timestamp, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				return nil, fmt.Errorf("invalid commit timestamp %q: %w", v, err)
+			}
+		case CSVKey:
+			keys = strings.Fields(v)
+		default:
+			if v == CSVNull {
+				row[col] = nil
+			} else {
+				row[col] = v
+			}
+		}
+	}
+
+	e.Identity = make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		e.Identity[k] = row[k]
+	}
+	if e.Type != types.EventDelete {
+		e.Columns = row
+	}
+	return e, nil
+}
+
+// Close closes the file.
+func (r *Reader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if cerr := r.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -3,9 +3,13 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nikolay-makurin/replicator/internal/keytemplate"
 	"github.com/spf13/viper"
 )
 
@@ -13,7 +17,9 @@ type Config struct {
 	Source    SourceConfig    `mapstructure:"source"`
 	Targets   TargetsConfig   `mapstructure:"targets"`
 	Pipeline  PipelineConfig  `mapstructure:"pipeline"`
+	Pipelines []PipelineSpec  `mapstructure:"pipelines"` // Replaces source, targets and pipeline
 	Telemetry TelemetryConfig `mapstructure:"telemetry"`
+	Admin     AdminConfig     `mapstructure:"admin"`
 }
 
 type SourceConfig struct {
@@ -26,6 +32,15 @@ type TargetsConfig struct {
 	Postgres   []PostgresTarget   `mapstructure:"postgres"`
 	ClickHouse []ClickHouseTarget `mapstructure:"clickhouse"`
 	Redis      []RedisTarget      `mapstructure:"redis"`
+	Kafka      []KafkaTarget      `mapstructure:"kafka"`
+	S3         []S3Target         `mapstructure:"s3"`
+	File       []FileTarget       `mapstructure:"file"`
+	Webhook    []WebhookTarget    `mapstructure:"webhook"`
+	NATS       []NATSTarget       `mapstructure:"nats"`
+	MySQL      []MySQLTarget      `mapstructure:"mysql"`
+
+	Elasticsearch []ElasticsearchTarget `mapstructure:"elasticsearch"`
+	SQLite        []SQLiteTarget        `mapstructure:"sqlite"`
 }
 
 type TargetBase struct {
@@ -40,15 +55,269 @@ type PostgresTarget struct {
 	ConnectionString string `mapstructure:"connection_string"`
 }
 
+// MySQLTarget applies changes to MySQL or MariaDB. Tables are written to
+// the database of the connection string under their Postgres table name.
+type MySQLTarget struct {
+	TargetBase       `mapstructure:",squash"`
+	ConnectionString string `mapstructure:"connection_string"` // e.g. "user:pass@tcp(localhost:3306)/app"
+	MaxOpenConns     int    `mapstructure:"max_open_conns"`
+}
+
+// SQLiteTarget replicates tables into a local SQLite file, creating them
+// from the source's column definitions.
+type SQLiteTarget struct {
+	TargetBase `mapstructure:",squash"`
+	Path       string   `mapstructure:"path"`   // Database file
+	Tables     []string `mapstructure:"tables"` // "table" or "schema.table"; empty replicates every table
+}
+
 type ClickHouseTarget struct {
 	TargetBase       `mapstructure:",squash"`
 	ConnectionString string `mapstructure:"connection_string"`
+	DeleteStrategy   string `mapstructure:"delete_strategy"` // lightweight, is_deleted or collapsing
+
+	// Connection
+	Hosts        []string `mapstructure:"hosts"`       // Extra host:port addresses, e.g. other shards or replicas
+	Compression  string   `mapstructure:"compression"` // none, lz4 or zstd; empty keeps the DSN setting
+	MaxOpenConns int      `mapstructure:"max_open_conns"`
+	MaxIdleConns int      `mapstructure:"max_idle_conns"`
+
+	// Insert settings
+	AsyncInsert        bool  `mapstructure:"async_insert"`
+	WaitForAsyncInsert *bool `mapstructure:"wait_for_async_insert"` // Defaults to true
+	InsertQuorum       int   `mapstructure:"insert_quorum"`
+	DeduplicationToken bool  `mapstructure:"deduplication_token"` // Derive insert_deduplication_token from the batch LSN range
+
+	// Distributed tables
+	Cluster           string `mapstructure:"cluster"`            // Runs lightweight deletes ON CLUSTER against the local tables
+	DistributedSuffix string `mapstructure:"distributed_suffix"` // Insert into <table><suffix>, e.g. "_dist"
 }
 
+// ClickHouse delete strategies
+const (
+	// DeleteLightweight issues one DELETE ... WHERE key IN (...) per table per batch.
+	DeleteLightweight = "lightweight"
+	// DeleteIsDeleted inserts tombstones for ReplacingMergeTree(_version, _is_deleted).
+	DeleteIsDeleted = "is_deleted"
+	// DeleteCollapsing inserts _sign rows for VersionedCollapsingMergeTree(_sign, _version).
+	DeleteCollapsing = "collapsing"
+)
+
 type RedisTarget struct {
 	TargetBase       `mapstructure:",squash"`
-	ConnectionString string `mapstructure:"connection_string"`
-	KeyPattern       string `mapstructure:"key_pattern"` // e.g. "users:{{.id}}"
+	ConnectionString string `mapstructure:"connection_string"` // Standalone node, e.g. "redis://host:6379/0"
+
+	// Cluster or Sentinel, used instead of connection_string
+	Addrs            []string `mapstructure:"addrs"`       // Cluster seed nodes or sentinel addresses
+	Cluster          bool     `mapstructure:"cluster"`     // Cluster mode even with a single seed
+	MasterName       string   `mapstructure:"master_name"` // Sentinel master name
+	Username         string   `mapstructure:"username"`
+	Password         string   `mapstructure:"password"`
+	SentinelPassword string   `mapstructure:"sentinel_password"`
+	DB               int      `mapstructure:"db"`
+	MaxRedirects     int      `mapstructure:"max_redirects"` // MOVED/ASK redirects followed per command
+
+	KeyPattern   string         `mapstructure:"key_pattern"`    // e.g. "users:{{.id}}"; names the stream in stream mode
+	Mode         string         `mapstructure:"mode"`           // string, hash, json or stream
+	StreamMaxLen int64          `mapstructure:"stream_max_len"` // Approximate MAXLEN cap per stream
+	Envelope     EnvelopeConfig `mapstructure:"envelope"`       // Stream entry layout
+
+	TTL          time.Duration               `mapstructure:"ttl"`           // Key expiration; 0 keeps keys forever
+	VersionGuard bool                        `mapstructure:"version_guard"` // Skip writes older than the stored LSN
+	TombstoneTTL time.Duration               `mapstructure:"tombstone_ttl"` // How long the LSN of a deleted row is kept when ttl is 0
+	Tables       map[string]RedisTableConfig `mapstructure:"tables"`        // Per-table settings, keyed by table name
+
+	// Change notifications, published in the same pipeline as the write
+	PublishChannel string `mapstructure:"publish_channel"` // e.g. "changes:{{.table}}"; empty disables publishing
+	PublishRow     bool   `mapstructure:"publish_row"`     // Include the row in the message
+}
+
+type RedisTableConfig struct {
+	KeyPattern string        `mapstructure:"key_pattern"` // Overrides the target key pattern
+	TTL        time.Duration `mapstructure:"ttl"`         // Overrides the target TTL
+	Indexes    []RedisIndex  `mapstructure:"indexes"`
+	Identity   []string      `mapstructure:"identity"` // Replica identity columns; the key and channel may only use these
+}
+
+// RedisIndex maintains a set (or sorted set) per rendered key holding the
+// keys of the rows that map to it, e.g. "users:by_email:{{.email}}".
+type RedisIndex struct {
+	KeyPattern string `mapstructure:"key_pattern"`
+	Type       string `mapstructure:"type"`  // set (default) or zset
+	Score      string `mapstructure:"score"` // zset score column; defaults to the commit time in ms
+}
+
+// Redis data structure modes
+const (
+	RedisModeString = "string" // SET key json(row)
+	RedisModeHash   = "hash"   // HSET key column value ...
+	RedisModeJSON   = "json"   // JSON.SET key $ json(row)
+	RedisModeStream = "stream" // XADD stream MAXLEN ~ n op ... data json(row)
+)
+
+type KafkaTarget struct {
+	TargetBase   `mapstructure:",squash"`
+	Brokers      []string       `mapstructure:"brokers"`
+	ClientID     string         `mapstructure:"client_id"`
+	TopicPattern string         `mapstructure:"topic_pattern"` // Key template, e.g. "cdc.{{.schema}}.{{.table}}"
+	Format       string         `mapstructure:"format"`        // json, avro or protobuf
+	Envelope     EnvelopeConfig `mapstructure:"envelope"`      // Record value layout; debezium requires json
+
+	// Typed Avro: with a registry, format avro writes one schema per table
+	SchemaRegistry SchemaRegistryConfig `mapstructure:"schema_registry"`
+
+	// Producer
+	Acks        string        `mapstructure:"acks"`        // all, leader or none
+	Idempotent  *bool         `mapstructure:"idempotent"`  // Defaults to true; requires acks=all
+	Compression string        `mapstructure:"compression"` // none, gzip, snappy, lz4 or zstd
+	Linger      time.Duration `mapstructure:"linger"`
+}
+
+// SchemaRegistryConfig points a Kafka target at a Confluent-compatible
+// schema registry.
+type SchemaRegistryConfig struct {
+	URL      string        `mapstructure:"url"`
+	Username string        `mapstructure:"username"`
+	Password string        `mapstructure:"password"`
+	Timeout  time.Duration `mapstructure:"timeout"` // Per request
+}
+
+// Kafka payload formats
+const (
+	KafkaFormatJSON     = "json"
+	KafkaFormatAvro     = "avro"
+	KafkaFormatProtobuf = "protobuf"
+)
+
+// S3Target writes Parquet files to S3-compatible object storage. BatchSize
+// is the maximum number of rows per file and BatchInterval the maximum age
+// of a file before it is uploaded.
+type S3Target struct {
+	TargetBase      `mapstructure:",squash"`
+	Endpoint        string `mapstructure:"endpoint"` // host:port, e.g. "s3.amazonaws.com" or "localhost:9000"
+	Region          string `mapstructure:"region"`
+	Bucket          string `mapstructure:"bucket"`
+	Prefix          string `mapstructure:"prefix"` // Object key prefix, e.g. "cdc/"
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	UseSSL          bool   `mapstructure:"use_ssl"`
+
+	RollSize    int64  `mapstructure:"roll_size"`   // Approximate file size in bytes that triggers an upload
+	Compression string `mapstructure:"compression"` // snappy, zstd, gzip or none
+}
+
+// FileTarget writes the change stream to local files for archiving and
+// debugging. The files can be replayed with the -replay flag.
+type FileTarget struct {
+	TargetBase  `mapstructure:",squash"`
+	Path        string         `mapstructure:"path"`        // Directory the files are written to
+	Format      string         `mapstructure:"format"`      // jsonl or csv (one file per table)
+	Compression string         `mapstructure:"compression"` // none, gzip or zstd
+	MaxSize     int64          `mapstructure:"max_size"`    // Rotate after this many uncompressed bytes
+	MaxAge      time.Duration  `mapstructure:"max_age"`     // Rotate files older than this
+	Fsync       *bool          `mapstructure:"fsync"`       // Sync files before a batch is acknowledged; defaults to true
+	Envelope    EnvelopeConfig `mapstructure:"envelope"`    // JSON line layout; debezium requires jsonl
+}
+
+// File formats
+const (
+	FileFormatJSONL = "jsonl"
+	FileFormatCSV   = "csv"
+)
+
+// WebhookTarget sends batches of changes to an HTTP endpoint.
+type WebhookTarget struct {
+	TargetBase  `mapstructure:",squash"`
+	URL         string            `mapstructure:"url"`
+	Method      string            `mapstructure:"method"`      // Defaults to POST
+	Format      string            `mapstructure:"format"`      // json or cloudevents
+	Headers     map[string]string `mapstructure:"headers"`     // Values are templates over schema, table, count, first_lsn and last_lsn
+	Secret      string            `mapstructure:"secret"`      // Signs requests with HMAC-SHA256 if set
+	Mode        string            `mapstructure:"mode"`        // per_batch or per_table
+	Concurrency int               `mapstructure:"concurrency"` // Maximum number of requests in flight
+	Timeout     time.Duration     `mapstructure:"timeout"`     // Per request
+	Envelope    EnvelopeConfig    `mapstructure:"envelope"`    // Layout of each change in the payload
+}
+
+// Webhook payload formats and request modes
+const (
+	WebhookFormatJSON        = "json"
+	WebhookFormatCloudEvents = "cloudevents"
+
+	WebhookModeBatch = "per_batch"
+	WebhookModeTable = "per_table"
+)
+
+// EnvelopeConfig selects the layout of the change messages written by the
+// message sinks (Redis streams, files, webhooks and Kafka).
+type EnvelopeConfig struct {
+	Type     string `mapstructure:"type"`     // native or debezium
+	Schema   bool   `mapstructure:"schema"`   // Debezium: wrap messages with their JSON Schema
+	Name     string `mapstructure:"name"`     // Debezium: logical server name; defaults to the slot name
+	Database string `mapstructure:"database"` // Debezium: source.db; defaults to the source database
+}
+
+// Envelope types
+const (
+	EnvelopeNative   = "native"
+	EnvelopeDebezium = "debezium"
+)
+
+// setDefaults fills the Debezium source block from the source settings.
+func (e *EnvelopeConfig) setDefaults(src SourceConfig) {
+	if e.Type == "" {
+		e.Type = EnvelopeNative
+	}
+	if e.Type != EnvelopeDebezium {
+		return
+	}
+	if e.Name == "" {
+		e.Name = src.SlotName
+	}
+	if e.Database == "" {
+		if pgCfg, err := pgconn.ParseConfig(src.ConnectionString); err == nil {
+			e.Database = pgCfg.Database
+		}
+	}
+}
+
+func (e *EnvelopeConfig) validate() error {
+	switch e.Type {
+	case "", EnvelopeNative, EnvelopeDebezium:
+	default:
+		return fmt.Errorf("envelope.type %q is invalid (expected %s or %s)", e.Type, EnvelopeNative, EnvelopeDebezium)
+	}
+	return nil
+}
+
+// ElasticsearchTarget indexes rows into Elasticsearch or OpenSearch with
+// the bulk API, one document per row.
+type ElasticsearchTarget struct {
+	TargetBase   `mapstructure:",squash"`
+	URLs         []string                            `mapstructure:"urls"` // e.g. "http://localhost:9200"
+	Username     string                              `mapstructure:"username"`
+	Password     string                              `mapstructure:"password"`
+	APIKey       string                              `mapstructure:"api_key"`
+	IndexPattern string                              `mapstructure:"index_pattern"` // Key template, e.g. "cdc-{{.table}}"
+	Tables       map[string]ElasticsearchTableConfig `mapstructure:"tables"`        // Per-table settings, keyed by table name
+	Timeout      time.Duration                       `mapstructure:"timeout"`       // Per bulk request
+}
+
+type ElasticsearchTableConfig struct {
+	IndexPattern string `mapstructure:"index_pattern"` // Overrides the target index pattern
+}
+
+// NATSTarget publishes changes to NATS JetStream on subjects
+// "<subject_prefix>.<schema>.<table>.<op>".
+type NATSTarget struct {
+	TargetBase      `mapstructure:",squash"`
+	URL             string        `mapstructure:"url"` // e.g. "nats://localhost:4222", comma-separated for a cluster
+	CredentialsFile string        `mapstructure:"credentials_file"`
+	Token           string        `mapstructure:"token"`
+	SubjectPrefix   string        `mapstructure:"subject_prefix"`
+	Stream          string        `mapstructure:"stream"`           // Created or updated to capture "<subject_prefix>.>" if set
+	DuplicateWindow time.Duration `mapstructure:"duplicate_window"` // Deduplication window of a created stream
+	AckTimeout      time.Duration `mapstructure:"ack_timeout"`      // Maximum wait for the publish acks of a batch
 }
 
 type RetryConfig struct {
@@ -66,14 +335,41 @@ func (r *RetryConfig) setDefaults() {
 }
 
 type PipelineConfig struct {
+	Name          string        `mapstructure:"name"` // Labels logs and metrics; "default" for the top-level pipeline
 	WorkerCount   int           `mapstructure:"worker_count"`
 	BufferSize    int           `mapstructure:"buffer_size"`
 	BatchSize     int           `mapstructure:"batch_size"`
 	BatchInterval time.Duration `mapstructure:"batch_interval"`
+	Compact       bool          `mapstructure:"compact"` // Collapse events per row before writing
+}
+
+// PipelineSpec is an entry of the pipelines list: a source, the targets it
+// feeds and the settings of its worker pool. Each runs with its own
+// checkpoint, so one failing pipeline does not stop the others.
+type PipelineSpec struct {
+	PipelineConfig `mapstructure:",squash"`
+	Source         SourceConfig  `mapstructure:"source"`
+	Targets        TargetsConfig `mapstructure:"targets"`
 }
 
 type TelemetryConfig struct {
-	Address string `mapstructure:"address"`
+	Address      string        `mapstructure:"address"`
+	FlushTimeout time.Duration `mapstructure:"flush_timeout"` // Time a sink may go without flushing waiting changes before /readyz fails
+	Tracing      TracingConfig `mapstructure:"tracing"`
+}
+
+// TracingConfig exports OpenTelemetry traces over OTLP/HTTP.
+type TracingConfig struct {
+	Endpoint    string            `mapstructure:"endpoint"` // Collector URL, e.g. "http://otel-collector:4318"; empty disables tracing
+	Headers     map[string]string `mapstructure:"headers"`  // Sent with every export, e.g. for authentication
+	ServiceName string            `mapstructure:"service_name"`
+	SampleRatio float64           `mapstructure:"sample_ratio"` // Fraction of transactions and batches traced, 0 to 1
+}
+
+// AdminConfig enables the admin API on the telemetry server. Requests must
+// carry the token as a bearer token.
+type AdminConfig struct {
+	Token string `mapstructure:"token"` // Empty disables the API
 }
 
 func Load(configPath string) (*Config, error) {
@@ -88,6 +384,11 @@ func Load(configPath string) (*Config, error) {
 	v.SetDefault("pipeline.batch_size", 1000)
 	v.SetDefault("pipeline.batch_interval", 1*time.Second)
 	v.SetDefault("telemetry.address", ":9090")
+	v.SetDefault("telemetry.flush_timeout", 1*time.Minute)
+	v.SetDefault("telemetry.tracing.endpoint", "") // Lets REPLICATOR_TELEMETRY_TRACING_ENDPOINT set it
+	v.SetDefault("telemetry.tracing.service_name", "replicator")
+	v.SetDefault("telemetry.tracing.sample_ratio", 0.1)
+	v.SetDefault("admin.token", "") // Lets REPLICATOR_ADMIN_TOKEN set it
 
 	// Read config file if provided
 	if configPath != "" {
@@ -112,49 +413,314 @@ func Load(configPath string) (*Config, error) {
 }
 
 func (c *Config) setDefaults() {
-	for i := range c.Targets.Postgres {
-		if c.Targets.Postgres[i].BatchSize == 0 {
-			c.Targets.Postgres[i].BatchSize = 1000 // Default
+	if c.Pipeline.Name == "" {
+		c.Pipeline.Name = "default"
+	}
+	c.Targets.setDefaults(c.Source)
+
+	for i := range c.Pipelines {
+		c.Pipelines[i].PipelineConfig.setDefaults()
+		c.Pipelines[i].Targets.setDefaults(c.Pipelines[i].Source)
+	}
+}
+
+// setDefaults fills the settings the pipelines list has no viper defaults
+// for.
+func (p *PipelineConfig) setDefaults() {
+	if p.WorkerCount == 0 {
+		p.WorkerCount = 4 // Default
+	}
+	if p.BufferSize == 0 {
+		p.BufferSize = 10000 // Default
+	}
+	if p.BatchSize == 0 {
+		p.BatchSize = 1000 // Default
+	}
+	if p.BatchInterval == 0 {
+		p.BatchInterval = 1 * time.Second // Default
+	}
+}
+
+func (targets *TargetsConfig) setDefaults(src SourceConfig) {
+	for i := range targets.Postgres {
+		if targets.Postgres[i].BatchSize == 0 {
+			targets.Postgres[i].BatchSize = 1000 // Default
+		}
+		if targets.Postgres[i].BatchInterval == 0 {
+			targets.Postgres[i].BatchInterval = 1 * time.Second // Default
+		}
+		targets.Postgres[i].Retry.setDefaults()
+	}
+
+	for i := range targets.ClickHouse {
+		if targets.ClickHouse[i].BatchSize == 0 {
+			targets.ClickHouse[i].BatchSize = 5000 // Default
+		}
+		if targets.ClickHouse[i].BatchInterval == 0 {
+			targets.ClickHouse[i].BatchInterval = 2 * time.Second // Default
+		}
+		if targets.ClickHouse[i].DeleteStrategy == "" {
+			targets.ClickHouse[i].DeleteStrategy = DeleteLightweight
+		}
+		if targets.ClickHouse[i].WaitForAsyncInsert == nil {
+			wait := true
+			targets.ClickHouse[i].WaitForAsyncInsert = &wait
+		}
+		targets.ClickHouse[i].Retry.setDefaults()
+	}
+
+	for i := range targets.Redis {
+		if targets.Redis[i].BatchSize == 0 {
+			targets.Redis[i].BatchSize = 1000 // Default
+		}
+		if targets.Redis[i].BatchInterval == 0 {
+			targets.Redis[i].BatchInterval = 1 * time.Second // Default
+		}
+		if targets.Redis[i].Mode == "" {
+			targets.Redis[i].Mode = RedisModeString
+		}
+		if targets.Redis[i].StreamMaxLen == 0 {
+			targets.Redis[i].StreamMaxLen = 100000 // Default
+		}
+		if targets.Redis[i].TombstoneTTL == 0 {
+			targets.Redis[i].TombstoneTTL = 24 * time.Hour // Default
 		}
-		if c.Targets.Postgres[i].BatchInterval == 0 {
-			c.Targets.Postgres[i].BatchInterval = 1 * time.Second // Default
+		targets.Redis[i].Envelope.setDefaults(src)
+		targets.Redis[i].Retry.setDefaults()
+	}
+
+	for i := range targets.Kafka {
+		if targets.Kafka[i].BatchSize == 0 {
+			targets.Kafka[i].BatchSize = 1000 // Default
+		}
+		if targets.Kafka[i].BatchInterval == 0 {
+			targets.Kafka[i].BatchInterval = 1 * time.Second // Default
+		}
+		if targets.Kafka[i].TopicPattern == "" {
+			targets.Kafka[i].TopicPattern = "{{.schema}}.{{.table}}"
+		}
+		if targets.Kafka[i].Format == "" {
+			targets.Kafka[i].Format = KafkaFormatJSON
 		}
-		c.Targets.Postgres[i].Retry.setDefaults()
+		if targets.Kafka[i].Acks == "" {
+			targets.Kafka[i].Acks = "all"
+		}
+		if targets.Kafka[i].SchemaRegistry.Timeout == 0 {
+			targets.Kafka[i].SchemaRegistry.Timeout = 10 * time.Second // Default
+		}
+		if targets.Kafka[i].Idempotent == nil {
+			idempotent := targets.Kafka[i].Acks == "all"
+			targets.Kafka[i].Idempotent = &idempotent
+		}
+		targets.Kafka[i].Envelope.setDefaults(src)
+		targets.Kafka[i].Retry.setDefaults()
 	}
 
-	for i := range c.Targets.ClickHouse {
-		if c.Targets.ClickHouse[i].BatchSize == 0 {
-			c.Targets.ClickHouse[i].BatchSize = 5000 // Default
+	for i := range targets.S3 {
+		if targets.S3[i].BatchSize == 0 {
+			targets.S3[i].BatchSize = 1000000 // Default rows per file
+		}
+		if targets.S3[i].BatchInterval == 0 {
+			targets.S3[i].BatchInterval = 5 * time.Minute // Default file age
+		}
+		if targets.S3[i].RollSize == 0 {
+			targets.S3[i].RollSize = 128 << 20 // Default
 		}
-		if c.Targets.ClickHouse[i].BatchInterval == 0 {
-			c.Targets.ClickHouse[i].BatchInterval = 2 * time.Second // Default
+		if targets.S3[i].Compression == "" {
+			targets.S3[i].Compression = "snappy"
 		}
-		c.Targets.ClickHouse[i].Retry.setDefaults()
+		targets.S3[i].Retry.setDefaults()
 	}
 
-	for i := range c.Targets.Redis {
-		if c.Targets.Redis[i].BatchSize == 0 {
-			c.Targets.Redis[i].BatchSize = 1000 // Default
+	for i := range targets.File {
+		if targets.File[i].BatchSize == 0 {
+			targets.File[i].BatchSize = 1000 // Default
 		}
-		if c.Targets.Redis[i].BatchInterval == 0 {
-			c.Targets.Redis[i].BatchInterval = 1 * time.Second // Default
+		if targets.File[i].BatchInterval == 0 {
+			targets.File[i].BatchInterval = 1 * time.Second // Default
 		}
-		c.Targets.Redis[i].Retry.setDefaults()
+		if targets.File[i].Format == "" {
+			targets.File[i].Format = FileFormatJSONL
+		}
+		if targets.File[i].Compression == "" {
+			targets.File[i].Compression = "none"
+		}
+		if targets.File[i].MaxSize == 0 {
+			targets.File[i].MaxSize = 256 << 20 // Default
+		}
+		if targets.File[i].MaxAge == 0 {
+			targets.File[i].MaxAge = 1 * time.Hour // Default
+		}
+		if targets.File[i].Fsync == nil {
+			fsync := true
+			targets.File[i].Fsync = &fsync
+		}
+		targets.File[i].Envelope.setDefaults(src)
+		targets.File[i].Retry.setDefaults()
+	}
+
+	for i := range targets.Webhook {
+		if targets.Webhook[i].BatchSize == 0 {
+			targets.Webhook[i].BatchSize = 500 // Default
+		}
+		if targets.Webhook[i].BatchInterval == 0 {
+			targets.Webhook[i].BatchInterval = 1 * time.Second // Default
+		}
+		if targets.Webhook[i].Method == "" {
+			targets.Webhook[i].Method = "POST"
+		}
+		if targets.Webhook[i].Format == "" {
+			targets.Webhook[i].Format = WebhookFormatJSON
+		}
+		if targets.Webhook[i].Mode == "" {
+			targets.Webhook[i].Mode = WebhookModeBatch
+		}
+		if targets.Webhook[i].Concurrency == 0 {
+			targets.Webhook[i].Concurrency = 4 // Default
+		}
+		if targets.Webhook[i].Timeout == 0 {
+			targets.Webhook[i].Timeout = 10 * time.Second // Default
+		}
+		targets.Webhook[i].Envelope.setDefaults(src)
+		targets.Webhook[i].Retry.setDefaults()
+	}
+
+	for i := range targets.NATS {
+		if targets.NATS[i].BatchSize == 0 {
+			targets.NATS[i].BatchSize = 1000 // Default
+		}
+		if targets.NATS[i].BatchInterval == 0 {
+			targets.NATS[i].BatchInterval = 1 * time.Second // Default
+		}
+		if targets.NATS[i].SubjectPrefix == "" {
+			targets.NATS[i].SubjectPrefix = "cdc"
+		}
+		if targets.NATS[i].DuplicateWindow == 0 {
+			targets.NATS[i].DuplicateWindow = 2 * time.Minute // Default
+		}
+		if targets.NATS[i].AckTimeout == 0 {
+			targets.NATS[i].AckTimeout = 10 * time.Second // Default
+		}
+		targets.NATS[i].Retry.setDefaults()
+	}
+
+	for i := range targets.MySQL {
+		if targets.MySQL[i].BatchSize == 0 {
+			targets.MySQL[i].BatchSize = 1000 // Default
+		}
+		if targets.MySQL[i].BatchInterval == 0 {
+			targets.MySQL[i].BatchInterval = 1 * time.Second // Default
+		}
+		targets.MySQL[i].Retry.setDefaults()
+	}
+
+	for i := range targets.Elasticsearch {
+		if targets.Elasticsearch[i].BatchSize == 0 {
+			targets.Elasticsearch[i].BatchSize = 1000 // Default
+		}
+		if targets.Elasticsearch[i].BatchInterval == 0 {
+			targets.Elasticsearch[i].BatchInterval = 1 * time.Second // Default
+		}
+		if targets.Elasticsearch[i].IndexPattern == "" {
+			targets.Elasticsearch[i].IndexPattern = "{{.schema}}.{{.table}}"
+		}
+		if targets.Elasticsearch[i].Timeout == 0 {
+			targets.Elasticsearch[i].Timeout = 30 * time.Second // Default
+		}
+		targets.Elasticsearch[i].Retry.setDefaults()
+	}
+
+	for i := range targets.SQLite {
+		if targets.SQLite[i].BatchSize == 0 {
+			targets.SQLite[i].BatchSize = 1000 // Default
+		}
+		if targets.SQLite[i].BatchInterval == 0 {
+			targets.SQLite[i].BatchInterval = 1 * time.Second // Default
+		}
+		targets.SQLite[i].Retry.setDefaults()
 	}
 }
 
 func (c *Config) Validate() error {
-	if c.Source.ConnectionString == "" {
+	if c.Telemetry.FlushTimeout < 0 {
+		return errors.New("telemetry.flush_timeout cannot be negative")
+	}
+	if r := c.Telemetry.Tracing.SampleRatio; r < 0 || r > 1 {
+		return fmt.Errorf("telemetry.tracing.sample_ratio must be between 0 and 1, got %v", r)
+	}
+	if c.Telemetry.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Telemetry.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("telemetry.tracing.endpoint must be an http or https URL, got %q", c.Telemetry.Tracing.Endpoint)
+		}
+	}
+	if len(c.Pipelines) == 0 {
+		if err := c.Source.validate(); err != nil {
+			return err
+		}
+		return c.Targets.validate()
+	}
+
+	if c.Source != (SourceConfig{}) || !c.Targets.empty() {
+		return errors.New("source and targets cannot be combined with pipelines")
+	}
+	names := make(map[string]bool)
+	slots := make(map[SourceConfig]string)
+	for i := range c.Pipelines {
+		p := &c.Pipelines[i]
+		if p.Name == "" {
+			return fmt.Errorf("pipelines[%d].name is required", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("pipelines[%d].name %q is not unique", i, p.Name)
+		}
+		names[p.Name] = true
+		if err := p.Source.validate(); err != nil {
+			return fmt.Errorf("pipelines[%d] (%s): %w", i, p.Name, err)
+		}
+		slot := SourceConfig{ConnectionString: p.Source.ConnectionString, SlotName: p.Source.SlotName}
+		if other, ok := slots[slot]; ok {
+			return fmt.Errorf("pipelines[%d] (%s): slot %s is already used by pipeline %s", i, p.Name, p.Source.SlotName, other)
+		}
+		slots[slot] = p.Name
+		if err := p.Targets.validate(); err != nil {
+			return fmt.Errorf("pipelines[%d] (%s): %w", i, p.Name, err)
+		}
+	}
+	return nil
+}
+
+// PipelineSpecs returns the pipelines to run: the pipelines list, or the
+// top-level source, targets and pipeline settings as one pipeline.
+func (c *Config) PipelineSpecs() []PipelineSpec {
+	if len(c.Pipelines) > 0 {
+		return c.Pipelines
+	}
+	return []PipelineSpec{{PipelineConfig: c.Pipeline, Source: c.Source, Targets: c.Targets}}
+}
+
+func (s *SourceConfig) validate() error {
+	if s.ConnectionString == "" {
 		return errors.New("source.connection_string is required")
 	}
-	if c.Source.SlotName == "" {
+	if s.SlotName == "" {
 		return errors.New("source.slot_name is required")
 	}
-	if len(c.Targets.Postgres) == 0 && len(c.Targets.ClickHouse) == 0 {
-		return errors.New("at least one target (postgres or clickhouse) must be defined")
+	return nil
+}
+
+func (targets *TargetsConfig) empty() bool {
+	return len(targets.Postgres) == 0 && len(targets.ClickHouse) == 0 && len(targets.Redis) == 0 &&
+		len(targets.Kafka) == 0 && len(targets.S3) == 0 && len(targets.File) == 0 &&
+		len(targets.Webhook) == 0 && len(targets.NATS) == 0 && len(targets.MySQL) == 0 &&
+		len(targets.Elasticsearch) == 0 && len(targets.SQLite) == 0
+}
+
+func (targets *TargetsConfig) validate() error {
+	if targets.empty() {
+		return errors.New("at least one target (postgres, clickhouse, redis, kafka, s3, file, webhook, nats, mysql, elasticsearch or sqlite) must be defined")
 	}
 
-	for i, t := range c.Targets.Postgres {
+	for i, t := range targets.Postgres {
 		if t.Name == "" {
 			return fmt.Errorf("targets.postgres[%d].name is required", i)
 		}
@@ -162,14 +728,14 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("targets.postgres[%d].connection_string is required", i)
 		}
 		if t.BatchSize <= 0 {
-			c.Targets.Postgres[i].BatchSize = 1000 // Default
+			targets.Postgres[i].BatchSize = 1000 // Default
 		}
 		if t.BatchInterval <= 0 {
-			c.Targets.Postgres[i].BatchInterval = 1 * time.Second // Default
+			targets.Postgres[i].BatchInterval = 1 * time.Second // Default
 		}
 	}
 
-	for i, t := range c.Targets.ClickHouse {
+	for i, t := range targets.ClickHouse {
 		if t.Name == "" {
 			return fmt.Errorf("targets.clickhouse[%d].name is required", i)
 		}
@@ -177,12 +743,391 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("targets.clickhouse[%d].connection_string is required", i)
 		}
 		if t.BatchSize <= 0 {
-			c.Targets.ClickHouse[i].BatchSize = 5000 // Default
+			targets.ClickHouse[i].BatchSize = 5000 // Default
 		}
 		if t.BatchInterval <= 0 {
-			c.Targets.ClickHouse[i].BatchInterval = 2 * time.Second // Default
+			targets.ClickHouse[i].BatchInterval = 2 * time.Second // Default
+		}
+		switch t.DeleteStrategy {
+		case "", DeleteLightweight, DeleteIsDeleted, DeleteCollapsing:
+		default:
+			return fmt.Errorf("targets.clickhouse[%d].delete_strategy %q is invalid (expected %s, %s or %s)",
+				i, t.DeleteStrategy, DeleteLightweight, DeleteIsDeleted, DeleteCollapsing)
+		}
+		switch t.Compression {
+		case "", "none", "lz4", "zstd":
+		default:
+			return fmt.Errorf("targets.clickhouse[%d].compression %q is invalid (expected none, lz4 or zstd)", i, t.Compression)
+		}
+		if t.InsertQuorum < 0 {
+			return fmt.Errorf("targets.clickhouse[%d].insert_quorum must not be negative", i)
+		}
+		// Deletes cannot go through a Distributed table; without ON CLUSTER
+		// they would only reach the local table of one shard
+		if t.DistributedSuffix != "" && t.Cluster == "" && (t.DeleteStrategy == "" || t.DeleteStrategy == DeleteLightweight) {
+			return fmt.Errorf("targets.clickhouse[%d].cluster is required with distributed_suffix and delete_strategy %s", i, DeleteLightweight)
+		}
+	}
+
+	for i, t := range targets.Redis {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.redis[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.Kafka {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.kafka[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.S3 {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.s3[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.File {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.file[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.Webhook {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.webhook[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.NATS {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.nats[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.MySQL {
+		if t.Name == "" {
+			return fmt.Errorf("targets.mysql[%d].name is required", i)
+		}
+		if t.ConnectionString == "" {
+			return fmt.Errorf("targets.mysql[%d].connection_string is required", i)
+		}
+	}
+
+	for i, t := range targets.Elasticsearch {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.elasticsearch[%d]: %w", i, err)
+		}
+	}
+
+	for i, t := range targets.SQLite {
+		if t.Name == "" {
+			return fmt.Errorf("targets.sqlite[%d].name is required", i)
+		}
+		if t.Path == "" {
+			return fmt.Errorf("targets.sqlite[%d].path is required", i)
+		}
+	}
+
+	// Names label metrics and address targets in the admin API
+	seen := make(map[string]string)
+	for _, t := range targets.names() {
+		if typ, ok := seen[t.name]; ok {
+			return fmt.Errorf("target name %q is used by both a %s and a %s target", t.name, typ, t.typ)
+		}
+		seen[t.name] = t.typ
+	}
+
+	return nil
+}
+
+// names returns the name and type of every target.
+func (targets *TargetsConfig) names() []struct{ name, typ string } {
+	var names []struct{ name, typ string }
+	add := func(typ, name string) {
+		names = append(names, struct{ name, typ string }{name, typ})
+	}
+	for _, t := range targets.Postgres {
+		add("postgres", t.Name)
+	}
+	for _, t := range targets.ClickHouse {
+		add("clickhouse", t.Name)
+	}
+	for _, t := range targets.Redis {
+		add("redis", t.Name)
+	}
+	for _, t := range targets.Kafka {
+		add("kafka", t.Name)
+	}
+	for _, t := range targets.S3 {
+		add("s3", t.Name)
+	}
+	for _, t := range targets.File {
+		add("file", t.Name)
+	}
+	for _, t := range targets.Webhook {
+		add("webhook", t.Name)
+	}
+	for _, t := range targets.NATS {
+		add("nats", t.Name)
+	}
+	for _, t := range targets.MySQL {
+		add("mysql", t.Name)
+	}
+	for _, t := range targets.Elasticsearch {
+		add("elasticsearch", t.Name)
+	}
+	for _, t := range targets.SQLite {
+		add("sqlite", t.Name)
+	}
+	return names
+}
+
+func (t *RedisTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.ConnectionString == "" && len(t.Addrs) == 0 {
+		return errors.New("connection_string or addrs is required")
+	}
+	switch t.Mode {
+	case "", RedisModeString, RedisModeHash, RedisModeJSON, RedisModeStream:
+	default:
+		return fmt.Errorf("mode %q is invalid (expected %s, %s, %s or %s)",
+			t.Mode, RedisModeString, RedisModeHash, RedisModeJSON, RedisModeStream)
+	}
+	if _, err := keytemplate.Parse("key", t.KeyPattern); err != nil {
+		return fmt.Errorf("key_pattern: %w", err)
+	}
+	if err := t.Envelope.validate(); err != nil {
+		return err
+	}
+	if t.Envelope.Type == EnvelopeDebezium && t.Mode != RedisModeStream {
+		return fmt.Errorf("envelope.type %s requires mode %s", EnvelopeDebezium, RedisModeStream)
+	}
+	if t.PublishChannel != "" {
+		if _, err := keytemplate.Parse("channel", t.PublishChannel); err != nil {
+			return fmt.Errorf("publish_channel: %w", err)
+		}
+	}
+	for table, tc := range t.Tables {
+		if tc.KeyPattern != "" {
+			if _, err := keytemplate.Parse("key", tc.KeyPattern); err != nil {
+				return fmt.Errorf("tables.%s.key_pattern: %w", table, err)
+			}
+		}
+		if len(tc.Identity) > 0 {
+			// Deletes only carry the identity, so their key and channel
+			// must be built from it
+			key := tc.KeyPattern
+			if key == "" {
+				key = t.KeyPattern
+			}
+			if err := identityOnly(key, tc.Identity); err != nil {
+				return fmt.Errorf("tables.%s: key_pattern: %w", table, err)
+			}
+			if t.PublishChannel != "" {
+				if err := identityOnly(t.PublishChannel, tc.Identity); err != nil {
+					return fmt.Errorf("tables.%s: publish_channel: %w", table, err)
+				}
+			}
+		}
+		for j, idx := range tc.Indexes {
+			if _, err := keytemplate.Parse("index", idx.KeyPattern); err != nil {
+				return fmt.Errorf("tables.%s.indexes[%d].key_pattern: %w", table, j, err)
+			}
+			switch idx.Type {
+			case "", "set", "zset":
+			default:
+				return fmt.Errorf("tables.%s.indexes[%d].type %q is invalid (expected set or zset)", table, j, idx.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// identityOnly checks that pattern only uses the identity columns, the
+// table and the schema.
+func identityOnly(pattern string, identity []string) error {
+	tmpl, err := keytemplate.Parse("key", pattern)
+	if err != nil {
+		return err
+	}
+	for _, field := range keytemplate.Fields(tmpl) {
+		if field != "table" && field != "schema" && !slices.Contains(identity, field) {
+			return fmt.Errorf("column %q is not an identity column %v; deletes cannot fill it in", field, identity)
+		}
+	}
+	return nil
+}
+
+func (t *KafkaTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(t.Brokers) == 0 {
+		return errors.New("brokers is required")
+	}
+	if _, err := keytemplate.Parse("topic", t.TopicPattern); err != nil {
+		return fmt.Errorf("topic_pattern: %w", err)
+	}
+	switch t.Format {
+	case "", KafkaFormatJSON, KafkaFormatAvro, KafkaFormatProtobuf:
+	default:
+		return fmt.Errorf("format %q is invalid (expected %s, %s or %s)",
+			t.Format, KafkaFormatJSON, KafkaFormatAvro, KafkaFormatProtobuf)
+	}
+	if err := t.Envelope.validate(); err != nil {
+		return err
+	}
+	if t.Envelope.Type == EnvelopeDebezium && t.Format != "" && t.Format != KafkaFormatJSON {
+		return fmt.Errorf("envelope.type %s requires format %s", EnvelopeDebezium, KafkaFormatJSON)
+	}
+	if u := t.SchemaRegistry.URL; u != "" {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("schema_registry.url %q is not an http(s) URL", u)
+		}
+		if t.Format != KafkaFormatAvro {
+			return fmt.Errorf("schema_registry requires format %s", KafkaFormatAvro)
 		}
 	}
+	switch t.Acks {
+	case "", "all", "leader", "none":
+	default:
+		return fmt.Errorf("acks %q is invalid (expected all, leader or none)", t.Acks)
+	}
+	if t.Idempotent != nil && *t.Idempotent && t.Acks != "" && t.Acks != "all" {
+		return errors.New("idempotent requires acks=all")
+	}
+	switch t.Compression {
+	case "", "none", "gzip", "snappy", "lz4", "zstd":
+	default:
+		return fmt.Errorf("compression %q is invalid (expected none, gzip, snappy, lz4 or zstd)", t.Compression)
+	}
+	return nil
+}
 
+func (t *S3Target) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.Endpoint == "" {
+		return errors.New("endpoint is required")
+	}
+	if t.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if t.RollSize < 0 {
+		return errors.New("roll_size must not be negative")
+	}
+	switch t.Compression {
+	case "", "snappy", "zstd", "gzip", "none":
+	default:
+		return fmt.Errorf("compression %q is invalid (expected snappy, zstd, gzip or none)", t.Compression)
+	}
+	return nil
+}
+
+func (t *FileTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.Path == "" {
+		return errors.New("path is required")
+	}
+	switch t.Format {
+	case "", FileFormatJSONL, FileFormatCSV:
+	default:
+		return fmt.Errorf("format %q is invalid (expected %s or %s)", t.Format, FileFormatJSONL, FileFormatCSV)
+	}
+	if err := t.Envelope.validate(); err != nil {
+		return err
+	}
+	if t.Envelope.Type == EnvelopeDebezium && t.Format == FileFormatCSV {
+		return fmt.Errorf("envelope.type %s requires format %s", EnvelopeDebezium, FileFormatJSONL)
+	}
+	switch t.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return fmt.Errorf("compression %q is invalid (expected none, gzip or zstd)", t.Compression)
+	}
+	return nil
+}
+
+func (t *WebhookTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.URL == "" {
+		return errors.New("url is required")
+	}
+	if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q is not an http(s) URL", t.URL)
+	}
+	switch t.Format {
+	case "", WebhookFormatJSON, WebhookFormatCloudEvents:
+	default:
+		return fmt.Errorf("format %q is invalid (expected %s or %s)", t.Format, WebhookFormatJSON, WebhookFormatCloudEvents)
+	}
+	switch t.Mode {
+	case "", WebhookModeBatch, WebhookModeTable:
+	default:
+		return fmt.Errorf("mode %q is invalid (expected %s or %s)", t.Mode, WebhookModeBatch, WebhookModeTable)
+	}
+	if err := t.Envelope.validate(); err != nil {
+		return err
+	}
+	for name, value := range t.Headers {
+		if _, err := keytemplate.Parse("header", value); err != nil {
+			return fmt.Errorf("headers.%s: %w", name, err)
+		}
+	}
+	if t.Concurrency < 0 {
+		return errors.New("concurrency must not be negative")
+	}
+	return nil
+}
+
+func (t *NATSTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if t.URL == "" {
+		return errors.New("url is required")
+	}
+	if strings.ContainsAny(t.SubjectPrefix, " *>") || strings.HasPrefix(t.SubjectPrefix, ".") || strings.HasSuffix(t.SubjectPrefix, ".") {
+		return fmt.Errorf("subject_prefix %q is not a valid subject", t.SubjectPrefix)
+	}
+	if t.CredentialsFile != "" && t.Token != "" {
+		return errors.New("credentials_file and token are mutually exclusive")
+	}
+	return nil
+}
+
+func (t *ElasticsearchTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(t.URLs) == 0 {
+		return errors.New("urls is required")
+	}
+	for _, u := range t.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("url %q is not an http(s) URL", u)
+		}
+	}
+	if t.APIKey != "" && t.Username != "" {
+		return errors.New("api_key and username are mutually exclusive")
+	}
+	if _, err := keytemplate.Parse("index", t.IndexPattern); err != nil {
+		return fmt.Errorf("index_pattern: %w", err)
+	}
+	for table, tc := range t.Tables {
+		if tc.IndexPattern != "" {
+			if _, err := keytemplate.Parse("index", tc.IndexPattern); err != nil {
+				return fmt.Errorf("tables.%s.index_pattern: %w", table, err)
+			}
+		}
+	}
 	return nil
 }
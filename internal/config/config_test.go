@@ -68,9 +68,26 @@ pipeline:
 	if cfg.Targets.ClickHouse[0].BatchSize != 5000 {
 		t.Errorf("Expected default batch_size 5000, got %d", cfg.Targets.ClickHouse[0].BatchSize)
 	}
+	if cfg.Targets.ClickHouse[0].DeleteStrategy != DeleteLightweight {
+		t.Errorf("Expected default delete_strategy %q, got %q", DeleteLightweight, cfg.Targets.ClickHouse[0].DeleteStrategy)
+	}
+	if w := cfg.Targets.ClickHouse[0].WaitForAsyncInsert; w == nil || !*w {
+		t.Error("Expected wait_for_async_insert to default to true")
+	}
+
+	// The top-level settings run as one pipeline
+	if specs := cfg.PipelineSpecs(); len(specs) != 1 || specs[0].Name != "default" || specs[0].WorkerCount != 2 {
+		t.Errorf("Expected a single default pipeline, got %+v", specs)
+	}
+
+	// Tracing is off unless an endpoint is set
+	if tr := cfg.Telemetry.Tracing; tr.Endpoint != "" || tr.ServiceName != "replicator" || tr.SampleRatio != 0.1 {
+		t.Errorf("Unexpected tracing defaults %+v", tr)
+	}
 }
 
 func TestConfigValidation(t *testing.T) {
+	idempotent := true
 	tests := []struct {
 		name        string
 		config      Config
@@ -126,6 +143,375 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "invalid clickhouse delete strategy",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					ClickHouse: []ClickHouseTarget{
+						{
+							TargetBase:       TargetBase{Name: "ch1"},
+							ConnectionString: "clickhouse://localhost:9000",
+							DeleteStrategy:   "truncate",
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "clickhouse distributed lightweight deletes without cluster",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					ClickHouse: []ClickHouseTarget{
+						{
+							TargetBase:        TargetBase{Name: "ch1"},
+							ConnectionString:  "clickhouse://localhost:9000",
+							DistributedSuffix: "_dist",
+							DeleteStrategy:    DeleteLightweight,
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "clickhouse distributed lightweight deletes on cluster",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					ClickHouse: []ClickHouseTarget{
+						{
+							TargetBase:        TargetBase{Name: "ch1"},
+							ConnectionString:  "clickhouse://localhost:9000",
+							DistributedSuffix: "_dist",
+							DeleteStrategy:    DeleteLightweight,
+							Cluster:           "main",
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "clickhouse distributed tombstones without cluster",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					ClickHouse: []ClickHouseTarget{
+						{
+							TargetBase:        TargetBase{Name: "ch1"},
+							ConnectionString:  "clickhouse://localhost:9000",
+							DistributedSuffix: "_dist",
+							DeleteStrategy:    DeleteIsDeleted,
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "valid redis target",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "cache"},
+							ConnectionString: "redis://localhost:6379",
+							KeyPattern:       `{{.table}}:{{join ":" .tenant_id .id}}`,
+							Tables: map[string]RedisTableConfig{
+								"users": {KeyPattern: "user:{{lower .email}}"},
+							},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "duplicate target names",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Postgres: []PostgresTarget{
+						{TargetBase: TargetBase{Name: "cache"}, ConnectionString: "postgres://localhost/replica"},
+					},
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "cache"},
+							ConnectionString: "redis://localhost:6379",
+							KeyPattern:       "{{.table}}:{{.id}}",
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "redis key pattern missing",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "cache"},
+							ConnectionString: "redis://localhost:6379",
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "redis index pattern invalid",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "cache"},
+							ConnectionString: "redis://localhost:6379",
+							KeyPattern:       "{{.table}}:{{.id}}",
+							Tables: map[string]RedisTableConfig{
+								"users": {Indexes: []RedisIndex{{KeyPattern: "users:by_email:{{.email"}}},
+							},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "redis key pattern uses identity columns",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "cache"},
+							ConnectionString: "redis://localhost:6379",
+							KeyPattern:       "{{.table}}:{{.id}}",
+							PublishChannel:   "changes:{{.schema}}.{{.table}}",
+							Tables: map[string]RedisTableConfig{
+								"orders": {Identity: []string{"id"}},
+								"users":  {KeyPattern: "user:{{hash .tenant_id .id}}", Identity: []string{"tenant_id", "id"}},
+							},
+						},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "redis key pattern uses a non-identity column",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "cache"},
+							ConnectionString: "redis://localhost:6379",
+							KeyPattern:       "{{.table}}:{{.id}}",
+							PublishChannel:   "changes:{{.schema}}.{{.table}}",
+							Tables: map[string]RedisTableConfig{
+								"users": {KeyPattern: "user:{{lower .email}}", Identity: []string{"id"}},
+							},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "kafka idempotent producer without acks all",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Kafka: []KafkaTarget{
+						{
+							TargetBase:   TargetBase{Name: "events"},
+							Brokers:      []string{"localhost:9092"},
+							TopicPattern: "cdc.{{.table}}",
+							Acks:         "leader",
+							Idempotent:   &idempotent,
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "s3 target without bucket",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					S3: []S3Target{
+						{
+							TargetBase: TargetBase{Name: "lake"},
+							Endpoint:   "localhost:9000",
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "webhook target with invalid url",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Webhook: []WebhookTarget{
+						{
+							TargetBase: TargetBase{Name: "hook"},
+							URL:        "localhost:8080/events",
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "webhook header template invalid",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Webhook: []WebhookTarget{
+						{
+							TargetBase: TargetBase{Name: "hook"},
+							URL:        "http://localhost:8080/events",
+							Headers:    map[string]string{"X-Table": "{{.table"},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "debezium envelope with avro format",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Kafka: []KafkaTarget{
+						{
+							TargetBase: TargetBase{Name: "kafka"},
+							Brokers:    []string{"localhost:9092"},
+							Format:     KafkaFormatAvro,
+							Envelope:   EnvelopeConfig{Type: EnvelopeDebezium},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "schema registry with json format",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Kafka: []KafkaTarget{
+						{
+							TargetBase:     TargetBase{Name: "kafka"},
+							Brokers:        []string{"localhost:9092"},
+							Format:         KafkaFormatJSON,
+							SchemaRegistry: SchemaRegistryConfig{URL: "http://localhost:8081"},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "debezium envelope outside redis stream mode",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Redis: []RedisTarget{
+						{
+							TargetBase:       TargetBase{Name: "redis"},
+							ConnectionString: "redis://localhost:6379/0",
+							Mode:             RedisModeHash,
+							Envelope:         EnvelopeConfig{Type: EnvelopeDebezium},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "elasticsearch table index pattern invalid",
+			config: Config{
+				Source: SourceConfig{
+					ConnectionString: "postgres://localhost/db",
+					SlotName:         "slot",
+				},
+				Targets: TargetsConfig{
+					Elasticsearch: []ElasticsearchTarget{
+						{
+							TargetBase:   TargetBase{Name: "search"},
+							URLs:         []string{"http://localhost:9200"},
+							IndexPattern: "{{.table}}",
+							Tables: map[string]ElasticsearchTableConfig{
+								"orders": {IndexPattern: "orders-{{.region"},
+							},
+						},
+					},
+				},
+			},
+			expectError: true,
+		},
 		{
 			name: "missing target name",
 			config: Config{
@@ -143,6 +529,85 @@ func TestConfigValidation(t *testing.T) {
 			},
 			expectError: true,
 		},
+		{
+			name: "pipelines",
+			config: Config{
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+					{PipelineConfig: PipelineConfig{Name: "b"}, Source: pipelineSource("slot_b"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "duplicate pipeline name",
+			config: Config{
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_b"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "pipelines sharing a slot",
+			config: Config{
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+					{PipelineConfig: PipelineConfig{Name: "b"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "pipeline without targets",
+			config: Config{
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a")},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "pipelines with top-level source",
+			config: Config{
+				Source: pipelineSource("slot"),
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "tracing",
+			config: Config{
+				Telemetry: TelemetryConfig{Tracing: TracingConfig{Endpoint: "http://otel-collector:4318", SampleRatio: 0.1}},
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "tracing sample ratio above 1",
+			config: Config{
+				Telemetry: TelemetryConfig{Tracing: TracingConfig{SampleRatio: 1.5}},
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "tracing endpoint without scheme",
+			config: Config{
+				Telemetry: TelemetryConfig{Tracing: TracingConfig{Endpoint: "otel-collector:4318"}},
+				Pipelines: []PipelineSpec{
+					{PipelineConfig: PipelineConfig{Name: "a"}, Source: pipelineSource("slot_a"), Targets: pipelineTargets()},
+				},
+			},
+			expectError: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -157,3 +622,87 @@ func TestConfigValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestEnvelopeDefaults(t *testing.T) {
+	cfg := Config{
+		Source: SourceConfig{ConnectionString: "postgres://user@localhost:5432/shop?sslmode=disable", SlotName: "cdc_slot"},
+		Targets: TargetsConfig{
+			File: []FileTarget{
+				{TargetBase: TargetBase{Name: "native"}, Path: "/tmp/a"},
+				{TargetBase: TargetBase{Name: "debezium"}, Path: "/tmp/b", Envelope: EnvelopeConfig{Type: EnvelopeDebezium}},
+			},
+		},
+	}
+	cfg.setDefaults()
+
+	if env := cfg.Targets.File[0].Envelope; env.Type != EnvelopeNative || env.Name != "" {
+		t.Errorf("Expected the native envelope by default, got %+v", env)
+	}
+	if env := cfg.Targets.File[1].Envelope; env.Name != "cdc_slot" || env.Database != "shop" {
+		t.Errorf("Expected the slot name and source database, got %+v", env)
+	}
+}
+
+func pipelineSource(slot string) SourceConfig {
+	return SourceConfig{ConnectionString: "postgres://localhost/db", SlotName: slot}
+}
+
+func pipelineTargets() TargetsConfig {
+	return TargetsConfig{
+		Postgres: []PostgresTarget{
+			{TargetBase: TargetBase{Name: "pg1"}, ConnectionString: "postgres://localhost/sink"},
+		},
+	}
+}
+
+func TestLoadPipelines(t *testing.T) {
+	configContent := `
+pipelines:
+  - name: "orders"
+    worker_count: 2
+    source:
+      connection_string: "postgres://localhost/orders"
+      slot_name: "orders_slot"
+    targets:
+      kafka:
+        - name: "k1"
+          brokers: ["localhost:9092"]
+  - name: "users"
+    source:
+      connection_string: "postgres://localhost/users"
+      slot_name: "users_slot"
+    targets:
+      clickhouse:
+        - name: "ch1"
+          connection_string: "clickhouse://localhost:9000"
+`
+	tmpFile, err := os.CreateTemp("", "config-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(configContent); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	cfg, err := Load(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	specs := cfg.PipelineSpecs()
+	if len(specs) != 2 {
+		t.Fatalf("Expected 2 pipelines, got %d", len(specs))
+	}
+	if specs[0].Name != "orders" || specs[0].WorkerCount != 2 || specs[0].BatchSize != 1000 {
+		t.Errorf("Unexpected orders pipeline settings %+v", specs[0].PipelineConfig)
+	}
+	if specs[1].WorkerCount != 4 || specs[1].BatchInterval != time.Second {
+		t.Errorf("Expected default pipeline settings, got %+v", specs[1].PipelineConfig)
+	}
+	if specs[1].Targets.ClickHouse[0].BatchSize != 5000 {
+		t.Errorf("Expected target defaults, got batch_size %d", specs[1].Targets.ClickHouse[0].BatchSize)
+	}
+}
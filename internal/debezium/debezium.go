@@ -0,0 +1,185 @@
+// Package debezium renders change events in the envelope of Debezium's
+// PostgreSQL connector, so consumers written for Debezium can read them.
+//
+// A change becomes
+//
+//	{"before": {...}, "after": {...}, "source": {...}, "op": "c", "ts_ms": 1700000000000}
+//
+// and, with the schema enabled, {"schema": {...}, "payload": <envelope>} in
+// the Kafka Connect JSON converter format.
+package debezium
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// Options configure an Encoder.
+type Options struct {
+	Name     string // Logical server name, source.name; prefixes schema names
+	Database string // Source database, source.db
+	Schema   bool   // Include the JSON Schema section
+}
+
+// Encoder renders events as Debezium envelopes.
+type Encoder struct {
+	opts Options
+	now  func() time.Time
+}
+
+func NewEncoder(opts Options) *Encoder {
+	return &Encoder{opts: opts, now: time.Now}
+}
+
+// Envelope is the payload of a Debezium change event.
+type Envelope struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Source Source                 `json:"source"`
+	Op     string                 `json:"op"`
+	TsMs   int64                  `json:"ts_ms"`
+}
+
+// Source is the source block of an envelope.
+type Source struct {
+	Version   string `json:"version"`
+	Connector string `json:"connector"`
+	Name      string `json:"name"`
+	TsMs      int64  `json:"ts_ms"`
+	Snapshot  string `json:"snapshot"`
+	DB        string `json:"db"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	TxID      *int64 `json:"txId"`
+	LSN       int64  `json:"lsn"`
+}
+
+// Op codes of the envelope
+const (
+	OpCreate = "c"
+	OpUpdate = "u"
+	OpDelete = "d"
+	OpRead   = "r" // Snapshot read
+)
+
+// Encode renders e as JSON.
+func (enc *Encoder) Encode(e *types.Event) ([]byte, error) {
+	env, err := enc.Envelope(e)
+	if err != nil {
+		return nil, err
+	}
+	if !enc.opts.Schema {
+		return json.Marshal(env)
+	}
+	return json.Marshal(map[string]interface{}{
+		"schema":  enc.ValueSchema(e),
+		"payload": env,
+	})
+}
+
+// Envelope builds the envelope of e. The before row is the old row the
+// source sent: the full row with REPLICA IDENTITY FULL, otherwise only the
+// key of deletes and of updates that changed the key.
+func (enc *Encoder) Envelope(e *types.Event) (*Envelope, error) {
+	env := &Envelope{
+		Source: Source{
+			Version:   "replicator",
+			Connector: "postgresql",
+			Name:      enc.opts.Name,
+			TsMs:      e.Timestamp.UnixMilli(),
+			Snapshot:  "false",
+			DB:        enc.opts.Database,
+			Schema:    e.Schema,
+			Table:     e.Table,
+			LSN:       int64(e.LSN),
+		},
+		TsMs: enc.now().UnixMilli(),
+	}
+	if e.XID != 0 {
+		txID := int64(e.XID)
+		env.Source.TxID = &txID
+	}
+
+	var err error
+	switch e.Type {
+	case types.EventInsert:
+		env.Op = OpCreate
+		if e.Snapshot {
+			env.Op = OpRead
+			env.Source.Snapshot = "true"
+		}
+		env.After, err = rowValues(e, e.Columns)
+	case types.EventUpdate:
+		env.Op = OpUpdate
+		if env.After, err = rowValues(e, e.Columns); err == nil {
+			env.Before, err = rowValues(e, e.Before)
+		}
+	case types.EventDelete:
+		env.Op = OpDelete
+		before := e.Before
+		if before == nil {
+			before = e.Identity
+		}
+		env.Before, err = rowValues(e, before)
+	default:
+		return nil, fmt.Errorf("cannot encode %s event", e.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+	}
+	return env, nil
+}
+
+// rowValues converts a row to the values Debezium uses for the column
+// types: numbers for floats, base64 (via []byte) for bytea, days since the
+// epoch for dates and microseconds for timestamps without time zone.
+// Without column definitions values are kept as decoded.
+func rowValues(e *types.Event, row map[string]interface{}) (map[string]interface{}, error) {
+	if row == nil {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(row))
+	for col, v := range row {
+		out[col] = v
+	}
+	if e.Relation == nil {
+		return out, nil
+	}
+	for _, col := range e.Relation.Columns {
+		if ts, ok := out[col.Name].(time.Time); ok && col.Type == oidTimestamp {
+			out[col.Name] = ts.UnixMicro()
+			continue
+		}
+		s, ok := out[col.Name].(string)
+		if !ok {
+			continue
+		}
+		switch col.Type {
+		case oidDate:
+			d, err := time.Parse(time.DateOnly, s)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			out[col.Name] = int32(d.Unix() / 86400)
+		case oidFloat4, oidFloat8:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			out[col.Name] = f
+		case oidBytea:
+			b, err := hex.DecodeString(strings.TrimPrefix(s, `\x`))
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Name, err)
+			}
+			out[col.Name] = b
+		}
+	}
+	return out, nil
+}
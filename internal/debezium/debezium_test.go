@@ -0,0 +1,161 @@
+package debezium
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func newTestEncoder(schema bool) *Encoder {
+	enc := NewEncoder(Options{Name: "shop", Database: "app", Schema: schema})
+	enc.now = func() time.Time { return time.UnixMilli(1700000000500) }
+	return enc
+}
+
+func TestEncode(t *testing.T) {
+	commit := time.UnixMilli(1700000000000)
+	users := &types.Relation{Schema: "public", Table: "users", Columns: []types.Column{
+		{Name: "id", Type: oidInt8, Key: true},
+		{Name: "score", Type: oidFloat8},
+		{Name: "born", Type: oidDate},
+		{Name: "avatar", Type: oidBytea},
+	}}
+
+	tests := []struct {
+		name   string
+		event  *types.Event
+		op     string
+		before map[string]interface{}
+		after  map[string]interface{}
+	}{
+		{
+			name: "insert",
+			event: &types.Event{Type: types.EventInsert, Schema: "public", Table: "users", Relation: users,
+				Columns: map[string]interface{}{"id": int64(1), "score": "1.5", "born": "1970-01-03", "avatar": `\x0102`}},
+			op:    "c",
+			after: map[string]interface{}{"id": 1.0, "score": 1.5, "born": 2.0, "avatar": "AQI="},
+		},
+		{
+			name: "update",
+			event: &types.Event{Type: types.EventUpdate, Schema: "public", Table: "users", Relation: users,
+				Columns: map[string]interface{}{"id": int64(2), "score": nil},
+				Before:  map[string]interface{}{"id": int64(1), "score": "2"}},
+			op:     "u",
+			before: map[string]interface{}{"id": 1.0, "score": 2.0},
+			after:  map[string]interface{}{"id": 2.0, "score": nil},
+		},
+		{
+			name: "delete without old row",
+			event: &types.Event{Type: types.EventDelete, Schema: "public", Table: "users",
+				Identity: map[string]interface{}{"id": int64(1)}},
+			op:     "d",
+			before: map[string]interface{}{"id": 1.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.LSN = 0x16B3748
+			tt.event.XID = 771
+			tt.event.Timestamp = commit
+
+			data, err := newTestEncoder(false).Encode(tt.event)
+			if err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Invalid JSON %s: %v", data, err)
+			}
+			if got["op"] != tt.op || got["ts_ms"] != 1700000000500.0 {
+				t.Errorf("Unexpected op or ts_ms in %s", data)
+			}
+			if !sameRow(got["before"], tt.before) || !sameRow(got["after"], tt.after) {
+				t.Errorf("Expected before %v and after %v, got %s", tt.before, tt.after, data)
+			}
+
+			source := got["source"].(map[string]interface{})
+			want := map[string]interface{}{
+				"connector": "postgresql", "name": "shop", "db": "app", "schema": "public", "table": "users",
+				"snapshot": "false", "ts_ms": 1700000000000.0, "txId": 771.0, "lsn": float64(0x16B3748),
+			}
+			for k, v := range want {
+				if source[k] != v {
+					t.Errorf("Expected source.%s = %v, got %v", k, v, source[k])
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeSnapshot(t *testing.T) {
+	e := &types.Event{Type: types.EventInsert, Schema: "public", Table: "users", Snapshot: true,
+		Columns: map[string]interface{}{"id": int64(1)}, Timestamp: time.UnixMilli(1700000000000)}
+	env, err := newTestEncoder(false).Envelope(e)
+	if err != nil {
+		t.Fatalf("Envelope failed: %v", err)
+	}
+	if env.Op != OpRead || env.Source.Snapshot != "true" {
+		t.Errorf("Expected a snapshot read, got op %q snapshot %q", env.Op, env.Source.Snapshot)
+	}
+}
+
+func sameRow(got interface{}, want map[string]interface{}) bool {
+	if want == nil {
+		return got == nil
+	}
+	row, ok := got.(map[string]interface{})
+	if !ok || len(row) != len(want) {
+		return false
+	}
+	for k, v := range want {
+		if row[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestEncodeWithSchema(t *testing.T) {
+	event := &types.Event{
+		Type: types.EventInsert, Schema: "public", Table: "users", LSN: 10,
+		Columns: map[string]interface{}{"id": int64(1), "name": "a", "created": time.Now()},
+		Relation: &types.Relation{Schema: "public", Table: "users", Columns: []types.Column{
+			{Name: "id", Type: oidInt8, Key: true},
+			{Name: "name", Type: 25},
+			{Name: "created", Type: oidTimestamptz},
+		}},
+	}
+	data, err := newTestEncoder(true).Encode(event)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	var got struct {
+		Schema  Field           `json:"schema"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", data, err)
+	}
+	if got.Schema.Name != "shop.public.users.Envelope" || len(got.Payload) == 0 {
+		t.Fatalf("Unexpected envelope %s", data)
+	}
+	after := got.Schema.Fields[1]
+	if after.Field != "after" || after.Name != "shop.public.users.Value" || len(after.Fields) != 3 {
+		t.Fatalf("Unexpected after schema %+v", after)
+	}
+	if f := after.Fields[0]; f.Type != "int64" || f.Optional {
+		t.Errorf("Expected a required int64 key column, got %+v", f)
+	}
+	if f := after.Fields[2]; f.Type != "string" || f.Name != "io.debezium.time.ZonedTimestamp" {
+		t.Errorf("Expected a ZonedTimestamp column, got %+v", f)
+	}
+
+	// Without column definitions the types are inferred from the values
+	event.Relation = nil
+	schema := newTestEncoder(true).ValueSchema(event)
+	if f := schema.Fields[1].Fields; len(f) != 3 || f[1].Field != "id" || f[1].Type != "int64" {
+		t.Errorf("Unexpected inferred schema %+v", f)
+	}
+}
@@ -0,0 +1,168 @@
+package debezium
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// Postgres type OIDs with a Debezium mapping other than a plain string
+const (
+	oidBool        = 16
+	oidBytea       = 17
+	oidInt8        = 20
+	oidInt2        = 21
+	oidInt4        = 23
+	oidJSON        = 114
+	oidFloat4      = 700
+	oidFloat8      = 701
+	oidDate        = 1082
+	oidTimestamp   = 1114
+	oidTimestamptz = 1184
+	oidUUID        = 2950
+	oidJSONB       = 3802
+)
+
+// Field is a Kafka Connect schema, as written by its JSON converter.
+type Field struct {
+	Type     string  `json:"type"`
+	Optional bool    `json:"optional"`
+	Name     string  `json:"name,omitempty"`
+	Version  int     `json:"version,omitempty"`
+	Field    string  `json:"field,omitempty"`
+	Fields   []Field `json:"fields,omitempty"`
+}
+
+// ValueSchema returns the schema of the envelope of e. Column types come
+// from the relation the source attached; without one they are inferred
+// from the values.
+func (enc *Encoder) ValueSchema(e *types.Event) Field {
+	prefix := enc.opts.Name + "." + e.Schema + "." + e.Table
+	row := rowSchema(e, prefix+".Value")
+
+	before, after := row, row
+	before.Field, after.Field = "before", "after"
+	return Field{
+		Type:     "struct",
+		Name:     prefix + ".Envelope",
+		Version:  1,
+		Optional: false,
+		Fields: []Field{
+			before,
+			after,
+			{
+				Type:  "struct",
+				Name:  "io.debezium.connector.postgresql.Source",
+				Field: "source",
+				Fields: []Field{
+					{Type: "string", Field: "version"},
+					{Type: "string", Field: "connector"},
+					{Type: "string", Field: "name"},
+					{Type: "int64", Field: "ts_ms"},
+					{Type: "string", Optional: true, Field: "snapshot"},
+					{Type: "string", Field: "db"},
+					{Type: "string", Field: "schema"},
+					{Type: "string", Field: "table"},
+					{Type: "int64", Optional: true, Field: "txId"},
+					{Type: "int64", Optional: true, Field: "lsn"},
+				},
+			},
+			{Type: "string", Field: "op"},
+			{Type: "int64", Optional: true, Field: "ts_ms"},
+		},
+	}
+}
+
+func rowSchema(e *types.Event, name string) Field {
+	row := Field{Type: "struct", Optional: true, Name: name}
+	if e.Relation != nil {
+		for _, col := range e.Relation.Columns {
+			f := columnSchema(col.Type)
+			f.Field = col.Name
+			f.Optional = !col.Key
+			row.Fields = append(row.Fields, f)
+		}
+		return row
+	}
+
+	values := e.Columns
+	if values == nil {
+		values = e.Before
+	}
+	if values == nil {
+		values = e.Identity
+	}
+	for _, col := range sortedKeys(values) {
+		f := valueSchema(values[col])
+		f.Field = col
+		f.Optional = true
+		row.Fields = append(row.Fields, f)
+	}
+	return row
+}
+
+// columnSchema maps a Postgres type the way Debezium does with its default
+// settings. Types without a mapping are strings.
+func columnSchema(oid uint32) Field {
+	switch oid {
+	case oidBool:
+		return Field{Type: "boolean"}
+	case oidInt2:
+		return Field{Type: "int16"}
+	case oidInt4:
+		return Field{Type: "int32"}
+	case oidInt8:
+		return Field{Type: "int64"}
+	case oidFloat4:
+		return Field{Type: "float"}
+	case oidFloat8:
+		return Field{Type: "double"}
+	case oidBytea:
+		return Field{Type: "bytes"}
+	case oidDate:
+		return Field{Type: "int32", Name: "io.debezium.time.Date", Version: 1}
+	case oidTimestamp:
+		return Field{Type: "int64", Name: "io.debezium.time.MicroTimestamp", Version: 1}
+	case oidTimestamptz:
+		return Field{Type: "string", Name: "io.debezium.time.ZonedTimestamp", Version: 1}
+	case oidUUID:
+		return Field{Type: "string", Name: "io.debezium.data.Uuid", Version: 1}
+	case oidJSON, oidJSONB:
+		return Field{Type: "string", Name: "io.debezium.data.Json", Version: 1}
+	default:
+		return Field{Type: "string"}
+	}
+}
+
+func valueSchema(v interface{}) Field {
+	switch v.(type) {
+	case bool:
+		return Field{Type: "boolean"}
+	case int16:
+		return Field{Type: "int16"}
+	case int32:
+		return Field{Type: "int32"}
+	case int, int64:
+		return Field{Type: "int64"}
+	case float32:
+		return Field{Type: "float"}
+	case float64:
+		return Field{Type: "double"}
+	case []byte:
+		return Field{Type: "bytes"}
+	case time.Time:
+		return Field{Type: "string", Name: "io.debezium.time.ZonedTimestamp", Version: 1}
+	default:
+		return Field{Type: "string"}
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
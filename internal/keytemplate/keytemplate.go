@@ -0,0 +1,177 @@
+// Package keytemplate builds sink keys, such as Redis keys and channels,
+// from text/template patterns over a row's columns.
+package keytemplate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// noValue is what text/template prints for a nil field. Helpers reject
+// NULLs themselves, since they would change it.
+const noValue = "<no value>"
+
+// ErrNullValue is returned when a column used in a key is NULL.
+var ErrNullValue = errors.New("key uses a NULL column")
+
+// Funcs are the helper functions available in key patterns.
+var Funcs = template.FuncMap{
+	"lower":   lower,
+	"upper":   upper,
+	"hash":    hash,
+	"join":    join,
+	"default": defaultValue,
+}
+
+// Parse parses a key pattern. Executing it fails if the pattern references
+// a column the row does not have, instead of rendering "<no value>".
+func Parse(name, pattern string) (*template.Template, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, errors.New("pattern is empty")
+	}
+	return template.New(name).Funcs(Funcs).Option("missingkey=error").Parse(pattern)
+}
+
+// Execute renders a key. A key that would contain a NULL column is
+// rejected with ErrNullValue.
+func Execute(t *template.Template, data map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	key := buf.String()
+	if strings.Contains(key, noValue) {
+		return "", ErrNullValue
+	}
+	if key == "" {
+		return "", errors.New("key is empty")
+	}
+	return key, nil
+}
+
+// Fields returns the names of the row fields a pattern references, e.g.
+// "table" and "id" for "{{.table}}:{{.id}}", in order of appearance.
+func Fields(t *template.Template) []string {
+	var fields []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			fields = append(fields, name)
+		}
+	}
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, c := range n.Nodes {
+					walk(c)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, c := range n.Cmds {
+					walk(c)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg)
+			}
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.FieldNode:
+			add(n.Ident[0])
+		case *parse.VariableNode:
+			if n.Ident[0] == "$" && len(n.Ident) > 1 {
+				add(n.Ident[1])
+			}
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		}
+	}
+	if t.Tree != nil {
+		walk(t.Tree.Root)
+	}
+	return fields
+}
+
+// lower lowercases a value, e.g. {{lower .email}}.
+func lower(v interface{}) (string, error) {
+	s, err := toString(v)
+	return strings.ToLower(s), err
+}
+
+// upper uppercases a value, e.g. {{upper .country}}.
+func upper(v interface{}) (string, error) {
+	s, err := toString(v)
+	return strings.ToUpper(s), err
+}
+
+// hash returns the first 16 hex digits of the SHA-256 of its arguments
+// joined by ":", e.g. {{hash .email}}.
+func hash(values ...interface{}) (string, error) {
+	s, err := join(":", values...)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// join joins the values of a composite key, e.g. {{join ":" .tenant_id .id}}.
+func join(sep string, values ...interface{}) (string, error) {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		s, err := toString(v)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// defaultValue returns def when v is NULL or empty, e.g.
+// {{default "none" .region}}.
+func defaultValue(def, v interface{}) interface{} {
+	if s, err := toString(v); err != nil || s == "" {
+		return def
+	}
+	return v
+}
+
+// toString formats a column value for a key, failing with ErrNullValue
+// for a NULL.
+func toString(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", ErrNullValue
+	case string:
+		return x, nil
+	case []byte:
+		return string(x), nil
+	}
+	return fmt.Sprint(v), nil
+}
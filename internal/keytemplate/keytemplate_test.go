@@ -0,0 +1,91 @@
+package keytemplate
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	row := map[string]interface{}{
+		"table":     "users",
+		"id":        int64(7),
+		"tenant_id": "acme",
+		"email":     "A@X.io",
+		"region":    nil,
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    string
+		wantErr error
+	}{
+		{"plain", "{{.table}}:{{.id}}", "users:7", nil},
+		{"lower", "users:by_email:{{lower .email}}", "users:by_email:a@x.io", nil},
+		{"join composite key", `{{.table}}:{{join ":" .tenant_id .id}}`, "users:acme:7", nil},
+		{"hash", "{{hash .email}}", "169ecf5d3dae758b", nil},
+		{"default for null", `{{default "none" .region}}`, "none", nil},
+		{"null column", "{{.table}}:{{.region}}", "", ErrNullValue},
+		{"null in join", `{{join ":" .id .region}}`, "", ErrNullValue},
+		{"null in lower", "{{.table}}:{{lower .region}}", "", ErrNullValue},
+		{"null in upper", "{{.table}}:{{upper .region}}", "", ErrNullValue},
+		{"null in hash", "{{hash .region}}", "", ErrNullValue},
+		{"missing column", "{{.table}}:{{.uuid}}", "", errAny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := Parse("key", tt.pattern)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			got, err := Execute(tmpl, row)
+			switch {
+			case tt.wantErr == errAny:
+				if err == nil {
+					t.Errorf("Expected error, got key %q", got)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected %v, got %v", tt.wantErr, err)
+				}
+			case err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case got != tt.want:
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any error")
+
+func TestParseRejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"", "{{.id", "{{unknown .id}}"} {
+		if _, err := Parse("key", pattern); err == nil {
+			t.Errorf("Expected error for pattern %q", pattern)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"{{.table}}:{{.id}}", []string{"table", "id"}},
+		{`{{join ":" .tenant_id .id}}:{{hash .email}}`, []string{"tenant_id", "id", "email"}},
+		{`{{if .region}}{{.region | lower}}{{else}}{{$.id}}{{end}}`, []string{"region", "id"}},
+		{"static", nil},
+	}
+	for _, tt := range tests {
+		tmpl, err := Parse("key", tt.pattern)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", tt.pattern, err)
+		}
+		if got := Fields(tmpl); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Fields(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
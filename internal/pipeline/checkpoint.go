@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"sync"
 
+	"github.com/nikolay-makurin/replicator/internal/sink"
 	"github.com/nikolay-makurin/replicator/pkg/types"
 )
 
@@ -31,6 +32,7 @@ type CheckpointManager struct {
 	inflight     LSNHeap       // Min-heap of all tracked LSNs
 	done         map[types.LSN]bool
 	lastSafeLSN  types.LSN
+	holds        []sink.Buffering
 }
 
 func NewCheckpointManager(startLSN types.LSN) *CheckpointManager {
@@ -53,9 +55,32 @@ func (cm *CheckpointManager) MarkDone(lsn types.LSN) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
+	// Already checkpointed, e.g. by MarkRangeDone
+	if lsn <= cm.lastSafeLSN {
+		return
+	}
 	cm.done[lsn] = true
+	cm.advance()
+}
+
+// MarkRangeDone marks every tracked LSN in [from, to] as done, e.g. the
+// changes of a batch that was dropped after a permanent failure and then
+// skipped.
+func (cm *CheckpointManager) MarkRangeDone(from, to types.LSN) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
 
-	// Advance safe LSN
+	for _, lsn := range cm.inflight {
+		if lsn >= from && lsn <= to {
+			cm.done[lsn] = true
+		}
+	}
+	cm.advance()
+}
+
+// advance moves the safe LSN past the done LSNs at the bottom of the heap.
+// cm.mu must be held.
+func (cm *CheckpointManager) advance() {
 	for cm.inflight.Len() > 0 {
 		min := cm.inflight[0]
 		if cm.done[min] {
@@ -68,8 +93,32 @@ func (cm *CheckpointManager) MarkDone(lsn types.LSN) {
 	}
 }
 
-func (cm *CheckpointManager) GetSafeLSN() types.LSN {
+// Hold keeps the safe LSN below the pending LSN of s, if any. It is used
+// by sinks that acknowledge a batch before its events are durable, such as
+// sinks that buffer events into larger files.
+func (cm *CheckpointManager) Hold(s sink.Buffering) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	return cm.lastSafeLSN
+	cm.holds = append(cm.holds, s)
+}
+
+// Inflight returns the number of tracked LSNs that are not yet done.
+func (cm *CheckpointManager) Inflight() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return cm.inflight.Len()
+}
+
+func (cm *CheckpointManager) GetSafeLSN() types.LSN {
+	// Sinks take their own locks in PendingLSN; never call them under cm.mu
+	cm.mu.Lock()
+	safe := cm.lastSafeLSN
+	holds := cm.holds
+	cm.mu.Unlock()
+	for _, s := range holds {
+		if lsn, ok := s.PendingLSN(); ok && lsn <= safe {
+			safe = lsn - 1
+		}
+	}
+	return safe
 }
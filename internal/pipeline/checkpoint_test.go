@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"testing"
+	"time"
 
 	"github.com/nikolay-makurin/replicator/pkg/types"
 )
@@ -32,3 +33,63 @@ func TestCheckpointManager(t *testing.T) {
 		t.Errorf("Expected safe LSN 103, got %d", safe)
 	}
 }
+
+func TestCheckpointManagerHold(t *testing.T) {
+	cm := NewCheckpointManager(types.LSN(100))
+	pending, held := types.LSN(102), true
+	cm.Hold(pendingFunc(func() (types.LSN, bool) { return pending, held }))
+
+	cm.Track(types.LSN(101))
+	cm.Track(types.LSN(102))
+	cm.Track(types.LSN(103))
+	cm.MarkDone(types.LSN(101))
+	cm.MarkDone(types.LSN(102))
+	cm.MarkDone(types.LSN(103))
+
+	// 102 is written but still buffered by a sink
+	if safe := cm.GetSafeLSN(); safe != 101 {
+		t.Errorf("Expected safe LSN 101, got %d", safe)
+	}
+
+	held = false
+	if safe := cm.GetSafeLSN(); safe != 103 {
+		t.Errorf("Expected safe LSN 103, got %d", safe)
+	}
+}
+
+// pendingFunc implements sink.Buffering with a function.
+type pendingFunc func() (types.LSN, bool)
+
+func (f pendingFunc) PendingLSN() (types.LSN, bool) { return f() }
+
+func TestCheckpointManagerHoldUnlocked(t *testing.T) {
+	cm := NewCheckpointManager(types.LSN(100))
+	// A sink that waits on the checkpoint manager while computing its
+	// pending LSN must not deadlock GetSafeLSN
+	cm.Hold(pendingFunc(func() (types.LSN, bool) { return 0, cm.Inflight() > 0 }))
+
+	done := make(chan types.LSN)
+	go func() { done <- cm.GetSafeLSN() }()
+	select {
+	case safe := <-done:
+		if safe != 100 {
+			t.Errorf("Expected safe LSN 100, got %d", safe)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GetSafeLSN deadlocked")
+	}
+}
+
+func TestCheckpointManagerInflight(t *testing.T) {
+	cm := NewCheckpointManager(types.LSN(100))
+	cm.Track(types.LSN(101))
+	cm.Track(types.LSN(102))
+	cm.MarkDone(types.LSN(102))
+	if n := cm.Inflight(); n != 2 {
+		t.Errorf("Expected 2 LSNs in flight, got %d", n)
+	}
+	cm.MarkDone(types.LSN(101))
+	if n := cm.Inflight(); n != 0 {
+		t.Errorf("Expected nothing in flight, got %d", n)
+	}
+}
@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// pendingRow holds the net effect of the events seen so far for one row.
+// del is the delete of the row as it existed before the batch, row is the
+// insert or update that produces its final image.
+type pendingRow struct {
+	del    *types.Event
+	delIdx int
+	row    *types.Event
+	rowIdx int
+}
+
+// compact collapses the events of a batch into their net effect per row:
+// insert+updates become a single insert with the final values, insert+delete
+// disappears and consecutive updates become the last update. Rows are keyed
+// by table and replica identity, and followed across key changes.
+//
+// Every surviving event takes the position of the last event folded into it,
+// so the order of changes to the same row is preserved. Events without an
+// identity are passed through untouched.
+func compact(events []*types.Event) []*types.Event {
+	slots := make([]*types.Event, len(events))
+	pending := make(map[string]*pendingRow)
+
+	emit := func(key string) {
+		p, ok := pending[key]
+		if !ok {
+			return
+		}
+		if p.del != nil {
+			slots[p.delIdx] = p.del
+		}
+		if p.row != nil {
+			slots[p.rowIdx] = p.row
+		}
+		delete(pending, key)
+	}
+
+	for i, e := range events {
+		key, ok := rowKey(e, e.Identity, identityColumns(e))
+		if !ok || e.Type == types.EventCommit {
+			slots[i] = e
+			continue
+		}
+
+		p := pending[key]
+		if p == nil {
+			p = &pendingRow{}
+			pending[key] = p
+		}
+
+		switch e.Type {
+		case types.EventInsert:
+			// A second insert for the same key only happens on replay;
+			// the later image wins.
+			p.row = cloneEvent(e)
+			p.rowIdx = i
+
+		case types.EventUpdate:
+			if p.row == nil {
+				p.row = cloneEvent(e)
+			} else {
+				for k, v := range e.Columns {
+					p.row.Columns[k] = v
+				}
+				p.row.LSN = e.LSN
+				p.row.Timestamp = e.Timestamp
+			}
+			p.rowIdx = i
+
+			// Follow the row if the update changed its key.
+			cols := identityColumns(e)
+			newKey, ok := rowKey(e, e.Columns, cols)
+			if !ok {
+				emit(key)
+				continue
+			}
+			if p.row.Type == types.EventInsert {
+				p.row.Identity = pick(p.row.Columns, cols)
+			}
+			if newKey != key {
+				emit(newKey)
+				delete(pending, key)
+				pending[newKey] = p
+			}
+
+		case types.EventDelete:
+			switch {
+			case p.row == nil:
+				p.del = e
+				p.delIdx = i
+			case p.row.Type == types.EventInsert:
+				// The row was created in this batch, so nothing reaches
+				// the sink unless it replaced an earlier row.
+				p.row = nil
+			default:
+				// Delete the row as the sink knows it, which is the
+				// identity before the first update in this batch.
+				d := cloneEvent(e)
+				d.Identity = p.row.Identity
+				p.del = d
+				p.delIdx = i
+				p.row = nil
+			}
+		}
+	}
+
+	for key := range pending {
+		emit(key)
+	}
+
+	out := slots[:0]
+	for _, e := range slots {
+		if e != nil {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// identityColumns returns the sorted identity column names of an event.
+func identityColumns(e *types.Event) []string {
+	cols := make([]string, 0, len(e.Identity))
+	for k := range e.Identity {
+		cols = append(cols, k)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// rowKey builds the compaction key of a row from the given identity columns.
+// It reports false if there are no identity columns or a value is missing.
+func rowKey(e *types.Event, values map[string]interface{}, cols []string) (string, bool) {
+	if len(cols) == 0 {
+		return "", false
+	}
+	var sb strings.Builder
+	sb.WriteString(e.Schema)
+	sb.WriteByte('.')
+	sb.WriteString(e.Table)
+	for _, col := range cols {
+		v, ok := values[col]
+		if !ok {
+			return "", false
+		}
+		fmt.Fprintf(&sb, "\x00%s=%v", col, v)
+	}
+	return sb.String(), true
+}
+
+func pick(values map[string]interface{}, cols []string) map[string]interface{} {
+	out := make(map[string]interface{}, len(cols))
+	for _, col := range cols {
+		out[col] = values[col]
+	}
+	return out
+}
+
+func cloneEvent(e *types.Event) *types.Event {
+	c := *e
+	c.Columns = make(map[string]interface{}, len(e.Columns))
+	for k, v := range e.Columns {
+		c.Columns[k] = v
+	}
+	return &c
+}
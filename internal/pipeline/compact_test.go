@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func row(typ types.EventType, lsn types.LSN, id int64, cols map[string]interface{}) *types.Event {
+	return &types.Event{
+		Type:     typ,
+		Schema:   "public",
+		Table:    "counters",
+		Columns:  cols,
+		Identity: map[string]interface{}{"id": id},
+		LSN:      lsn,
+	}
+}
+
+func TestCompact(t *testing.T) {
+	t.Run("insert and updates become insert with final values", func(t *testing.T) {
+		out := compact([]*types.Event{
+			row(types.EventInsert, 1, 1, map[string]interface{}{"id": int64(1), "n": int64(0), "name": "a"}),
+			row(types.EventUpdate, 2, 1, map[string]interface{}{"id": int64(1), "n": int64(1)}),
+			row(types.EventUpdate, 3, 1, map[string]interface{}{"id": int64(1), "n": int64(2)}),
+		})
+		if len(out) != 1 {
+			t.Fatalf("Expected 1 event, got %d", len(out))
+		}
+		if out[0].Type != types.EventInsert {
+			t.Errorf("Expected INSERT, got %s", out[0].Type)
+		}
+		if out[0].Columns["n"] != int64(2) || out[0].Columns["name"] != "a" {
+			t.Errorf("Unexpected columns: %v", out[0].Columns)
+		}
+		if out[0].LSN != 3 {
+			t.Errorf("Expected LSN 3, got %d", out[0].LSN)
+		}
+	})
+
+	t.Run("insert and delete cancel out", func(t *testing.T) {
+		out := compact([]*types.Event{
+			row(types.EventInsert, 1, 1, map[string]interface{}{"id": int64(1)}),
+			row(types.EventUpdate, 2, 1, map[string]interface{}{"id": int64(1)}),
+			row(types.EventDelete, 3, 1, nil),
+		})
+		if len(out) != 0 {
+			t.Fatalf("Expected no events, got %d", len(out))
+		}
+	})
+
+	t.Run("updates become last update", func(t *testing.T) {
+		out := compact([]*types.Event{
+			row(types.EventUpdate, 1, 1, map[string]interface{}{"id": int64(1), "n": int64(1)}),
+			row(types.EventUpdate, 2, 1, map[string]interface{}{"id": int64(1), "n": int64(2)}),
+		})
+		if len(out) != 1 || out[0].Type != types.EventUpdate || out[0].Columns["n"] != int64(2) {
+			t.Fatalf("Unexpected result: %+v", out)
+		}
+	})
+
+	t.Run("delete then insert keeps both in order", func(t *testing.T) {
+		out := compact([]*types.Event{
+			row(types.EventDelete, 1, 1, nil),
+			row(types.EventInsert, 2, 1, map[string]interface{}{"id": int64(1), "n": int64(0)}),
+			row(types.EventUpdate, 3, 1, map[string]interface{}{"id": int64(1), "n": int64(5)}),
+		})
+		if len(out) != 2 {
+			t.Fatalf("Expected 2 events, got %d", len(out))
+		}
+		if out[0].Type != types.EventDelete || out[1].Type != types.EventInsert {
+			t.Errorf("Expected DELETE then INSERT, got %s then %s", out[0].Type, out[1].Type)
+		}
+	})
+
+	t.Run("key change is followed", func(t *testing.T) {
+		moved := row(types.EventUpdate, 2, 1, map[string]interface{}{"id": int64(2), "n": int64(1)})
+		out := compact([]*types.Event{
+			row(types.EventUpdate, 1, 1, map[string]interface{}{"id": int64(1), "n": int64(0)}),
+			moved,
+			row(types.EventDelete, 3, 2, nil),
+		})
+		if len(out) != 1 || out[0].Type != types.EventDelete {
+			t.Fatalf("Expected a single DELETE, got %+v", out)
+		}
+		if out[0].Identity["id"] != int64(1) {
+			t.Errorf("Expected delete of original key 1, got %v", out[0].Identity["id"])
+		}
+	})
+
+	t.Run("rows without identity pass through", func(t *testing.T) {
+		e1 := &types.Event{Type: types.EventInsert, Table: "logs", LSN: 1}
+		e2 := &types.Event{Type: types.EventInsert, Table: "logs", LSN: 2}
+		out := compact([]*types.Event{
+			e1,
+			row(types.EventUpdate, 2, 1, map[string]interface{}{"id": int64(1)}),
+			e2,
+			row(types.EventUpdate, 3, 1, map[string]interface{}{"id": int64(1)}),
+		})
+		if len(out) != 3 || out[0] != e1 || out[1] != e2 || out[2].LSN != 3 {
+			t.Fatalf("Unexpected result: %+v", out)
+		}
+	})
+}
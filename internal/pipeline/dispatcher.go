@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"context"
+	"fmt"
 	"hash/fnv"
 	"log/slog"
 	"sync"
@@ -11,26 +12,59 @@ import (
 	"github.com/nikolay-makurin/replicator/internal/sink"
 	"github.com/nikolay-makurin/replicator/internal/telemetry"
 	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Dispatcher struct {
 	cfg        config.PipelineConfig
 	workers    []*Worker
 	checkPoint *CheckpointManager
+	skips      *skipList
 }
 
 func NewDispatcher(cfg config.PipelineConfig, s sink.Sink, cm *CheckpointManager) *Dispatcher {
+	skips := &skipList{}
 	workers := make([]*Worker, cfg.WorkerCount)
 	for i := 0; i < cfg.WorkerCount; i++ {
 		workers[i] = NewWorker(i, cfg, s, cm)
+		workers[i].skips = skips
 	}
 	return &Dispatcher{
 		cfg:        cfg,
 		workers:    workers,
 		checkPoint: cm,
+		skips:      skips,
 	}
 }
 
+// Skip drops the changes with LSNs in [from, to], including those already
+// queued, without writing them. They are still checkpointed, as are those
+// of a batch in the range that was already dropped after a failed write.
+func (d *Dispatcher) Skip(from, to types.LSN) {
+	d.skips.add(from, to)
+	d.checkPoint.MarkRangeDone(from, to)
+}
+
+// Flush makes every worker write its batch now and returns once all have.
+func (d *Dispatcher) Flush(ctx context.Context) error {
+	for _, w := range d.workers {
+		done := make(chan struct{})
+		select {
+		case w.flushReq <- done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 func (d *Dispatcher) Start(ctx context.Context, in <-chan *types.Event) {
 	// Start workers
 	var wg sync.WaitGroup
@@ -42,6 +76,8 @@ func (d *Dispatcher) Start(ctx context.Context, in <-chan *types.Event) {
 		}(w)
 	}
 
+	go d.reportQueues(ctx, in)
+
 	// Dispatch loop
 	go func() {
 		for event := range in {
@@ -60,6 +96,48 @@ func (d *Dispatcher) Start(ctx context.Context, in <-chan *types.Event) {
 	wg.Wait()
 }
 
+// queueReportInterval is how often queue fill ratios are reported.
+const queueReportInterval = time.Second
+
+// reportQueues records the fill ratio of the input and worker queues until
+// ctx is done.
+func (d *Dispatcher) reportQueues(ctx context.Context, in <-chan *types.Event) {
+	ticker := time.NewTicker(queueReportInterval)
+	defer ticker.Stop()
+	source := telemetry.QueueFillRatio.WithLabelValues(d.cfg.Name, "source")
+	workers := make([]prometheus.Gauge, len(d.workers))
+	for i := range d.workers {
+		workers[i] = telemetry.QueueFillRatio.WithLabelValues(d.cfg.Name, fmt.Sprintf("worker-%d", i))
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		source.Set(fillRatio(len(in), cap(in)))
+		for i, w := range d.workers {
+			workers[i].Set(fillRatio(len(w.in), cap(w.in)))
+		}
+	}
+}
+
+func fillRatio(n, capacity int) float64 {
+	if capacity == 0 {
+		return 0
+	}
+	return float64(n) / float64(capacity)
+}
+
+// QueueDepths returns the number of events waiting in each worker's queue.
+func (d *Dispatcher) QueueDepths() []int {
+	depths := make([]int, len(d.workers))
+	for i, w := range d.workers {
+		depths[i] = len(w.in)
+	}
+	return depths
+}
+
 func hash(s string) uint32 {
 	h := fnv.New32a()
 	h.Write([]byte(s))
@@ -73,6 +151,8 @@ type Worker struct {
 	in         chan *types.Event
 	batch      *types.Batch
 	checkpoint *CheckpointManager
+	skips      *skipList
+	flushReq   chan chan struct{}
 }
 
 func NewWorker(id int, cfg config.PipelineConfig, s sink.Sink, cm *CheckpointManager) *Worker {
@@ -83,6 +163,8 @@ func NewWorker(id int, cfg config.PipelineConfig, s sink.Sink, cm *CheckpointMan
 		in:         make(chan *types.Event, cfg.BufferSize),
 		batch:      &types.Batch{Events: make([]*types.Event, 0, cfg.BatchSize)},
 		checkpoint: cm,
+		skips:      &skipList{},
+		flushReq:   make(chan chan struct{}),
 	}
 }
 
@@ -100,47 +182,102 @@ func (w *Worker) Run(ctx context.Context) {
 				w.flush(ctx)
 				return
 			}
-			w.batch.Events = append(w.batch.Events, event)
-			if event.LSN > w.batch.MaxLSN {
-				w.batch.MaxLSN = event.LSN
-			}
-			if len(w.batch.Events) >= w.cfg.BatchSize {
-				w.flush(ctx)
-			}
+			w.add(ctx, event)
 		case <-ticker.C:
 			if len(w.batch.Events) > 0 {
 				w.flush(ctx)
 			}
+		case done := <-w.flushReq:
+			// Include the events already queued
+			for n := len(w.in); n > 0; n-- {
+				if event, ok := <-w.in; ok {
+					w.add(ctx, event)
+				}
+			}
+			w.flush(ctx)
+			close(done)
 		}
 	}
 }
 
+func (w *Worker) add(ctx context.Context, event *types.Event) {
+	w.batch.Events = append(w.batch.Events, event)
+	if event.LSN > w.batch.MaxLSN {
+		w.batch.MaxLSN = event.LSN
+	}
+	if len(w.batch.Events) >= w.cfg.BatchSize {
+		w.flush(ctx)
+	}
+}
+
 func (w *Worker) flush(ctx context.Context) {
 	if len(w.batch.Events) == 0 {
 		return
 	}
 
-	start := time.Now()
-	err := w.sink.Write(ctx, w.batch)
-	duration := time.Since(start)
+	// Batches are traced on their own, linked to the source transactions
+	// of their changes
+	ctx, span := telemetry.Tracer().Start(ctx, "flush",
+		trace.WithNewRoot(),
+		trace.WithLinks(txLinks(w.batch.Events)...),
+		trace.WithAttributes(
+			attribute.String("replicator.pipeline", w.cfg.Name),
+			attribute.Int("replicator.worker", w.id),
+			attribute.Int("replicator.events", len(w.batch.Events)),
+			attribute.String("replicator.max_lsn", w.batch.MaxLSN.String()),
+		),
+	)
+
+	out := w.batch
+	if kept := w.skips.filter(w.batch.Events); len(kept) < len(w.batch.Events) {
+		slog.Warn("Skipping changes", "pipeline", w.cfg.Name, "worker", w.id, "events", len(w.batch.Events)-len(kept))
+		out = &types.Batch{Events: kept, MaxLSN: w.batch.MaxLSN}
+	}
+	if w.cfg.Compact && len(out.Events) > 0 {
+		received := len(out.Events)
+		out = &types.Batch{Events: compact(out.Events), MaxLSN: out.MaxLSN}
+		telemetry.CompactionRatio.WithLabelValues(w.cfg.Name).Observe(float64(len(out.Events)) / float64(received))
+	}
+
+	span.SetAttributes(attribute.Int("replicator.events_written", len(out.Events)))
 
-	telemetry.SinkLatency.WithLabelValues("generic").Observe(duration.Seconds())
-	telemetry.BatchSize.WithLabelValues("generic").Observe(float64(len(w.batch.Events)))
+	var err error
+	if len(out.Events) > 0 {
+		// Each sink records its own latency, batch size and event counts
+		err = w.sink.Write(ctx, out)
+	}
+	telemetry.EndSpan(span, err)
 
 	if err != nil {
-		slog.Error("Sink write failed", "worker", w.id, "error", err)
+		slog.Error("Sink write failed", "pipeline", w.cfg.Name, "worker", w.id, "error", err)
 		// Retry logic should be here or in Sink.
 		// For now, we drop or panic. In prod, we retry indefinitely.
 		// panic(err) 
 	} else {
-		// Mark all LSNs in batch as done
+		// Mark all LSNs in batch as done, including compacted-away events
 		for _, e := range w.batch.Events {
-			w.checkpoint.MarkDone(e.LSN)
+			if !e.Snapshot {
+				w.checkpoint.MarkDone(e.LSN)
+			}
 		}
-		telemetry.EventsProcessed.WithLabelValues("success", "generic").Add(float64(len(w.batch.Events)))
 	}
 
 	// Reset batch
 	w.batch.Events = w.batch.Events[:0]
 	w.batch.MaxLSN = 0
 }
+
+// txLinks links to each source transaction that events belong to.
+func txLinks(events []*types.Event) []trace.Link {
+	var links []trace.Link
+	seen := make(map[trace.SpanID]bool)
+	for _, e := range events {
+		sc, ok := telemetry.EventTrace(e)
+		if !ok || seen[sc.SpanID()] {
+			continue
+		}
+		seen[sc.SpanID()] = true
+		links = append(links, trace.Link{SpanContext: sc})
+	}
+	return links
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/sink"
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWorkerTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	// Two source transactions, the first with two changes
+	_, tx1 := telemetry.Tracer().Start(context.Background(), "transaction")
+	tx1.End()
+	_, tx2 := telemetry.Tracer().Start(context.Background(), "transaction")
+	tx2.End()
+
+	cfg := config.PipelineConfig{Name: "orders", BufferSize: 10, BatchSize: 100, BatchInterval: time.Hour}
+	s := sink.NewRetrySink(sink.Labels{Pipeline: "orders", Name: "pg1", Type: "postgres"}, &recordingSink{}, config.RetryConfig{})
+	cm := NewCheckpointManager(100)
+	w := NewWorker(0, cfg, s, cm)
+	events := []*types.Event{
+		{Type: types.EventInsert, Table: "orders", LSN: 101},
+		{Type: types.EventUpdate, Table: "orders", LSN: 102},
+		{Type: types.EventInsert, Table: "orders", LSN: 103},
+		{Type: types.EventInsert, Table: "orders", LSN: 104}, // Not traced
+	}
+	telemetry.TraceEvent(events[0], tx1.SpanContext())
+	telemetry.TraceEvent(events[1], tx1.SpanContext())
+	telemetry.TraceEvent(events[2], tx2.SpanContext())
+	for _, e := range events {
+		cm.Track(e.LSN)
+		w.add(context.Background(), e)
+	}
+	w.flush(context.Background())
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	flush, ok := spans["flush"]
+	if !ok {
+		t.Fatalf("Expected a flush span, got %v", exporter.GetSpans())
+	}
+	if len(flush.Links) != 2 || flush.Links[0].SpanContext.SpanID() != tx1.SpanContext().SpanID() || flush.Links[1].SpanContext.SpanID() != tx2.SpanContext().SpanID() {
+		t.Errorf("Expected links to both transactions, got %v", flush.Links)
+	}
+	if flush.Parent.IsValid() {
+		t.Error("Expected the flush span to start a trace")
+	}
+	write, ok := spans["write"]
+	if !ok {
+		t.Fatal("Expected a write span")
+	}
+	if write.Parent.SpanID() != flush.SpanContext.SpanID() {
+		t.Error("Expected the write span to be a child of the flush span")
+	}
+	for _, e := range events {
+		if _, ok := telemetry.EventTrace(e); ok {
+			t.Errorf("Expected the trace of %s to be released by the flush", e.LSN)
+		}
+	}
+}
+
+func TestWorkerCompaction(t *testing.T) {
+	cfg := config.PipelineConfig{Name: "compacted", BufferSize: 10, BatchSize: 100, BatchInterval: time.Hour, Compact: true}
+	s := &recordingSink{}
+	cm := NewCheckpointManager(100)
+	w := NewWorker(0, cfg, s, cm)
+	events := []*types.Event{
+		row(types.EventInsert, 101, 1, map[string]interface{}{"id": int64(1), "n": int64(0)}),
+		row(types.EventUpdate, 102, 1, map[string]interface{}{"id": int64(1), "n": int64(1)}),
+		row(types.EventUpdate, 103, 1, map[string]interface{}{"id": int64(1), "n": int64(2)}),
+	}
+	for _, e := range events {
+		cm.Track(e.LSN)
+		w.add(context.Background(), e)
+	}
+	w.flush(context.Background())
+
+	if len(s.lsns) != 1 || s.lsns[0] != 103 {
+		t.Errorf("Expected one compacted change at 103, got %v", s.lsns)
+	}
+	// The changes compacted away are checkpointed too
+	if n := cm.Inflight(); n != 0 {
+		t.Errorf("Expected every change to be done, %d in flight", n)
+	}
+	if lsn := cm.GetSafeLSN(); lsn != 103 {
+		t.Errorf("Expected safe LSN 103, got %s", lsn)
+	}
+
+	var m dto.Metric
+	if err := telemetry.CompactionRatio.WithLabelValues("compacted").(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if h := m.GetHistogram(); h.GetSampleCount() != 1 || h.GetSampleSum() != 1.0/3 {
+		t.Errorf("Expected one ratio of 1/3, got %d with sum %v", h.GetSampleCount(), h.GetSampleSum())
+	}
+}
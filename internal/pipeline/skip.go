@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// skipList holds the LSN ranges whose changes are dropped, e.g. a poison
+// change a sink keeps rejecting.
+type skipList struct {
+	mu     sync.RWMutex
+	ranges [][2]types.LSN
+}
+
+func (s *skipList) add(from, to types.LSN) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ranges = append(s.ranges, [2]types.LSN{from, to})
+}
+
+func (s *skipList) contains(lsn types.LSN) bool {
+	for _, r := range s.ranges {
+		if lsn >= r[0] && lsn <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the events outside every range. Snapshot rows are never
+// skipped.
+func (s *skipList) filter(events []*types.Event) []*types.Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.ranges) == 0 {
+		return events
+	}
+	kept := make([]*types.Event, 0, len(events))
+	for _, e := range events {
+		if e.Snapshot || !s.contains(e.LSN) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
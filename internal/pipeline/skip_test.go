@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// recordingSink keeps the LSNs of the events written to it.
+type recordingSink struct {
+	mu   sync.Mutex
+	lsns []types.LSN
+}
+
+func (s *recordingSink) Write(ctx context.Context, batch *types.Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range batch.Events {
+		s.lsns = append(s.lsns, e.LSN)
+	}
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestDispatcherSkipAndFlush(t *testing.T) {
+	cfg := config.PipelineConfig{WorkerCount: 1, BufferSize: 10, BatchSize: 100, BatchInterval: time.Hour}
+	s := &recordingSink{}
+	cm := NewCheckpointManager(100)
+	d := NewDispatcher(cfg, s, cm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *types.Event)
+	go d.Start(ctx, in)
+
+	d.Skip(102, 103)
+	for lsn := types.LSN(101); lsn <= 104; lsn++ {
+		cm.Track(lsn)
+		in <- &types.Event{Type: types.EventInsert, Table: "users", LSN: lsn}
+	}
+	// A snapshot row at a skipped LSN is still written, and not checkpointed
+	in <- &types.Event{Type: types.EventInsert, Table: "users", LSN: 103, Snapshot: true}
+
+	// The last event may still be on its way to the worker
+	var got []types.LSN
+	for deadline := time.Now().Add(time.Second); len(got) < 3 && time.Now().Before(deadline); {
+		if err := d.Flush(ctx); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		s.mu.Lock()
+		got = s.lsns
+		s.mu.Unlock()
+	}
+	if len(got) != 3 || got[0] != 101 || got[1] != 104 || got[2] != 103 {
+		t.Errorf("Expected LSNs 101, 104 and the snapshot row, got %v", got)
+	}
+	// Skipped changes are checkpointed
+	if safe := cm.GetSafeLSN(); safe != 104 {
+		t.Errorf("Expected safe LSN 104, got %d", safe)
+	}
+}
+
+// failingSink rejects every batch, recording its LSNs.
+type failingSink struct {
+	recordingSink
+}
+
+func (s *failingSink) Write(ctx context.Context, batch *types.Batch) error {
+	s.recordingSink.Write(ctx, batch)
+	return errors.New("rejected")
+}
+
+func TestDispatcherSkipDroppedBatch(t *testing.T) {
+	cfg := config.PipelineConfig{WorkerCount: 1, BufferSize: 10, BatchSize: 100, BatchInterval: time.Hour}
+	cm := NewCheckpointManager(100)
+	s := &failingSink{}
+	d := NewDispatcher(cfg, s, cm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in := make(chan *types.Event)
+	go d.Start(ctx, in)
+
+	for lsn := types.LSN(101); lsn <= 103; lsn++ {
+		cm.Track(lsn)
+		in <- &types.Event{Type: types.EventInsert, Table: "users", LSN: lsn}
+	}
+	// The last event may still be on its way to the worker
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if err := d.Flush(ctx); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		s.mu.Lock()
+		n := len(s.lsns)
+		s.mu.Unlock()
+		if n == 3 {
+			break
+		}
+	}
+	if safe := cm.GetSafeLSN(); safe != 100 {
+		t.Fatalf("Expected the failed batch to hold the checkpoint at 100, got %d", safe)
+	}
+
+	// Skipping the failed changes releases the checkpoint
+	d.Skip(101, 102)
+	if safe := cm.GetSafeLSN(); safe != 102 {
+		t.Errorf("Expected safe LSN 102, got %d", safe)
+	}
+	if n := cm.Inflight(); n != 1 {
+		t.Errorf("Expected 103 to stay in flight, got %d", n)
+	}
+}
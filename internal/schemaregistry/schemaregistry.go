@@ -0,0 +1,135 @@
+// Package schemaregistry registers Avro schemas with a Confluent-compatible
+// schema registry and frames values in its wire format.
+package schemaregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client registers schemas under subjects. IDs are cached, so a schema is
+// only sent to the registry once per subject.
+type Client struct {
+	baseURL  string
+	username string
+	password string
+	http     *http.Client
+
+	mu  sync.Mutex
+	ids map[string]int // Keyed by subject + "\x00" + schema
+}
+
+func New(baseURL, username, password string, timeout time.Duration) *Client {
+	return &Client{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		username: username,
+		password: password,
+		http:     &http.Client{Timeout: timeout},
+		ids:      make(map[string]int),
+	}
+}
+
+// Error is an error response of the registry.
+type Error struct {
+	StatusCode int
+	Code       int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("schema registry returned %d (error code %d): %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Temporary reports whether the request may succeed when repeated.
+// Incompatible (409) and invalid (422) schemas never do.
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Register registers schema under subject and returns its ID. Registering a
+// schema the subject already has returns the existing ID; a new schema must
+// pass the subject's compatibility check.
+func (c *Client) Register(ctx context.Context, subject, schema string) (int, error) {
+	cacheKey := subject + "\x00" + schema
+	c.mu.Lock()
+	id, ok := c.ids[cacheKey]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"schema": schema})
+	if err != nil {
+		return 0, err
+	}
+	endpoint := c.baseURL + "/subjects/" + url.PathEscape(subject) + "/versions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create schema registry request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to register schema for %s: %w", subject, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		regErr := &Error{StatusCode: resp.StatusCode}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(msg, regErr) != nil || regErr.Message == "" {
+			regErr.Message = string(bytes.TrimSpace(msg))
+		}
+		return 0, fmt.Errorf("failed to register schema for %s: %w", subject, regErr)
+	}
+	var result struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("invalid schema registry response for %s: %w", subject, err)
+	}
+
+	c.mu.Lock()
+	c.ids[cacheKey] = result.ID
+	c.mu.Unlock()
+	return result.ID, nil
+}
+
+// Close releases idle connections.
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+// magicByte starts every value in the wire format.
+const magicByte = 0
+
+// Frame prefixes an encoded value with the wire format header: the magic
+// byte and the big-endian schema ID.
+func Frame(id int, data []byte) []byte {
+	out := make([]byte, 5, 5+len(data))
+	out[0] = magicByte
+	binary.BigEndian.PutUint32(out[1:], uint32(id))
+	return append(out, data...)
+}
+
+// Unframe splits a framed value into schema ID and encoded data.
+func Unframe(msg []byte) (int, []byte, error) {
+	if len(msg) < 5 || msg[0] != magicByte {
+		return 0, nil, fmt.Errorf("not a schema registry framed value")
+	}
+	return int(binary.BigEndian.Uint32(msg[1:5])), msg[5:], nil
+}
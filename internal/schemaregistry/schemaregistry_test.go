@@ -0,0 +1,74 @@
+package schemaregistry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if user, pass, _ := r.BasicAuth(); user != "u" || pass != "p" {
+			t.Errorf("Expected basic auth, got %q %q", user, pass)
+		}
+		var req struct {
+			Schema string `json:"schema"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		switch {
+		case r.URL.Path == "/subjects/orders-value/versions":
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error_code":409,"message":"Schema being registered is incompatible"}`))
+		case r.URL.Path == "/subjects/users-value/versions" && req.Schema == `"string"`:
+			w.Write([]byte(`{"id":7}`))
+		default:
+			http.Error(w, "unexpected request "+r.URL.Path, http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL+"/", "u", "p", time.Second)
+	defer c.Close()
+	ctx := context.Background()
+
+	for range 2 {
+		id, err := c.Register(ctx, "users-value", `"string"`)
+		if err != nil || id != 7 {
+			t.Fatalf("Expected ID 7, got %d (%v)", id, err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected the ID to be cached, got %d requests", calls.Load())
+	}
+
+	_, err := c.Register(ctx, "orders-value", `"long"`)
+	var regErr *Error
+	if !errors.As(err, &regErr) || regErr.Code != 409 || regErr.Temporary() {
+		t.Errorf("Expected a permanent 409 error, got %v", err)
+	}
+	_, err = c.Register(ctx, "other-value", `"long"`)
+	if !errors.As(err, &regErr) || !regErr.Temporary() {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	msg := Frame(258, []byte{0xAA})
+	if string(msg) != "\x00\x00\x00\x01\x02\xAA" {
+		t.Errorf("Unexpected framing %x", msg)
+	}
+	id, data, err := Unframe(msg)
+	if err != nil || id != 258 || len(data) != 1 || data[0] != 0xAA {
+		t.Errorf("Unexpected unframing: %d %x %v", id, data, err)
+	}
+	if _, _, err := Unframe([]byte{1, 0, 0, 0, 1}); err == nil {
+		t.Error("Expected an error for a wrong magic byte")
+	}
+}
@@ -3,7 +3,10 @@ package sink
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
@@ -12,8 +15,15 @@ import (
 )
 
 type ClickHouseSink struct {
-	conn driver.Conn
-	db   string // ClickHouse database name
+	conn              driver.Conn
+	db                string // ClickHouse database name
+	deleteStrategy    string
+	dedupToken        bool
+	cluster           string
+	distributedSuffix string
+
+	mu      sync.Mutex
+	schemas map[string]chSchema // Column types per "db.table"
 }
 
 func NewClickHouseSink(cfg config.ClickHouseTarget) (*ClickHouseSink, error) {
@@ -21,107 +31,462 @@ func NewClickHouseSink(cfg config.ClickHouseTarget) (*ClickHouseSink, error) {
 	if err != nil {
 		return nil, err
 	}
-	
+
 	// Extract database name from auth.Database (e.g., "analytics")
 	dbName := opts.Auth.Database
 	if dbName == "" {
 		dbName = "default"
 	}
-	
+
+	opts.Addr = append(opts.Addr, cfg.Hosts...)
+	switch cfg.Compression {
+	case "none":
+		opts.Compression = &clickhouse.Compression{Method: clickhouse.CompressionNone}
+	case "lz4":
+		opts.Compression = &clickhouse.Compression{Method: clickhouse.CompressionLZ4}
+	case "zstd":
+		opts.Compression = &clickhouse.Compression{Method: clickhouse.CompressionZSTD}
+	}
+	if cfg.MaxOpenConns > 0 {
+		opts.MaxOpenConns = cfg.MaxOpenConns
+	}
+	if cfg.MaxIdleConns > 0 {
+		opts.MaxIdleConns = cfg.MaxIdleConns
+	}
+
+	if opts.Settings == nil {
+		opts.Settings = clickhouse.Settings{}
+	}
+	if cfg.AsyncInsert {
+		opts.Settings["async_insert"] = 1
+		// Without waiting, a batch would be acknowledged before ClickHouse
+		// has flushed it.
+		opts.Settings["wait_for_async_insert"] = 1
+		if cfg.WaitForAsyncInsert != nil && !*cfg.WaitForAsyncInsert {
+			opts.Settings["wait_for_async_insert"] = 0
+		}
+	}
+	if cfg.InsertQuorum > 0 {
+		opts.Settings["insert_quorum"] = cfg.InsertQuorum
+	}
+
 	conn, err := clickhouse.Open(opts)
 	if err != nil {
 		return nil, err
 	}
-	return &ClickHouseSink{conn: conn, db: dbName}, nil
+	strategy := cfg.DeleteStrategy
+	if strategy == "" {
+		strategy = config.DeleteLightweight
+	}
+	return &ClickHouseSink{
+		conn:              conn,
+		db:                dbName,
+		deleteStrategy:    strategy,
+		dedupToken:        cfg.DeduplicationToken,
+		cluster:           cfg.Cluster,
+		distributedSuffix: cfg.DistributedSuffix,
+		schemas:           make(map[string]chSchema),
+	}, nil
 }
 
 func (s *ClickHouseSink) Write(ctx context.Context, batch *types.Batch) error {
-	// Group events by table and type
+	// Group events by table, keeping their order
 	type tableKey struct {
 		schema string
 		table  string
 	}
-	eventsByTable := make(map[tableKey]map[types.EventType][]*types.Event)
+	var tables []tableKey
+	eventsByTable := make(map[tableKey][]*types.Event)
 
 	for _, e := range batch.Events {
 		key := tableKey{schema: e.Schema, table: e.Table}
-		if eventsByTable[key] == nil {
-			eventsByTable[key] = make(map[types.EventType][]*types.Event)
+		if _, ok := eventsByTable[key]; !ok {
+			tables = append(tables, key)
 		}
-		eventsByTable[key][e.Type] = append(eventsByTable[key][e.Type], e)
+		eventsByTable[key] = append(eventsByTable[key], e)
+	}
+
+	// Retries of the same batch carry the same token, so ClickHouse drops
+	// inserts it has already applied.
+	var token string
+	if s.dedupToken {
+		token = lsnRange(batch)
 	}
 
-	for key, typeMap := range eventsByTable {
+	for _, key := range tables {
 		// Use ClickHouse database instead of PostgreSQL schema
 		tableName := fmt.Sprintf("%s.%s", s.db, key.table)
+		events := eventsByTable[key]
 
-		// Handle DELETEs using lightweight DELETE
-		if deletes, ok := typeMap[types.EventDelete]; ok && len(deletes) > 0 {
-			for _, e := range deletes {
-				// Build WHERE clause from identity columns
-				whereParts := []string{}
-				for col := range e.Identity {
-					whereParts = append(whereParts, fmt.Sprintf("%s = ?", col))
-				}
-				if len(whereParts) == 0 {
-					continue // Skip if no identity
-				}
-
-				whereClause := strings.Join(whereParts, " AND ")
-				query := fmt.Sprintf("DELETE FROM %s WHERE %s", tableName, whereClause)
-
-				// Extract values in consistent order
-				vals := make([]interface{}, 0, len(e.Identity))
-				for _, part := range whereParts {
-					col := strings.Split(part, " ")[0]
-					vals = append(vals, e.Identity[col])
-				}
-
-				if err := s.conn.Exec(ctx, query, vals...); err != nil {
-					return fmt.Errorf("delete failed for %s: %w", tableName, err)
-				}
-			}
+		var err error
+		switch s.deleteStrategy {
+		case config.DeleteIsDeleted:
+			err = s.writeIsDeleted(ctx, tableName, token, events)
+		case config.DeleteCollapsing:
+			err = s.writeCollapsing(ctx, tableName, token, events)
+		default:
+			err = s.writeLightweight(ctx, tableName, token, events)
 		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		// Handle INSERTs and UPDATEs (both as inserts with LSN as version)
-		inserts := append(typeMap[types.EventInsert], typeMap[types.EventUpdate]...)
-		if len(inserts) > 0 {
-			// Collect all columns (including _version)
-			first := inserts[0]
-			cols := make([]string, 0, len(first.Columns)+1)
-			for k := range first.Columns {
-				cols = append(cols, k)
-			}
-			cols = append(cols, "_version") // Add version column
+// writeLightweight runs one lightweight DELETE per table, then inserts the
+// remaining rows with the LSN as _version.
+func (s *ClickHouseSink) writeLightweight(ctx context.Context, tableName, token string, events []*types.Event) error {
+	deletes, upserts := lightweightChanges(events)
+	for _, stmt := range deleteStatements(tableName+s.onCluster(), deletes) {
+		if err := s.conn.Exec(ctx, stmt.query, stmt.set); err != nil {
+			return fmt.Errorf("delete failed for %s: %w", tableName, err)
+		}
+	}
 
-			query := fmt.Sprintf("INSERT INTO %s (%s)", tableName, strings.Join(cols, ", "))
-			chBatch, err := s.conn.PrepareBatch(ctx, query)
-			if err != nil {
-				return fmt.Errorf("prepare batch failed for %s: %w", tableName, err)
-			}
+	if len(upserts) == 0 {
+		return nil
+	}
+	cols := upsertColumns(upserts)
+	rows := make([][]interface{}, 0, len(upserts))
+	for _, e := range upserts {
+		rows = append(rows, append(values(e.Columns, cols), uint64(e.LSN)))
+	}
+	return s.insert(ctx, tableName, dedupToken(token, tableName, "upsert"), append(cols, "_version"), rows)
+}
 
-			for _, e := range inserts {
-				vals := make([]interface{}, len(cols))
-				for i, col := range cols {
-					if col == "_version" {
-						vals[i] = uint64(e.LSN) // Use LSN as version for deduplication
-					} else {
-						vals[i] = e.Columns[col]
-					}
-				}
-				if err := chBatch.Append(vals...); err != nil {
-					return fmt.Errorf("append failed: %w", err)
-				}
-			}
+// lightweightChanges splits events into the deletes and the upserts to
+// write. The DELETE runs before the INSERT, so upserts that a later delete
+// of the same row in this batch supersedes are dropped.
+func lightweightChanges(events []*types.Event) (deletes, upserts []*types.Event) {
+	lastDelete := make(map[string]int)
+	for i, e := range events {
+		if e.Type == types.EventDelete && len(e.Identity) > 0 {
+			lastDelete[identityKey(e.Identity, sortedKeys(e.Identity))] = i
+			deletes = append(deletes, e)
+		}
+	}
+	for i, e := range events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate {
+			continue
+		}
+		if d, ok := lastDelete[identityKey(e.Identity, sortedKeys(e.Identity))]; ok && d > i {
+			continue
+		}
+		upserts = append(upserts, e)
+	}
+	return deletes, upserts
+}
+
+// chStatement is a query with one set parameter.
+type chStatement struct {
+	query string
+	set   []clickhouse.GroupSet
+}
+
+// deleteStatements builds one DELETE per identity column set, in column
+// set order. target is the table name, with its ON CLUSTER clause if any.
+func deleteStatements(target string, deletes []*types.Event) []chStatement {
+	sets := make(map[string][]clickhouse.GroupSet)
+	colsByGroup := make(map[string][]string)
+	for _, e := range deletes {
+		cols := sortedKeys(e.Identity)
+		group := strings.Join(cols, ",")
+		colsByGroup[group] = cols
+		sets[group] = append(sets[group], clickhouse.GroupSet{Value: values(e.Identity, cols)})
+	}
+	groups := make([]string, 0, len(sets))
+	for group := range sets {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	stmts := make([]chStatement, 0, len(groups))
+	for _, group := range groups {
+		stmts = append(stmts, chStatement{
+			query: fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (?)", target, strings.Join(colsByGroup[group], ", ")),
+			set:   sets[group],
+		})
+	}
+	return stmts
+}
 
-			if err := chBatch.Send(); err != nil {
-				return fmt.Errorf("batch send failed for %s: %w", tableName, err)
+// writeIsDeleted inserts every change as a row of a
+// ReplacingMergeTree(_version, _is_deleted) table. Deletes become tombstones
+// carrying only the identity columns.
+func (s *ClickHouseSink) writeIsDeleted(ctx context.Context, tableName, token string, events []*types.Event) error {
+	var upserts, deletes []*types.Event
+	for _, e := range events {
+		switch e.Type {
+		case types.EventInsert, types.EventUpdate:
+			upserts = append(upserts, e)
+		case types.EventDelete:
+			if len(e.Identity) > 0 {
+				deletes = append(deletes, e)
 			}
 		}
 	}
+
+	if len(upserts) > 0 {
+		cols := upsertColumns(upserts)
+		rows := make([][]interface{}, 0, len(upserts))
+		for _, e := range upserts {
+			rows = append(rows, append(values(e.Columns, cols), uint64(e.LSN), uint8(0)))
+		}
+		if err := s.insert(ctx, tableName, dedupToken(token, tableName, "upsert"), append(cols, "_version", "_is_deleted"), rows); err != nil {
+			return err
+		}
+	}
+
+	if len(deletes) > 0 {
+		cols := sortedKeys(deletes[0].Identity)
+		rows := make([][]interface{}, 0, len(deletes))
+		for _, e := range deletes {
+			rows = append(rows, append(values(e.Identity, cols), uint64(e.LSN), uint8(1)))
+		}
+		if err := s.insert(ctx, tableName, dedupToken(token, tableName, "delete"), append(cols, "_version", "_is_deleted"), rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collapsingState is the last row written for a key with _sign = 1.
+type collapsingState struct {
+	values  []interface{}
+	version uint64
+}
+
+// writeCollapsing writes _sign rows for a VersionedCollapsingMergeTree(_sign,
+// _version) table. Every update or delete cancels the live row of its key
+// with a _sign = -1 row of the same _version, so the table's ORDER BY must be
+// the identity columns.
+func (s *ClickHouseSink) writeCollapsing(ctx context.Context, tableName, token string, events []*types.Event) error {
+	var keyCols []string
+	for _, e := range events {
+		if len(e.Identity) > 0 {
+			keyCols = sortedKeys(e.Identity)
+			break
+		}
+	}
+	if keyCols == nil {
+		return nil
+	}
+
+	// Cancel rows must repeat the version of the row they cancel, which
+	// for rows written by earlier batches is only known to ClickHouse.
+	live, err := s.liveVersions(ctx, tableName, keyCols, events)
+	if err != nil {
+		return err
+	}
+
+	var upserts []*types.Event
+	for _, e := range events {
+		if e.Type == types.EventInsert || e.Type == types.EventUpdate {
+			upserts = append(upserts, e)
+		}
+	}
+	cols := upsertColumns(upserts)
+	rows, keyOnlyRows := collapsingRows(events, keyCols, cols, live)
+
+	if len(keyOnlyRows) > 0 {
+		if err := s.insert(ctx, tableName, dedupToken(token, tableName, "cancel"), append(append([]string{}, keyCols...), "_version", "_sign"), keyOnlyRows); err != nil {
+			return err
+		}
+	}
+	if len(rows) > 0 {
+		if err := s.insert(ctx, tableName, dedupToken(token, tableName, "rows"), append(cols, "_version", "_sign"), rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collapsingRows returns the _sign rows of events, with cols followed by
+// _version and _sign, and the cancel rows of live rows written by earlier
+// batches, with keyCols followed by _version and _sign. live is consumed.
+func collapsingRows(events []*types.Event, keyCols, cols []string, live map[string]uint64) (rows, keyOnlyRows [][]interface{}) {
+	state := make(map[string]collapsingState)
+	for _, e := range events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		key := identityKey(e.Identity, keyCols)
+		if prev, ok := state[key]; ok {
+			rows = append(rows, append(append([]interface{}{}, prev.values...), prev.version, int8(-1)))
+			delete(state, key)
+		} else if version, ok := live[key]; ok {
+			keyOnlyRows = append(keyOnlyRows, append(values(e.Identity, keyCols), version, int8(-1)))
+		}
+		delete(live, key)
+
+		if e.Type == types.EventDelete {
+			continue
+		}
+		vals := values(e.Columns, cols)
+		rows = append(rows, append(vals, uint64(e.LSN), int8(1)))
+		newKey := identityKey(e.Columns, keyCols)
+		state[newKey] = collapsingState{values: vals, version: uint64(e.LSN)}
+		delete(live, newKey)
+	}
+	return rows, keyOnlyRows
+}
+
+// liveVersions returns the _version of the uncancelled row of every key the
+// events touch, keyed by identityKey. It costs one SELECT per batch.
+func (s *ClickHouseSink) liveVersions(ctx context.Context, tableName string, keyCols []string, events []*types.Event) (map[string]uint64, error) {
+	live := make(map[string]uint64)
+	stmt, ok := liveVersionsStatement(tableName+s.distributedSuffix, keyCols, events)
+	if !ok {
+		return live, nil
+	}
+	rows, err := s.conn.Query(ctx, stmt.query, stmt.set)
+	if err != nil {
+		return nil, fmt.Errorf("version lookup failed for %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	colTypes := rows.ColumnTypes()
+	for rows.Next() {
+		dest := make([]interface{}, len(colTypes))
+		for i, ct := range colTypes {
+			dest[i] = reflect.New(ct.ScanType()).Interface()
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("version lookup scan failed for %s: %w", tableName, err)
+		}
+		key := make(map[string]interface{}, len(keyCols))
+		for i, col := range keyCols {
+			key[col] = reflect.ValueOf(dest[i]).Elem().Interface()
+		}
+		version, _ := reflect.ValueOf(dest[len(keyCols)]).Elem().Interface().(uint64)
+		live[identityKey(key, keyCols)] = version
+	}
+	return live, rows.Err()
+}
+
+// liveVersionsStatement builds the SELECT of liveVersions over the distinct
+// keys of events; ok is false if no event has an identity.
+func liveVersionsStatement(tableName string, keyCols []string, events []*types.Event) (stmt chStatement, ok bool) {
+	seen := make(map[string]bool)
+	for _, e := range events {
+		if len(e.Identity) == 0 {
+			continue
+		}
+		key := identityKey(e.Identity, keyCols)
+		if !seen[key] {
+			seen[key] = true
+			stmt.set = append(stmt.set, clickhouse.GroupSet{Value: values(e.Identity, keyCols)})
+		}
+	}
+	if len(stmt.set) == 0 {
+		return stmt, false
+	}
+	colList := strings.Join(keyCols, ", ")
+	stmt.query = fmt.Sprintf("SELECT %s, _version FROM %s WHERE (%s) IN (?) GROUP BY %s, _version HAVING sum(_sign) > 0",
+		colList, tableName, colList, colList)
+	return stmt, true
+}
+
+// insert writes rows into tableName, or into its Distributed table when a
+// suffix is configured. A non-empty token is sent as insert_deduplication_token.
+func (s *ClickHouseSink) insert(ctx context.Context, tableName, token string, cols []string, rows [][]interface{}) error {
+	tableName += s.distributedSuffix
+	if token != "" {
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+			"insert_deduplication_token": token,
+		}))
+	}
+	if err := s.convertRows(ctx, tableName, cols, rows); err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s)", tableName, strings.Join(cols, ", "))
+	chBatch, err := s.conn.PrepareBatch(ctx, query)
+	if err != nil {
+		s.forgetSchema(tableName)
+		return fmt.Errorf("prepare batch failed for %s: %w", tableName, err)
+	}
+	for _, row := range rows {
+		if err := chBatch.Append(row...); err != nil {
+			s.forgetSchema(tableName)
+			return fmt.Errorf("append failed for %s: %w", tableName, err)
+		}
+	}
+	if err := chBatch.Send(); err != nil {
+		s.forgetSchema(tableName)
+		return fmt.Errorf("batch send failed for %s: %w", tableName, err)
+	}
 	return nil
 }
 
 func (s *ClickHouseSink) Close() error {
 	return s.conn.Close()
 }
+
+func (s *ClickHouseSink) onCluster() string {
+	if s.cluster == "" {
+		return ""
+	}
+	return " ON CLUSTER " + s.cluster
+}
+
+// lsnRange renders the LSN range of a batch, e.g. "0/16B3748-0/16B3A10".
+func lsnRange(batch *types.Batch) string {
+	if len(batch.Events) == 0 {
+		return ""
+	}
+	first, last := batch.Events[0].LSN, batch.Events[0].LSN
+	for _, e := range batch.Events {
+		if e.LSN < first {
+			first = e.LSN
+		}
+		if e.LSN > last {
+			last = e.LSN
+		}
+	}
+	return fmt.Sprintf("%s-%s", first, last)
+}
+
+// dedupToken builds the insert_deduplication_token of one insert of a batch.
+func dedupToken(token, tableName, part string) string {
+	if token == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s/%s", token, tableName, part)
+}
+
+// upsertColumns returns the columns of the first event, which every row of
+// the INSERT is expected to share.
+func upsertColumns(events []*types.Event) []string {
+	if len(events) == 0 {
+		return nil
+	}
+	return sortedKeys(events[0].Columns)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func values(m map[string]interface{}, cols []string) []interface{} {
+	vals := make([]interface{}, len(cols))
+	for i, col := range cols {
+		vals[i] = m[col]
+	}
+	return vals
+}
+
+// identityKey renders the given columns of a row as a comparable key.
+func identityKey(m map[string]interface{}, cols []string) string {
+	var sb strings.Builder
+	for _, col := range cols {
+		fmt.Fprintf(&sb, "%s=%v\x00", col, m[col])
+	}
+	return sb.String()
+}
@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func TestLightweightChanges(t *testing.T) {
+	events := []*types.Event{
+		{Type: types.EventInsert, LSN: 10, Identity: map[string]interface{}{"id": 1}, Columns: map[string]interface{}{"id": 1, "v": "a"}},
+		{Type: types.EventUpdate, LSN: 11, Identity: map[string]interface{}{"id": 2}, Columns: map[string]interface{}{"id": 2, "v": "b"}},
+		{Type: types.EventDelete, LSN: 12, Identity: map[string]interface{}{"id": 1}},
+		{Type: types.EventInsert, LSN: 13, Identity: map[string]interface{}{"id": 1}, Columns: map[string]interface{}{"id": 1, "v": "c"}},
+		{Type: types.EventDelete, LSN: 14}, // No identity, nothing to delete
+	}
+
+	deletes, upserts := lightweightChanges(events)
+	if len(deletes) != 1 || deletes[0].LSN != 12 {
+		t.Errorf("Expected the delete at 12, got %v", lsns(deletes))
+	}
+	// The insert at 10 is superseded by the delete; the one at 13 is not
+	if got := lsns(upserts); !reflect.DeepEqual(got, []types.LSN{11, 13}) {
+		t.Errorf("Expected upserts at 11 and 13, got %v", got)
+	}
+}
+
+func TestDeleteStatements(t *testing.T) {
+	deletes := []*types.Event{
+		{Type: types.EventDelete, Identity: map[string]interface{}{"tenant": "acme", "id": 1}},
+		{Type: types.EventDelete, Identity: map[string]interface{}{"id": 2}},
+		{Type: types.EventDelete, Identity: map[string]interface{}{"id": 3, "tenant": "other"}},
+	}
+
+	got := deleteStatements("db.users ON CLUSTER main", deletes)
+	want := []chStatement{
+		{
+			query: "DELETE FROM db.users ON CLUSTER main WHERE (id) IN (?)",
+			set:   []clickhouse.GroupSet{{Value: []interface{}{2}}},
+		},
+		{
+			query: "DELETE FROM db.users ON CLUSTER main WHERE (id, tenant) IN (?)",
+			set:   []clickhouse.GroupSet{{Value: []interface{}{1, "acme"}}, {Value: []interface{}{3, "other"}}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestCollapsingRows(t *testing.T) {
+	id := func(n int) map[string]interface{} { return map[string]interface{}{"id": n} }
+	row := func(n int, v string) map[string]interface{} { return map[string]interface{}{"id": n, "v": v} }
+	events := []*types.Event{
+		// Updated twice: the first update cancels the row of an earlier
+		// batch, the second cancels the first
+		{Type: types.EventUpdate, LSN: 10, Identity: id(1), Columns: row(1, "b")},
+		{Type: types.EventUpdate, LSN: 20, Identity: id(1), Columns: row(1, "c")},
+		// Deleted: only the earlier batch's row is cancelled
+		{Type: types.EventDelete, LSN: 21, Identity: id(2)},
+		// Inserted, then deleted in the same batch
+		{Type: types.EventInsert, LSN: 22, Identity: id(3), Columns: row(3, "x")},
+		{Type: types.EventDelete, LSN: 23, Identity: id(3)},
+		// Key changed from 4 to 5
+		{Type: types.EventUpdate, LSN: 24, Identity: id(4), Columns: row(5, "y")},
+	}
+	live := map[string]uint64{
+		identityKey(id(1), []string{"id"}): 5,
+		identityKey(id(2), []string{"id"}): 7,
+		identityKey(id(4), []string{"id"}): 8,
+	}
+
+	rows, cancels := collapsingRows(events, []string{"id"}, []string{"id", "v"}, live)
+	wantRows := [][]interface{}{
+		{1, "b", uint64(10), int8(1)},
+		{1, "b", uint64(10), int8(-1)},
+		{1, "c", uint64(20), int8(1)},
+		{3, "x", uint64(22), int8(1)},
+		{3, "x", uint64(22), int8(-1)},
+		{5, "y", uint64(24), int8(1)},
+	}
+	wantCancels := [][]interface{}{
+		{1, uint64(5), int8(-1)},
+		{2, uint64(7), int8(-1)},
+		{4, uint64(8), int8(-1)},
+	}
+	if !reflect.DeepEqual(rows, wantRows) {
+		t.Errorf("Expected rows %v, got %v", wantRows, rows)
+	}
+	if !reflect.DeepEqual(cancels, wantCancels) {
+		t.Errorf("Expected cancel rows %v, got %v", wantCancels, cancels)
+	}
+	if len(live) != 0 {
+		t.Errorf("Expected every live version to be used, left %v", live)
+	}
+}
+
+func TestLiveVersionsStatement(t *testing.T) {
+	events := []*types.Event{
+		{Type: types.EventUpdate, Identity: map[string]interface{}{"tenant": "acme", "id": 1}},
+		{Type: types.EventDelete, Identity: map[string]interface{}{"tenant": "acme", "id": 1}},
+		{Type: types.EventInsert, Identity: map[string]interface{}{"tenant": "acme", "id": 2}},
+	}
+
+	stmt, ok := liveVersionsStatement("db.users_dist", []string{"id", "tenant"}, events)
+	if !ok {
+		t.Fatal("Expected a statement")
+	}
+	wantQuery := "SELECT id, tenant, _version FROM db.users_dist WHERE (id, tenant) IN (?) GROUP BY id, tenant, _version HAVING sum(_sign) > 0"
+	if stmt.query != wantQuery {
+		t.Errorf("Expected query %q, got %q", wantQuery, stmt.query)
+	}
+	wantSet := []clickhouse.GroupSet{{Value: []interface{}{1, "acme"}}, {Value: []interface{}{2, "acme"}}}
+	if !reflect.DeepEqual(stmt.set, wantSet) {
+		t.Errorf("Expected one key per row, got %v", stmt.set)
+	}
+
+	if _, ok := liveVersionsStatement("db.users", []string{"id"}, []*types.Event{{Type: types.EventInsert}}); ok {
+		t.Error("Expected no statement without identities")
+	}
+}
+
+func lsns(events []*types.Event) []types.LSN {
+	out := make([]types.LSN, len(events))
+	for i, e := range events {
+		out[i] = e.LSN
+	}
+	return out
+}
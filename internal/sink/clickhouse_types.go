@@ -0,0 +1,457 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// chSchema maps column names of a ClickHouse table to their types.
+type chSchema map[string]string
+
+var errNotNullable = errors.New("NULL value for a non-Nullable column")
+
+// tableSchema returns the cached column types of tableName ("db.table"),
+// reading them from system.columns on first use.
+func (s *ClickHouseSink) tableSchema(ctx context.Context, tableName string) (chSchema, error) {
+	s.mu.Lock()
+	schema, ok := s.schemas[tableName]
+	s.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	db, table, _ := strings.Cut(tableName, ".")
+	rows, err := s.conn.Query(ctx, "SELECT name, type FROM system.columns WHERE database = ? AND table = ?", db, table)
+	if err != nil {
+		return nil, fmt.Errorf("schema lookup failed for %s: %w", tableName, err)
+	}
+	defer rows.Close()
+
+	schema = make(chSchema)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, fmt.Errorf("schema lookup scan failed for %s: %w", tableName, err)
+		}
+		schema[name] = typ
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("schema lookup failed for %s: %w", tableName, err)
+	}
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("table %s does not exist in ClickHouse", tableName)
+	}
+
+	s.mu.Lock()
+	s.schemas[tableName] = schema
+	s.mu.Unlock()
+	return schema, nil
+}
+
+// forgetSchema drops a cached schema so that it is read again, e.g. after
+// an insert failed because the table was altered.
+func (s *ClickHouseSink) forgetSchema(tableName string) {
+	s.mu.Lock()
+	delete(s.schemas, tableName)
+	s.mu.Unlock()
+}
+
+// convertRows converts the values of rows in place to the types of cols.
+func (s *ClickHouseSink) convertRows(ctx context.Context, tableName string, cols []string, rows [][]interface{}) error {
+	schema, err := s.tableSchema(ctx, tableName)
+	if err != nil {
+		return err
+	}
+	colTypes := make([]string, len(cols))
+	for i, col := range cols {
+		typ, ok := schema[col]
+		if !ok {
+			return fmt.Errorf("column %q does not exist in ClickHouse table %s", col, tableName)
+		}
+		colTypes[i] = typ
+	}
+
+	for _, row := range rows {
+		for i := range row {
+			v, err := convertCH(colTypes[i], row[i])
+			if err != nil {
+				return fmt.Errorf("column %s.%s (%s): %w", tableName, cols[i], colTypes[i], err)
+			}
+			row[i] = v
+		}
+	}
+	return nil
+}
+
+// convertCH converts a decoded source value to the Go type the ClickHouse
+// driver expects for chType.
+func convertCH(chType string, v interface{}) (interface{}, error) {
+	typ, nullable := unwrapCHType(chType)
+	if v == nil {
+		if nullable {
+			return nil, nil
+		}
+		return nil, errNotNullable
+	}
+
+	name, args := typ, ""
+	if i := strings.IndexByte(typ, '('); i >= 0 && strings.HasSuffix(typ, ")") {
+		name, args = typ[:i], typ[i+1:len(typ)-1]
+	}
+
+	switch name {
+	case "Int8", "Int16", "Int32", "Int64":
+		bits, _ := strconv.Atoi(name[3:])
+		n, err := strconv.ParseInt(numberString(v), 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		switch bits {
+		case 8:
+			return int8(n), nil
+		case 16:
+			return int16(n), nil
+		case 32:
+			return int32(n), nil
+		}
+		return n, nil
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		bits, _ := strconv.Atoi(name[4:])
+		n, err := strconv.ParseUint(numberString(v), 10, bits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		switch bits {
+		case 8:
+			return uint8(n), nil
+		case 16:
+			return uint16(n), nil
+		case 32:
+			return uint32(n), nil
+		}
+		return n, nil
+	case "Int128", "Int256", "UInt128", "UInt256":
+		n, ok := new(big.Int).SetString(numberString(v), 10)
+		if !ok {
+			return nil, fmt.Errorf("cannot convert %v (%T) to an integer", v, v)
+		}
+		return n, nil
+	case "Float32", "Float64":
+		bits, _ := strconv.Atoi(name[5:])
+		f, err := strconv.ParseFloat(numberString(v), bits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		if bits == 32 {
+			return float32(f), nil
+		}
+		return f, nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		d, err := decimal.NewFromString(numberString(v))
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		return d, nil
+	case "Bool":
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case string:
+			b, err := strconv.ParseBool(x)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %q: %w", x, err)
+			}
+			return b, nil
+		}
+		n, err := strconv.ParseInt(numberString(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		return n != 0, nil
+	case "String", "FixedString":
+		return stringValue(v)
+	case "UUID":
+		switch x := v.(type) {
+		case uuid.UUID:
+			return x, nil
+		case [16]byte:
+			return uuid.UUID(x), nil
+		}
+		u, err := uuid.Parse(fmt.Sprint(stringOrBytes(v)))
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		return u, nil
+	case "Date", "Date32", "DateTime", "DateTime64":
+		return timeValue(v, chTimezone(args))
+	case "JSON", "Object":
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case []byte:
+			return string(x), nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode %T as JSON: %w", v, err)
+		}
+		return string(data), nil
+	case "Array":
+		elems, err := arrayElements(v)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]interface{}, len(elems))
+		for i, e := range elems {
+			if out[i], err = convertCH(args, e); err != nil {
+				return nil, fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+		return out, nil
+	default:
+		// Enums, Maps, Tuples and the rest are handed to the driver as is
+		return v, nil
+	}
+}
+
+// unwrapCHType strips LowCardinality and Nullable wrappers from a type.
+func unwrapCHType(typ string) (string, bool) {
+	nullable := false
+	for {
+		switch {
+		case strings.HasPrefix(typ, "LowCardinality(") && strings.HasSuffix(typ, ")"):
+			typ = typ[len("LowCardinality(") : len(typ)-1]
+		case strings.HasPrefix(typ, "Nullable(") && strings.HasSuffix(typ, ")"):
+			typ = typ[len("Nullable(") : len(typ)-1]
+			nullable = true
+		default:
+			return typ, nullable
+		}
+	}
+}
+
+// chTimezone returns the location named in DateTime('tz') or
+// DateTime64(p, 'tz') arguments, or UTC.
+func chTimezone(args string) *time.Location {
+	start := strings.IndexByte(args, '\'')
+	end := strings.LastIndexByte(args, '\'')
+	if start < 0 || end <= start {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(args[start+1 : end])
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07",
+}
+
+// Layouts without an offset are interpreted in the column's timezone
+var localTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+func timeValue(v interface{}, loc *time.Location) (interface{}, error) {
+	switch x := v.(type) {
+	case time.Time:
+		return x.In(loc), nil
+	case int64:
+		return time.Unix(x, 0).In(loc), nil
+	}
+	s := fmt.Sprint(stringOrBytes(v))
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.In(loc), nil
+		}
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot convert %v (%T) to a time", v, v)
+}
+
+func stringValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case []byte:
+		return string(x), nil
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	}
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Struct:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode %T as string: %w", v, err)
+		}
+		return string(data), nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+func stringOrBytes(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// numberString renders a numeric source value in a form strconv and
+// decimal can parse.
+func numberString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return strings.TrimSpace(x)
+	case []byte:
+		return strings.TrimSpace(string(x))
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	case float32:
+		return strconv.FormatFloat(float64(x), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// arrayElements returns the elements of a slice or of a Postgres array
+// literal such as {1,2,"a b",NULL}.
+func arrayElements(v interface{}) ([]interface{}, error) {
+	switch x := v.(type) {
+	case []interface{}:
+		return x, nil
+	case string:
+		return parsePGArray(x)
+	case []byte:
+		return parsePGArray(string(x))
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("cannot convert %v (%T) to an array", v, v)
+	}
+	elems := make([]interface{}, rv.Len())
+	for i := range elems {
+		elems[i] = rv.Index(i).Interface()
+	}
+	return elems, nil
+}
+
+// parsePGArray parses the Postgres text representation of an array.
+// Nested arrays become nested []interface{} and unquoted NULL becomes nil.
+func parsePGArray(s string) ([]interface{}, error) {
+	p := &pgArrayParser{s: s}
+	arr, err := p.parseArray()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("invalid array literal %q: trailing data", s)
+	}
+	return arr, nil
+}
+
+type pgArrayParser struct {
+	s   string
+	pos int
+}
+
+func (p *pgArrayParser) parseArray() ([]interface{}, error) {
+	if p.pos >= len(p.s) || p.s[p.pos] != '{' {
+		return nil, fmt.Errorf("invalid array literal %q: expected '{'", p.s)
+	}
+	p.pos++
+	elems := []interface{}{}
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+		return elems, nil
+	}
+	for {
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("invalid array literal %q: unterminated", p.s)
+		}
+		var elem interface{}
+		var err error
+		switch p.s[p.pos] {
+		case '{':
+			elem, err = p.parseArray()
+		case '"':
+			elem, err = p.parseQuoted()
+		default:
+			elem = p.parseUnquoted()
+		}
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("invalid array literal %q: unterminated", p.s)
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return elems, nil
+		default:
+			return nil, fmt.Errorf("invalid array literal %q: unexpected %q", p.s, p.s[p.pos])
+		}
+	}
+}
+
+func (p *pgArrayParser) parseQuoted() (interface{}, error) {
+	p.pos++ // opening quote
+	var sb strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		switch c {
+		case '\\':
+			p.pos++
+			if p.pos < len(p.s) {
+				sb.WriteByte(p.s[p.pos])
+			}
+		case '"':
+			p.pos++
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+		p.pos++
+	}
+	return nil, fmt.Errorf("invalid array literal %q: unterminated string", p.s)
+}
+
+func (p *pgArrayParser) parseUnquoted() interface{} {
+	start := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ',' && p.s[p.pos] != '}' {
+		p.pos++
+	}
+	elem := strings.TrimSpace(p.s[start:p.pos])
+	if strings.EqualFold(elem, "NULL") {
+		return nil
+	}
+	return elem
+}
@@ -0,0 +1,97 @@
+package sink
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestConvertCH(t *testing.T) {
+	moscow, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+
+	tests := []struct {
+		name   string
+		chType string
+		in     interface{}
+		want   interface{}
+	}{
+		{"int32 from int64", "Int32", int64(42), int32(42)},
+		{"uint8 from string", "UInt8", "7", uint8(7)},
+		{"float32 from string", "Float32", "1.5", float32(1.5)},
+		{"decimal from string", "Decimal(10, 2)", "12.34", decimal.RequireFromString("12.34")},
+		{"uuid from string", "UUID", "6ba7b810-9dad-11d1-80b4-00c04fd430c8", uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")},
+		{"bool from pg text", "Bool", "t", true},
+		{"string from bytes", "String", []byte("abc"), "abc"},
+		{"nullable nil", "Nullable(Int64)", nil, nil},
+		{"low cardinality nullable", "LowCardinality(Nullable(String))", "x", "x"},
+		{"json from map", "JSON", map[string]interface{}{"a": 1}, `{"a":1}`},
+		{"array from pg literal", "Array(Int32)", "{1,2,3}", []interface{}{int32(1), int32(2), int32(3)}},
+		{"array with nulls", "Array(Nullable(String))", `{"a b",NULL}`, []interface{}{"a b", nil}},
+		{
+			"datetime64 without offset uses column timezone",
+			"DateTime64(3, 'Europe/Moscow')",
+			"2024-01-02 03:04:05.678",
+			time.Date(2024, 1, 2, 3, 4, 5, 678000000, moscow),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertCH(tt.chType, tt.in)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if want, ok := tt.want.(decimal.Decimal); ok {
+				if d, ok := got.(decimal.Decimal); !ok || !d.Equal(want) {
+					t.Errorf("Expected %v, got %v (%T)", want, got, got)
+				}
+				return
+			}
+			if want, ok := tt.want.(time.Time); ok {
+				if ts, ok := got.(time.Time); !ok || !ts.Equal(want) {
+					t.Errorf("Expected %v, got %v (%T)", want, got, got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConvertCHErrors(t *testing.T) {
+	if _, err := convertCH("Int64", nil); !errors.Is(err, errNotNullable) {
+		t.Errorf("Expected errNotNullable, got %v", err)
+	}
+	if _, err := convertCH("Int8", int64(300)); err == nil {
+		t.Error("Expected out of range error")
+	}
+	if _, err := convertCH("UUID", "not-a-uuid"); err == nil {
+		t.Error("Expected invalid UUID error")
+	}
+	if _, err := convertCH("Array(Int32)", "{1,2"); err == nil {
+		t.Error("Expected invalid array error")
+	}
+}
+
+func TestParsePGArray(t *testing.T) {
+	got, err := parsePGArray(`{{1,2},{"x\"y",NULL}}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := []interface{}{
+		[]interface{}{"1", "2"},
+		[]interface{}{`x"y`, nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %#v, got %#v", want, got)
+	}
+}
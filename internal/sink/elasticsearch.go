@@ -0,0 +1,275 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/keytemplate"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// ElasticsearchSink keeps one document per row in Elasticsearch or
+// OpenSearch. Inserts and updates become bulk index operations and deletes
+// delete operations, all with the LSN as external version, so a replayed
+// older change is rejected instead of overwriting a newer one.
+type ElasticsearchSink struct {
+	urls      []string
+	next      atomic.Uint32 // Round-robin position in urls
+	username  string
+	password  string
+	apiKey    string
+	indexTmpl *template.Template
+	tables    map[string]*template.Template // Per-table index templates
+	client    *http.Client
+	byteCount
+}
+
+func NewElasticsearchSink(cfg config.ElasticsearchTarget) (*ElasticsearchSink, error) {
+	indexTmpl, err := keytemplate.Parse("index", cfg.IndexPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index pattern: %w", err)
+	}
+	tables := make(map[string]*template.Template, len(cfg.Tables))
+	for table, tc := range cfg.Tables {
+		if tc.IndexPattern == "" {
+			continue
+		}
+		t, err := keytemplate.Parse("index", tc.IndexPattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index pattern for table %s: %w", table, err)
+		}
+		tables[table] = t
+	}
+	urls := make([]string, len(cfg.URLs))
+	for i, u := range cfg.URLs {
+		urls[i] = strings.TrimSuffix(u, "/")
+	}
+	return &ElasticsearchSink{
+		urls:      urls,
+		username:  cfg.Username,
+		password:  cfg.Password,
+		apiKey:    cfg.APIKey,
+		indexTmpl: indexTmpl,
+		tables:    tables,
+		client:    &http.Client{Timeout: cfg.Timeout},
+	}, nil
+}
+
+// esAction is the action line of a bulk operation.
+type esAction struct {
+	Index       string `json:"_index"`
+	ID          string `json:"_id"`
+	Version     uint64 `json:"version"`
+	VersionType string `json:"version_type"`
+}
+
+// esBulkResponse is the part of the bulk response the sink checks.
+type esBulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]esBulkItemResult `json:"items"`
+}
+
+type esBulkItemResult struct {
+	Index  string `json:"_index"`
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func (s *ElasticsearchSink) Write(ctx context.Context, batch *types.Batch) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	ops := 0
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		if len(e.Identity) == 0 {
+			continue // Cannot address a document without identity
+		}
+		index, err := s.index(e)
+		if err != nil {
+			return Permanent(err)
+		}
+		action := esAction{Index: index, ID: documentID(e.Identity), Version: uint64(e.LSN), VersionType: "external"}
+
+		if e.Type == types.EventDelete {
+			err = enc.Encode(map[string]esAction{"delete": action})
+		} else {
+			// An update that changed the key moves the document
+			if e.Type == types.EventUpdate && keyChanged(e) {
+				if err = enc.Encode(map[string]esAction{"delete": action}); err != nil {
+					return Permanent(fmt.Errorf("failed to encode %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err))
+				}
+				ops++
+			}
+			action.ID = documentID(newIdentity(e))
+			if err = enc.Encode(map[string]esAction{"index": action}); err == nil {
+				err = enc.Encode(e.Columns)
+			}
+		}
+		if err != nil {
+			return Permanent(fmt.Errorf("failed to encode %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err))
+		}
+		ops++
+	}
+	if ops == 0 {
+		return nil
+	}
+
+	resp, err := s.bulk(ctx, body.Bytes())
+	if err != nil {
+		return err
+	}
+	return checkBulkResponse(resp)
+}
+
+// index renders the index name of a change. Index names must be lower case.
+func (s *ElasticsearchSink) index(e *types.Event) (string, error) {
+	t := s.tables[e.Table]
+	if t == nil {
+		t = s.indexTmpl
+	}
+	row := e.Columns
+	if e.Type == types.EventDelete {
+		row = e.Identity
+	}
+	data := make(map[string]interface{}, len(row)+2)
+	for k, v := range row {
+		data[k] = v
+	}
+	data["table"] = e.Table
+	data["schema"] = e.Schema
+
+	index, err := keytemplate.Execute(t, data)
+	if err != nil {
+		return "", fmt.Errorf("cannot build index name for %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+	}
+	return strings.ToLower(index), nil
+}
+
+// documentID renders the identity values in column order, joined by ":".
+func documentID(identity map[string]interface{}) string {
+	cols := sortedKeys(identity)
+	parts := make([]string, len(cols))
+	for i, col := range cols {
+		parts[i] = fmt.Sprint(stringOrBytes(identity[col]))
+	}
+	return strings.Join(parts, ":")
+}
+
+// newIdentity returns the identity columns of an event's new row.
+func newIdentity(e *types.Event) map[string]interface{} {
+	identity := make(map[string]interface{}, len(e.Identity))
+	for col, v := range e.Identity {
+		if nv, ok := e.Columns[col]; ok {
+			v = nv
+		}
+		identity[col] = v
+	}
+	return identity
+}
+
+// bulk posts body to the _bulk endpoint, trying the next URL if a node is
+// unreachable.
+func (s *ElasticsearchSink) bulk(ctx context.Context, body []byte) (*esBulkResponse, error) {
+	var lastErr error
+	for range s.urls {
+		base := s.urls[int(s.next.Add(1)-1)%len(s.urls)]
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/_bulk", bytes.NewReader(body))
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("failed to create bulk request: %w", err))
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		switch {
+		case s.apiKey != "":
+			req.Header.Set("Authorization", "ApiKey "+s.apiKey)
+		case s.username != "":
+			req.SetBasicAuth(s.username, s.password)
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("bulk request to %s failed: %w", base, err)
+			continue
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			err := fmt.Errorf("bulk request to %s returned %s: %s", base, resp.Status, bytes.TrimSpace(msg))
+			switch {
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+					return nil, RetryAfter(err, delay)
+				}
+				return nil, err
+			default:
+				return nil, Permanent(err)
+			}
+		}
+
+		s.addBytes(len(body))
+		var result esBulkResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, fmt.Errorf("invalid bulk response from %s: %w", base, err)
+		}
+		return &result, nil
+	}
+	return nil, lastErr
+}
+
+// checkBulkResponse fails the batch if an operation failed. Version
+// conflicts mean the document already holds a newer change and deleting a
+// missing document is a no-op, so neither counts as a failure. Rejections
+// for load (429) and server errors are retried; other failures, such as
+// mapping errors, are not.
+func checkBulkResponse(resp *esBulkResponse) error {
+	if !resp.Errors {
+		return nil
+	}
+	var retryable, permanent []error
+	for _, item := range resp.Items {
+		for op, r := range item {
+			if r.Status < 300 || r.Status == http.StatusConflict || (op == "delete" && r.Status == http.StatusNotFound) {
+				continue
+			}
+			reason := http.StatusText(r.Status)
+			if r.Error != nil {
+				reason = r.Error.Type + ": " + r.Error.Reason
+			}
+			err := fmt.Errorf("%s of %s/%s failed with %d: %s", op, r.Index, r.ID, r.Status, reason)
+			if r.Status == http.StatusTooManyRequests || r.Status >= 500 {
+				retryable = append(retryable, err)
+			} else {
+				permanent = append(permanent, err)
+			}
+		}
+	}
+	// Retrying is safe: applied operations are rejected as version conflicts
+	if len(permanent) > 0 {
+		return Permanent(errors.Join(append(permanent, retryable...)...))
+	}
+	return errors.Join(retryable...)
+}
+
+func (s *ElasticsearchSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,183 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+type esDoc struct {
+	version uint64
+	source  map[string]interface{} // nil for a delete tombstone
+}
+
+// fakeBulkAPI implements the _bulk endpoint with external versioning.
+// Like Elasticsearch, it remembers the version of deleted documents.
+type fakeBulkAPI struct {
+	mu     sync.Mutex
+	docs   map[string]esDoc // Keyed by "<index>/<id>"
+	reject map[string]int   // Item status to return for an index
+}
+
+func (f *fakeBulkAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := esBulkResponse{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var line map[string]esAction
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for op, a := range line {
+			var source map[string]interface{}
+			if op == "index" {
+				scanner.Scan()
+				if err := json.Unmarshal(scanner.Bytes(), &source); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			key := a.Index + "/" + a.ID
+			result := esBulkItemResult{Index: a.Index, ID: a.ID, Status: http.StatusOK}
+			cur, exists := f.docs[key]
+			switch {
+			case f.reject[a.Index] != 0:
+				result.Status = f.reject[a.Index]
+			case exists && cur.version >= a.Version:
+				result.Status = http.StatusConflict
+			case op == "delete":
+				if !exists || cur.source == nil {
+					result.Status = http.StatusNotFound
+				}
+				f.docs[key] = esDoc{version: a.Version}
+			default:
+				f.docs[key] = esDoc{version: a.Version, source: source}
+			}
+			if result.Status >= 300 {
+				resp.Errors = true
+			}
+			resp.Items = append(resp.Items, map[string]esBulkItemResult{op: result})
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func newTestElasticsearchSink(t *testing.T, cfg config.ElasticsearchTarget) (*ElasticsearchSink, *fakeBulkAPI) {
+	t.Helper()
+	api := &fakeBulkAPI{docs: make(map[string]esDoc), reject: make(map[string]int)}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	cfg.URLs = []string{srv.URL}
+	if cfg.IndexPattern == "" {
+		cfg.IndexPattern = "{{.schema}}.{{.table}}"
+	}
+	s, err := NewElasticsearchSink(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create elasticsearch sink: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, api
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	s, api := newTestElasticsearchSink(t, config.ElasticsearchTarget{
+		Tables: map[string]config.ElasticsearchTableConfig{
+			"Orders": {IndexPattern: "orders-{{.region}}"},
+		},
+	})
+	ctx := context.Background()
+
+	events := []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "a"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 10},
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(2), "name": "b"}, Identity: map[string]interface{}{"id": int64(2)}, LSN: 11},
+		{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "c"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 12},
+		{Type: types.EventDelete, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": int64(2)}, LSN: 13},
+		// The key changed from 3 to 4
+		{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(4), "name": "d"}, Identity: map[string]interface{}{"id": int64(3)}, LSN: 14},
+		{Type: types.EventInsert, Schema: "public", Table: "Orders", Columns: map[string]interface{}{"id": int64(7), "region": "EU"}, Identity: map[string]interface{}{"id": int64(7)}, LSN: 15},
+	}
+	if err := s.Write(ctx, &types.Batch{Events: events}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Replaying the batch is rejected by the external versions
+	if err := s.Write(ctx, &types.Batch{Events: events[:2]}); err != nil {
+		t.Fatalf("Replayed write failed: %v", err)
+	}
+
+	live := 0
+	for _, doc := range api.docs {
+		if doc.source != nil {
+			live++
+		}
+	}
+	if live != 3 {
+		t.Errorf("Expected 3 documents, got %v", api.docs)
+	}
+	if doc := api.docs["public.users/1"]; doc.version != 12 || doc.source["name"] != "c" {
+		t.Errorf("Expected users/1 at version 12 with name c, got %+v", doc)
+	}
+	if api.docs["public.users/2"].source != nil {
+		t.Error("Expected users/2 to be deleted")
+	}
+	if doc, ok := api.docs["public.users/4"]; !ok || doc.source["name"] != "d" {
+		t.Errorf("Expected the moved row under users/4, got %v", api.docs)
+	}
+	if _, ok := api.docs["orders-eu/7"]; !ok {
+		t.Errorf("Expected the per-table index orders-eu, got %v", api.docs)
+	}
+}
+
+func TestElasticsearchSinkItemErrors(t *testing.T) {
+	event := &types.Event{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1)}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 10}
+
+	tests := []struct {
+		status    int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			s, api := newTestElasticsearchSink(t, config.ElasticsearchTarget{})
+			api.reject["public.users"] = tt.status
+
+			err := s.Write(context.Background(), &types.Batch{Events: []*types.Event{event}})
+			if err == nil {
+				t.Fatal("Expected error")
+			}
+			var perm *permanentError
+			if got := errors.As(err, &perm); got != tt.permanent {
+				t.Errorf("Expected permanent=%v, got error %v", tt.permanent, err)
+			}
+		})
+	}
+}
+
+func TestDocumentID(t *testing.T) {
+	id := documentID(map[string]interface{}{"tenant": "acme", "id": int64(5)})
+	if id != "5:acme" {
+		t.Errorf("Expected 5:acme, got %s", id)
+	}
+	if strings.Contains(documentID(map[string]interface{}{"id": []byte("x")}), "[") {
+		t.Error("Expected bytes to be rendered as a string")
+	}
+}
@@ -0,0 +1,19 @@
+package sink
+
+import (
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/debezium"
+)
+
+// newEnvelopeEncoder returns the Debezium encoder of a message sink, or nil
+// for the native layout.
+func newEnvelopeEncoder(cfg config.EnvelopeConfig) *debezium.Encoder {
+	if cfg.Type != config.EnvelopeDebezium {
+		return nil
+	}
+	return debezium.NewEncoder(debezium.Options{
+		Name:     cfg.Name,
+		Database: cfg.Database,
+		Schema:   cfg.Schema,
+	})
+}
@@ -0,0 +1,280 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nikolay-makurin/replicator/internal/changelog"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/debezium"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// FileSink appends the change stream to local files: one JSON line per
+// event, or one CSV file per table. Files are rotated by size and age and,
+// with fsync, synced to disk before Write returns.
+type FileSink struct {
+	dir         string
+	format      string
+	compression string
+	maxSize     int64
+	maxAge      time.Duration
+	fsync       bool
+	envelope    *debezium.Encoder // nil writes replayable changelog lines
+
+	mu    sync.Mutex
+	files map[string]*changeFile // Keyed by "<schema>.<table>" for CSV, "" for JSONL
+	seq   int
+
+	byteCount // Before compression
+}
+
+// changeFile is an open output file and its encoder chain.
+type changeFile struct {
+	path   string
+	f      *os.File
+	comp   io.WriteCloser // nil without compression
+	buf    *bufio.Writer
+	csv    *csv.Writer
+	header []string
+	size   int64 // Uncompressed bytes written
+	opened time.Time
+	closed bool
+}
+
+func NewFileSink(cfg config.FileTarget) (*FileSink, error) {
+	if err := os.MkdirAll(cfg.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", cfg.Path, err)
+	}
+	format := cfg.Format
+	if format == "" {
+		format = config.FileFormatJSONL
+	}
+	fsync := cfg.Fsync == nil || *cfg.Fsync
+	return &FileSink{
+		dir:         cfg.Path,
+		format:      format,
+		compression: cfg.Compression,
+		maxSize:     cfg.MaxSize,
+		maxAge:      cfg.MaxAge,
+		fsync:       fsync,
+		envelope:    newEnvelopeEncoder(cfg.Envelope),
+		files:       make(map[string]*changeFile),
+	}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, batch *types.Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	touched := make(map[*changeFile]bool)
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		var err error
+		var f *changeFile
+		if s.format == config.FileFormatCSV {
+			f, err = s.writeCSV(e)
+		} else {
+			f, err = s.writeJSON(e)
+		}
+		if err != nil {
+			return err
+		}
+		touched[f] = true
+	}
+
+	for f := range touched {
+		if f.closed {
+			continue // Rotated during the batch, already synced
+		}
+		if err := f.flush(s.fsync); err != nil {
+			return fmt.Errorf("failed to flush %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) writeJSON(e *types.Event) (*changeFile, error) {
+	var line []byte
+	var err error
+	if s.envelope != nil {
+		line, err = s.envelope.Encode(e)
+	} else {
+		line, err = changelog.MarshalJSON(e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	f, err := s.file("", nil)
+	if err != nil {
+		return nil, err
+	}
+	n, err := f.buf.Write(append(line, '\n'))
+	f.size += int64(n)
+	s.addBytes(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", f.path, err)
+	}
+	return f, nil
+}
+
+func (s *FileSink) writeCSV(e *types.Event) (*changeFile, error) {
+	key := e.Schema + "." + e.Table
+	f, err := s.file(key, e)
+	if err != nil {
+		return nil, err
+	}
+	rec, ok := changelog.CSVRecord(f.header, e)
+	if !ok {
+		// The table gained a column: start a file with a new header
+		if err := s.rotate(key); err != nil {
+			return nil, err
+		}
+		if f, err = s.file(key, e); err != nil {
+			return nil, err
+		}
+		rec, _ = changelog.CSVRecord(f.header, e)
+	}
+	if err := f.csv.Write(rec); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", f.path, err)
+	}
+	for _, v := range rec {
+		f.size += int64(len(v)) + 1
+		s.addBytes(len(v) + 1)
+	}
+	return f, nil
+}
+
+// file returns the open file for key, rotating it first if it is too large
+// or too old. e supplies the header of a new CSV file.
+func (s *FileSink) file(key string, e *types.Event) (*changeFile, error) {
+	if f, ok := s.files[key]; ok {
+		if (s.maxSize <= 0 || f.size < s.maxSize) && (s.maxAge <= 0 || time.Since(f.opened) < s.maxAge) {
+			return f, nil
+		}
+		if err := s.rotate(key); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := s.dir
+	if key != "" {
+		dir = filepath.Join(s.dir, key)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+		}
+	}
+	// Names sort in write order
+	s.seq++
+	name := fmt.Sprintf("changes-%s-%04d%s", time.Now().UTC().Format("20060102T150405.000000000"), s.seq,
+		changelog.Extension(s.format, s.compression))
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", path, err)
+	}
+
+	f := &changeFile{path: path, f: file, opened: time.Now()}
+	var out io.Writer = file
+	switch s.compression {
+	case "gzip":
+		f.comp = gzip.NewWriter(file)
+		out = f.comp
+	case "zstd":
+		zw, err := zstd.NewWriter(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		f.comp = zw
+		out = zw
+	}
+	f.buf = bufio.NewWriterSize(out, 64*1024)
+	if s.format == config.FileFormatCSV {
+		f.csv = csv.NewWriter(f.buf)
+		f.header = changelog.CSVHeader(e)
+		if err := f.csv.Write(f.header); err != nil {
+			f.close()
+			return nil, fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	s.files[key] = f
+	slog.Info("Opened change file", "path", path)
+	return f, nil
+}
+
+func (s *FileSink) rotate(key string) error {
+	f := s.files[key]
+	delete(s.files, key)
+	if err := f.close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// flush pushes buffered data through the compressor to the file and, with
+// sync, to disk. A compressed file stays readable up to its last flush.
+func (f *changeFile) flush(sync bool) error {
+	if f.csv != nil {
+		f.csv.Flush()
+		if err := f.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if flusher, ok := f.comp.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	if sync {
+		return f.f.Sync()
+	}
+	return nil
+}
+
+func (f *changeFile) close() error {
+	f.closed = true
+	err := f.flush(false)
+	if f.comp != nil {
+		if cerr := f.comp.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if serr := f.f.Sync(); serr != nil && err == nil {
+		err = serr
+	}
+	if cerr := f.f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for key := range s.files {
+		if err := s.rotate(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("close failed: %v", errs)
+	}
+	return nil
+}
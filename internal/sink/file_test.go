@@ -0,0 +1,135 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/changelog"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// readChanges reads back every change file matching pattern, in name order.
+func readChanges(t *testing.T, pattern string) []*types.Event {
+	t.Helper()
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []*types.Event
+	for _, p := range paths {
+		r, err := changelog.Open(p)
+		if err != nil {
+			t.Fatalf("Open %s failed: %v", p, err)
+		}
+		for {
+			e, err := r.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read %s failed: %v", p, err)
+			}
+			events = append(events, e)
+		}
+		r.Close()
+	}
+	return events
+}
+
+func TestFileSinkJSONL(t *testing.T) {
+	ts := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	events := []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "score": 1.5, "name": "a"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 0x100, Timestamp: ts},
+		{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "score": 2.5, "name": nil}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 0x200, Timestamp: ts},
+		{Type: types.EventDelete, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 0x300, Timestamp: ts},
+	}
+
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := NewFileSink(config.FileTarget{Path: dir, Compression: compression, MaxSize: 150})
+			if err != nil {
+				t.Fatalf("Failed to create file sink: %v", err)
+			}
+			for _, e := range events {
+				if err := s.Write(context.Background(), &types.Batch{Events: []*types.Event{e}}); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+			}
+
+			// Synced data is readable before the files are closed
+			got := readChanges(t, filepath.Join(dir, "changes-*"))
+			if len(got) != len(events) {
+				t.Fatalf("Expected %d events before close, got %d", len(events), len(got))
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			if paths, _ := filepath.Glob(filepath.Join(dir, "changes-*")); len(paths) < 2 {
+				t.Errorf("Expected files to rotate at max_size, got %v", paths)
+			}
+			got = readChanges(t, filepath.Join(dir, "changes-*"))
+			if len(got) != len(events) {
+				t.Fatalf("Expected %d events, got %d", len(events), len(got))
+			}
+			if got[0].Columns["id"] != int64(1) || got[0].Columns["score"] != 1.5 || !got[0].Timestamp.Equal(ts) {
+				t.Errorf("Unexpected first event: %+v", got[0])
+			}
+			if got[1].LSN != 0x200 || got[1].Columns["name"] != nil {
+				t.Errorf("Unexpected second event: %+v", got[1])
+			}
+			if got[2].Type != types.EventDelete || got[2].Identity["id"] != int64(1) || got[2].Columns != nil {
+				t.Errorf("Unexpected delete event: %+v", got[2])
+			}
+		})
+	}
+}
+
+func TestFileSinkCSV(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileSink(config.FileTarget{Path: dir, Format: config.FileFormatCSV, Compression: "gzip"})
+	if err != nil {
+		t.Fatalf("Failed to create file sink: %v", err)
+	}
+
+	err = s.Write(context.Background(), &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "a,b"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 1},
+		{Type: types.EventInsert, Schema: "public", Table: "orders", Columns: map[string]interface{}{"id": int64(7)}, Identity: map[string]interface{}{"id": int64(7)}, LSN: 2},
+		// A new column starts a new users file
+		{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": nil, "email": "x@y"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 3},
+		{Type: types.EventDelete, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 4},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "public.users", "*.csv.gz"))
+	if len(paths) != 2 {
+		t.Fatalf("Expected 2 users files, got %v", paths)
+	}
+	users := readChanges(t, filepath.Join(dir, "public.users", "*.csv.gz"))
+	if len(users) != 3 {
+		t.Fatalf("Expected 3 users events, got %d", len(users))
+	}
+	if users[0].Schema != "public" || users[0].Table != "users" || users[0].Columns["name"] != "a,b" {
+		t.Errorf("Unexpected first users event: %+v", users[0])
+	}
+	if users[1].Columns["email"] != "x@y" || users[1].Columns["name"] != nil {
+		t.Errorf("Unexpected update: %+v", users[1])
+	}
+	if users[2].Type != types.EventDelete || users[2].Identity["id"] != "1" || users[2].LSN != 4 {
+		t.Errorf("Unexpected delete: %+v", users[2])
+	}
+	if orders := readChanges(t, filepath.Join(dir, "public.orders", "*.csv.gz")); len(orders) != 1 {
+		t.Errorf("Expected 1 orders event, got %d", len(orders))
+	}
+}
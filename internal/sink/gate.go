@@ -0,0 +1,30 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/nikolay-makurin/replicator/internal/admin"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// GatedSink holds writes to the sink it wraps while its gate is paused.
+// The batch, and with it the pipeline, waits until the gate is resumed.
+type GatedSink struct {
+	next Sink
+	gate *admin.Gate
+}
+
+func NewGatedSink(next Sink, gate *admin.Gate) *GatedSink {
+	return &GatedSink{next: next, gate: gate}
+}
+
+func (g *GatedSink) Write(ctx context.Context, batch *types.Batch) error {
+	if err := g.gate.Wait(ctx); err != nil {
+		return err
+	}
+	return g.next.Write(ctx, batch)
+}
+
+func (g *GatedSink) Close() error {
+	return g.next.Close()
+}
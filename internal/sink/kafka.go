@@ -0,0 +1,183 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"text/template"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/keytemplate"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaSink produces one record per change to a topic derived from the
+// schema and table. Records are keyed by the replica identity so that all
+// changes of a row land in one partition, in order.
+type KafkaSink struct {
+	client    *kgo.Client
+	topicTmpl *template.Template
+	encode    kafkaEncoder
+	registry  *avroRegistryEncoder // Typed Avro with a schema registry; nil otherwise
+	byteCount
+}
+
+func NewKafkaSink(cfg config.KafkaTarget) (*KafkaSink, error) {
+	topicTmpl, err := keytemplate.Parse("topic", cfg.TopicPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid topic pattern: %w", err)
+	}
+	encode, err := newKafkaEncoder(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	if env := newEnvelopeEncoder(cfg.Envelope); env != nil {
+		if cfg.Format != "" && cfg.Format != config.KafkaFormatJSON {
+			return nil, fmt.Errorf("debezium envelope requires kafka format %s", config.KafkaFormatJSON)
+		}
+		encode = env.Encode
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.AllowAutoTopicCreation(),
+	}
+	if cfg.ClientID != "" {
+		opts = append(opts, kgo.ClientID(cfg.ClientID))
+	}
+	switch cfg.Acks {
+	case "", "all":
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case "leader":
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()))
+	case "none":
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()))
+	default:
+		return nil, fmt.Errorf("invalid kafka acks %q", cfg.Acks)
+	}
+	// The idempotent producer keeps per-partition order across retries and
+	// lets the broker drop duplicates; it is the client default.
+	if cfg.Idempotent != nil && !*cfg.Idempotent || cfg.Acks == "leader" || cfg.Acks == "none" {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if cfg.Compression != "" {
+		codec, err := kafkaCompression(cfg.Compression)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.ProducerBatchCompression(codec))
+	}
+	if cfg.Linger > 0 {
+		opts = append(opts, kgo.ProducerLinger(cfg.Linger))
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+
+	s := &KafkaSink{
+		client:    client,
+		topicTmpl: topicTmpl,
+		encode:    encode,
+	}
+	if cfg.SchemaRegistry.URL != "" {
+		s.registry = newAvroRegistryEncoder(cfg.SchemaRegistry)
+	}
+	return s, nil
+}
+
+func kafkaCompression(name string) (kgo.CompressionCodec, error) {
+	switch name {
+	case "none":
+		return kgo.NoCompression(), nil
+	case "gzip":
+		return kgo.GzipCompression(), nil
+	case "snappy":
+		return kgo.SnappyCompression(), nil
+	case "lz4":
+		return kgo.Lz4Compression(), nil
+	case "zstd":
+		return kgo.ZstdCompression(), nil
+	}
+	return kgo.CompressionCodec{}, fmt.Errorf("invalid kafka compression %q", name)
+}
+
+// Write produces the batch and waits for every delivery report, so the
+// batch is only acknowledged (and checkpointed) once Kafka has it.
+func (s *KafkaSink) Write(ctx context.Context, batch *types.Batch) error {
+	records := make([]*kgo.Record, 0, len(batch.Events))
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		r, err := s.record(ctx, e)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := s.client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		return fmt.Errorf("kafka produce failed: %w", err)
+	}
+	for _, r := range records {
+		s.addBytes(len(r.Key) + len(r.Value))
+	}
+	return nil
+}
+
+func (s *KafkaSink) record(ctx context.Context, e *types.Event) (*kgo.Record, error) {
+	topic, err := keytemplate.Execute(s.topicTmpl, map[string]interface{}{
+		"schema": e.Schema,
+		"table":  e.Table,
+		"op":     string(e.Type),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot build kafka topic for %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+	}
+	var key, value []byte
+	if s.registry != nil {
+		key, value, err = s.registry.encode(ctx, topic, e)
+	} else if key, err = kafkaKey(e); err == nil {
+		value, err = s.encode(e)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+	}
+	return &kgo.Record{
+		Topic: topic,
+		Key:   key,
+		Value: value,
+		Headers: []kgo.RecordHeader{
+			{Key: "op", Value: []byte(e.Type)},
+			{Key: "lsn", Value: []byte(e.LSN.String())},
+		},
+		Timestamp: e.Timestamp,
+	}, nil
+}
+
+// kafkaKey is the JSON object of the row's replica identity columns. Rows
+// of tables without one get no key and are spread over partitions.
+func kafkaKey(e *types.Event) ([]byte, error) {
+	if len(e.Identity) == 0 {
+		return nil, nil
+	}
+	key, err := json.Marshal(e.Identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal kafka key: %w", err)
+	}
+	return key, nil
+}
+
+func (s *KafkaSink) Close() error {
+	s.client.Close()
+	if s.registry != nil {
+		s.registry.close()
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/schemaregistry"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// avroRegistryEncoder writes records as Avro with one schema per table,
+// generated from the source's column types and registered with a schema
+// registry under the TopicNameStrategy subjects "<topic>-key" and
+// "<topic>-value". A relation change generates a new schema, which is
+// registered (and checked for compatibility) by its first record.
+type avroRegistryEncoder struct {
+	registry *schemaregistry.Client
+
+	mu       sync.Mutex
+	byRel    map[*types.Relation]*avroTable
+	inferred map[string]*avroTable // Tables without column types, keyed by value schema
+}
+
+func newAvroRegistryEncoder(cfg config.SchemaRegistryConfig) *avroRegistryEncoder {
+	return &avroRegistryEncoder{
+		registry: schemaregistry.New(cfg.URL, cfg.Username, cfg.Password, cfg.Timeout),
+		byRel:    make(map[*types.Relation]*avroTable),
+		inferred: make(map[string]*avroTable),
+	}
+}
+
+// avroTable holds the generated schemas of one version of a relation.
+type avroTable struct {
+	namespace   string
+	columns     []avroColumn // Row columns, in relation order
+	keys        []avroColumn // Replica identity columns
+	keyJSON     string
+	valueJSON   string
+	keySchema   avro.Schema
+	valueSchema avro.Schema
+}
+
+// avroColumn maps a source column to its Avro field.
+type avroColumn struct {
+	name   string      // Source column name
+	field  string      // Avro field name
+	oid    uint32      // Source type
+	typ    interface{} // Avro type of the value
+	branch string      // Union branch name of typ
+}
+
+// encode renders the key and value of e in the schema registry wire
+// format. Rows of tables without a replica identity get no key.
+func (enc *avroRegistryEncoder) encode(ctx context.Context, topic string, e *types.Event) ([]byte, []byte, error) {
+	t, err := enc.table(e)
+	if err != nil {
+		return nil, nil, Permanent(err)
+	}
+
+	var key []byte
+	if len(e.Identity) > 0 && len(t.keys) > 0 {
+		keyRow, err := avroRow(t.keys, e.Identity)
+		if err != nil {
+			return nil, nil, Permanent(err)
+		}
+		if key, err = enc.marshal(ctx, topic+"-key", t.keyJSON, t.keySchema, keyRow); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r := newChangeRecord(e)
+	record := map[string]interface{}{
+		"op":       r.Op,
+		"schema":   r.Schema,
+		"table":    r.Table,
+		"lsn":      r.LSN,
+		"ts_ms":    r.TsMs,
+		"identity": nil,
+		"data":     nil,
+	}
+	if r.Identity != nil {
+		row, err := avroRow(t.keys, r.Identity)
+		if err != nil {
+			return nil, nil, Permanent(err)
+		}
+		record["identity"] = map[string]interface{}{t.namespace + ".Key": row}
+	}
+	if r.Data != nil {
+		row, err := avroRow(t.columns, r.Data)
+		if err != nil {
+			return nil, nil, Permanent(err)
+		}
+		record["data"] = map[string]interface{}{t.namespace + ".Value": row}
+	}
+	value, err := enc.marshal(ctx, topic+"-value", t.valueJSON, t.valueSchema, record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, value, nil
+}
+
+// marshal registers schema under subject and encodes v with it. Schemas the
+// registry rejects, e.g. as incompatible, fail the batch permanently.
+func (enc *avroRegistryEncoder) marshal(ctx context.Context, subject, schemaJSON string, schema avro.Schema, v interface{}) ([]byte, error) {
+	id, err := enc.registry.Register(ctx, subject, schemaJSON)
+	if err != nil {
+		var regErr *schemaregistry.Error
+		if errors.As(err, &regErr) && !regErr.Temporary() {
+			return nil, Permanent(err)
+		}
+		return nil, err
+	}
+	data, err := avro.Marshal(schema, v)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("failed to encode %s record: %w", subject, err))
+	}
+	return schemaregistry.Frame(id, data), nil
+}
+
+// table returns the schemas of the event's relation. Events without column
+// types, such as replayed ones, get a schema inferred from their values.
+func (enc *avroRegistryEncoder) table(e *types.Event) (*avroTable, error) {
+	enc.mu.Lock()
+	defer enc.mu.Unlock()
+
+	if e.Relation != nil {
+		if t, ok := enc.byRel[e.Relation]; ok {
+			return t, nil
+		}
+		t, err := newAvroTable(e.Relation)
+		if err != nil {
+			return nil, err
+		}
+		enc.byRel[e.Relation] = t
+		return t, nil
+	}
+
+	rel := inferRelation(e)
+	t, err := newAvroTable(rel)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := enc.inferred[t.valueJSON]; ok {
+		return cached, nil
+	}
+	enc.inferred[t.valueJSON] = t
+	return t, nil
+}
+
+func (enc *avroRegistryEncoder) close() {
+	enc.registry.Close()
+}
+
+// avroField is a field of a generated record schema.
+type avroField struct {
+	Name    string      `json:"name"`
+	Type    interface{} `json:"type"`
+	Default *struct{}   `json:"default"` // Always null: every column is optional
+}
+
+type avroRecord struct {
+	Type      string      `json:"type"`
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace,omitempty"`
+	Fields    interface{} `json:"fields"`
+}
+
+// newAvroTable generates the key and value schemas of a relation. Every
+// column is a nullable field with a null default, so adding or dropping
+// columns keeps the schema backward and forward compatible.
+func newAvroTable(rel *types.Relation) (*avroTable, error) {
+	t := &avroTable{namespace: "replicator." + avroName(rel.Schema) + "." + avroName(rel.Table)}
+	for _, col := range rel.Columns {
+		typ, branch := avroColumnType(col.Type)
+		c := avroColumn{name: col.Name, field: avroName(col.Name), oid: col.Type, typ: typ, branch: branch}
+		t.columns = append(t.columns, c)
+		if col.Key {
+			t.keys = append(t.keys, c)
+		}
+	}
+
+	keyRecord := avroRecord{Type: "record", Name: "Key", Namespace: t.namespace, Fields: avroFields(t.keys)}
+	valueRecord := avroRecord{Type: "record", Name: "Value", Fields: avroFields(t.columns)}
+	envelope := avroRecord{
+		Type:      "record",
+		Name:      "Envelope",
+		Namespace: t.namespace,
+		Fields: []interface{}{
+			map[string]interface{}{"name": "op", "type": "string"},
+			map[string]interface{}{"name": "schema", "type": "string"},
+			map[string]interface{}{"name": "table", "type": "string"},
+			map[string]interface{}{"name": "lsn", "type": "string"},
+			map[string]interface{}{"name": "ts_ms", "type": "long"},
+			avroField{Name: "identity", Type: []interface{}{"null", keyRecord}},
+			avroField{Name: "data", Type: []interface{}{"null", valueRecord}},
+		},
+	}
+
+	keyJSON, err := json.Marshal(keyRecord)
+	if err != nil {
+		return nil, err
+	}
+	valueJSON, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	t.keyJSON, t.valueJSON = string(keyJSON), string(valueJSON)
+	// Each version gets its own cache: a new version reuses the record names
+	if t.keySchema, err = avro.ParseWithCache(t.keyJSON, "", &avro.SchemaCache{}); err != nil {
+		return nil, fmt.Errorf("invalid key schema for %s.%s: %w", rel.Schema, rel.Table, err)
+	}
+	if t.valueSchema, err = avro.ParseWithCache(t.valueJSON, "", &avro.SchemaCache{}); err != nil {
+		return nil, fmt.Errorf("invalid value schema for %s.%s: %w", rel.Schema, rel.Table, err)
+	}
+	return t, nil
+}
+
+func avroFields(cols []avroColumn) []avroField {
+	fields := make([]avroField, len(cols))
+	for i, c := range cols {
+		fields[i] = avroField{Name: c.field, Type: []interface{}{"null", c.typ}}
+	}
+	return fields
+}
+
+// avroColumnType maps a Postgres type OID to an Avro type and its union
+// branch name. Types without a closer match, including numeric and json,
+// are strings.
+func avroColumnType(oid uint32) (interface{}, string) {
+	switch oid {
+	case 16: // bool
+		return "boolean", "boolean"
+	case 21, 23: // int2, int4
+		return "int", "int"
+	case 20: // int8
+		return "long", "long"
+	case 700: // float4
+		return "float", "float"
+	case 701: // float8
+		return "double", "double"
+	case 17: // bytea
+		return "bytes", "bytes"
+	case 1082: // date
+		return map[string]string{"type": "int", "logicalType": "date"}, "int.date"
+	case 1114, 1184: // timestamp, timestamptz
+		return map[string]string{"type": "long", "logicalType": "timestamp-micros"}, "long.timestamp-micros"
+	case 2950: // uuid
+		return map[string]string{"type": "string", "logicalType": "uuid"}, "string.uuid"
+	}
+	return "string", "string"
+}
+
+// inferRelation builds column definitions from the Go types of an event's
+// values.
+func inferRelation(e *types.Event) *types.Relation {
+	row := make(map[string]interface{}, len(e.Columns)+len(e.Identity))
+	for col, v := range e.Identity {
+		row[col] = v
+	}
+	for col, v := range e.Columns {
+		row[col] = v
+	}
+	rel := &types.Relation{Schema: e.Schema, Table: e.Table}
+	for _, col := range sortedKeys(row) {
+		var oid uint32 = 25 // text
+		switch row[col].(type) {
+		case bool:
+			oid = 16
+		case int32:
+			oid = 23
+		case int64:
+			oid = 20
+		case float64:
+			oid = 701
+		case []byte:
+			oid = 17
+		case time.Time:
+			oid = 1184
+		}
+		_, key := e.Identity[col]
+		rel.Columns = append(rel.Columns, types.Column{Name: col, Type: oid, Key: key})
+	}
+	return rel
+}
+
+// avroRow converts the values of row to the Avro record of cols, each
+// wrapped in its union branch.
+func avroRow(cols []avroColumn, row map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(cols))
+	for _, c := range cols {
+		v, ok := row[c.name]
+		if !ok || v == nil {
+			out[c.field] = nil
+			continue
+		}
+		av, err := avroValue(c.oid, v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.name, err)
+		}
+		out[c.field] = map[string]interface{}{c.branch: av}
+	}
+	return out, nil
+}
+
+func avroValue(oid uint32, v interface{}) (interface{}, error) {
+	switch oid {
+	case 16:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return strconv.ParseBool(numberString(v))
+	case 21, 23:
+		i, err := strconv.ParseInt(numberString(v), 10, 32)
+		return int32(i), err
+	case 20:
+		if i, ok := v.(int64); ok {
+			return i, nil
+		}
+		return strconv.ParseInt(numberString(v), 10, 64)
+	case 700:
+		f, err := strconv.ParseFloat(numberString(v), 32)
+		return float32(f), err
+	case 701:
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+		return strconv.ParseFloat(numberString(v), 64)
+	case 17:
+		return binaryValue(v)
+	case 1082, 1114, 1184:
+		return timeValue(v, time.UTC)
+	}
+	return stringValue(v)
+}
+
+// avroName replaces the characters Avro names do not allow with "_".
+func avroName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', i > 0 && r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,190 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/schemaregistry"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// fakeRegistry implements schema registration of a Confluent-compatible
+// schema registry.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	schemas  []string            // Indexed by ID - 1
+	subjects map[string][]string // Versions per subject
+	reject   map[string]bool     // Subjects whose new versions are incompatible
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subject, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+	if r.Method != http.MethodPost || !ok {
+		http.Error(w, "unexpected request", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := avro.ParseWithCache(req.Schema, "", &avro.SchemaCache{}); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error_code": 42201, "message": err.Error()})
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := 0
+	for i, s := range f.schemas {
+		if s == req.Schema {
+			id = i + 1
+		}
+	}
+	known := false
+	for _, s := range f.subjects[subject] {
+		known = known || s == req.Schema
+	}
+	if !known {
+		if f.reject[subject] && len(f.subjects[subject]) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error_code": 409, "message": "Schema being registered is incompatible with an earlier schema"})
+			return
+		}
+		f.subjects[subject] = append(f.subjects[subject], req.Schema)
+	}
+	if id == 0 {
+		f.schemas = append(f.schemas, req.Schema)
+		id = len(f.schemas)
+	}
+	json.NewEncoder(w).Encode(map[string]int{"id": id})
+}
+
+// decode unframes msg and decodes it with the registered schema.
+func (f *fakeRegistry) decode(t *testing.T, msg []byte) map[string]interface{} {
+	t.Helper()
+	id, data, err := schemaregistry.Unframe(msg)
+	if err != nil {
+		t.Fatalf("Invalid framing: %v", err)
+	}
+	f.mu.Lock()
+	schema := avro.MustParse(f.schemas[id-1])
+	f.mu.Unlock()
+	var v map[string]interface{}
+	if err := avro.Unmarshal(schema, data, &v); err != nil {
+		t.Fatalf("Invalid avro value: %v", err)
+	}
+	return v
+}
+
+// avroRecordField returns a nullable record field, decoded as a map keyed
+// by the record's full name.
+func avroRecordField(record map[string]interface{}, field string) map[string]interface{} {
+	union, _ := record[field].(map[string]interface{})
+	for _, v := range union {
+		row, _ := v.(map[string]interface{})
+		return row
+	}
+	return nil
+}
+
+func TestKafkaSinkSchemaRegistry(t *testing.T) {
+	registry := &fakeRegistry{subjects: make(map[string][]string), reject: make(map[string]bool)}
+	srv := httptest.NewServer(registry)
+	defer srv.Close()
+
+	s, brokers := newTestKafkaSink(t, config.KafkaTarget{
+		Format:         config.KafkaFormatAvro,
+		SchemaRegistry: config.SchemaRegistryConfig{URL: srv.URL, Timeout: time.Second},
+	})
+	ctx := context.Background()
+
+	v1 := &types.Relation{Schema: "public", Table: "users", Columns: []types.Column{
+		{Name: "id", Type: 23, Key: true},
+		{Name: "name", Type: 25},
+		{Name: "balance", Type: 701},
+		{Name: "created", Type: 1184},
+	}}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	batch := &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Relation: v1, LSN: 10,
+			Columns:  map[string]interface{}{"id": int64(1), "name": "a", "balance": "12.5", "created": created},
+			Identity: map[string]interface{}{"id": int64(1)}},
+		{Type: types.EventDelete, Schema: "public", Table: "users", Relation: v1, LSN: 11,
+			Identity: map[string]interface{}{"id": int64(1)}},
+	}}
+	if err := s.Write(ctx, batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	records := consume(t, brokers, "public.users", 2)
+	key := registry.decode(t, records[0].Key)
+	if key["id"] != 1 {
+		t.Errorf("Expected an int key, got %v", key)
+	}
+	insert := registry.decode(t, records[0].Value)
+	data := avroRecordField(insert, "data")
+	if insert["op"] != "INSERT" || data["name"] != "a" || data["balance"] != 12.5 {
+		t.Errorf("Unexpected insert %v", insert)
+	}
+	if ts, ok := data["created"].(time.Time); !ok || !ts.Equal(created) {
+		t.Errorf("Expected created %s, got %v", created, data["created"])
+	}
+	if del := registry.decode(t, records[1].Value); del["op"] != "DELETE" || del["data"] != nil {
+		t.Errorf("Unexpected delete %v", del)
+	}
+
+	// A new relation version registers a new schema version
+	v2 := &types.Relation{Schema: "public", Table: "users", Columns: append(v1.Columns[:4:4], types.Column{Name: "email", Type: 25})}
+	added := &types.Event{Type: types.EventInsert, Schema: "public", Table: "users", Relation: v2, LSN: 12,
+		Columns:  map[string]interface{}{"id": int64(2), "email": "b@example.com"},
+		Identity: map[string]interface{}{"id": int64(2)}}
+	if err := s.Write(ctx, &types.Batch{Events: []*types.Event{added}}); err != nil {
+		t.Fatalf("Write after relation change failed: %v", err)
+	}
+	if n := len(registry.subjects["public.users-value"]); n != 2 {
+		t.Errorf("Expected 2 value schema versions, got %d", n)
+	}
+	if n := len(registry.subjects["public.users-key"]); n != 1 {
+		t.Errorf("Expected the key schema to be unchanged, got %d versions", n)
+	}
+	for _, r := range consume(t, brokers, "public.users", 3) {
+		if v := registry.decode(t, r.Value); v["lsn"] == "0/C" {
+			data = avroRecordField(v, "data")
+		}
+	}
+	if data["email"] != "b@example.com" || data["name"] != nil {
+		t.Errorf("Unexpected evolved row %v", data)
+	}
+
+	// An incompatible change fails the batch without retrying
+	registry.reject["public.users-value"] = true
+	v3 := &types.Relation{Schema: "public", Table: "users", Columns: []types.Column{{Name: "id", Type: 25, Key: true}}}
+	changed := &types.Event{Type: types.EventInsert, Schema: "public", Table: "users", Relation: v3, LSN: 13,
+		Columns: map[string]interface{}{"id": "x"}, Identity: map[string]interface{}{"id": "x"}}
+	err := s.Write(ctx, &types.Batch{Events: []*types.Event{changed}})
+	var perm *permanentError
+	if !errors.As(err, &perm) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+}
+
+func TestAvroName(t *testing.T) {
+	for in, want := range map[string]string{"users": "users", "order-items": "order_items", "1st": "_st", "Ünicode": "_nicode"} {
+		if got := avroName(in); got != want {
+			t.Errorf("avroName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
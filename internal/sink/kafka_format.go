@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// kafkaEncoder renders a change event as a record value.
+type kafkaEncoder func(e *types.Event) ([]byte, error)
+
+func newKafkaEncoder(format string) (kafkaEncoder, error) {
+	switch format {
+	case "", config.KafkaFormatJSON:
+		return encodeChangeJSON, nil
+	case config.KafkaFormatAvro:
+		return encodeChangeAvro, nil
+	case config.KafkaFormatProtobuf:
+		return encodeChangeProtobuf, nil
+	}
+	return nil, fmt.Errorf("invalid kafka format %q", format)
+}
+
+// changeRecord is the payload of a change. Identity holds the replica
+// identity columns, Data the row (absent for deletes).
+type changeRecord struct {
+	Op       string                 `json:"op" avro:"op"`
+	Schema   string                 `json:"schema" avro:"schema"`
+	Table    string                 `json:"table" avro:"table"`
+	LSN      string                 `json:"lsn" avro:"lsn"`
+	TsMs     int64                  `json:"ts_ms" avro:"ts_ms"`
+	Identity map[string]interface{} `json:"identity,omitempty" avro:"identity"`
+	Data     map[string]interface{} `json:"data,omitempty" avro:"data"`
+}
+
+func newChangeRecord(e *types.Event) changeRecord {
+	r := changeRecord{
+		Op:       string(e.Type),
+		Schema:   e.Schema,
+		Table:    e.Table,
+		LSN:      e.LSN.String(),
+		TsMs:     e.Timestamp.UnixMilli(),
+		Identity: e.Identity,
+	}
+	if e.Type != types.EventDelete {
+		r.Data = e.Columns
+	}
+	return r
+}
+
+func encodeChangeJSON(e *types.Event) ([]byte, error) {
+	return json.Marshal(newChangeRecord(e))
+}
+
+// changeAvroSchema is a generic envelope: column values are written as the
+// closest Avro primitive, and as JSON strings for anything else. A delete
+// has an empty data map.
+var changeAvroSchema = avro.MustParse(`{
+  "type": "record",
+  "name": "Change",
+  "namespace": "replicator",
+  "fields": [
+    {"name": "op", "type": "string"},
+    {"name": "schema", "type": "string"},
+    {"name": "table", "type": "string"},
+    {"name": "lsn", "type": "string"},
+    {"name": "ts_ms", "type": "long"},
+    {"name": "identity", "type": {"type": "map", "values": ["null", "boolean", "long", "double", "string", "bytes"]}, "default": {}},
+    {"name": "data", "type": {"type": "map", "values": ["null", "boolean", "long", "double", "string", "bytes"]}, "default": {}}
+  ]
+}`)
+
+func encodeChangeAvro(e *types.Event) ([]byte, error) {
+	r := newChangeRecord(e)
+	var err error
+	if r.Identity, err = plainValues(r.Identity, false); err != nil {
+		return nil, err
+	}
+	if r.Data, err = plainValues(r.Data, false); err != nil {
+		return nil, err
+	}
+	return avro.Marshal(changeAvroSchema, r)
+}
+
+// encodeChangeProtobuf writes the record as a google.protobuf.Struct.
+func encodeChangeProtobuf(e *types.Event) ([]byte, error) {
+	r := newChangeRecord(e)
+	fields := map[string]interface{}{
+		"op":     r.Op,
+		"schema": r.Schema,
+		"table":  r.Table,
+		"lsn":    r.LSN,
+		"ts_ms":  r.TsMs,
+	}
+	if r.Identity != nil {
+		identity, err := plainValues(r.Identity, true)
+		if err != nil {
+			return nil, err
+		}
+		fields["identity"] = identity
+	}
+	if r.Data != nil {
+		data, err := plainValues(r.Data, true)
+		if err != nil {
+			return nil, err
+		}
+		fields["data"] = data
+	}
+	msg, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(msg)
+}
+
+// maxSafeInt is the largest integer a double holds exactly.
+const maxSafeInt = 1 << 53
+
+// plainValues converts column values to nil, bool, int64, float64, string
+// or []byte. Times become RFC 3339 strings and other values JSON strings.
+// With asDouble, integers a double cannot hold exactly become strings.
+func plainValues(row map[string]interface{}, asDouble bool) (map[string]interface{}, error) {
+	if row == nil {
+		return nil, nil
+	}
+	out := make(map[string]interface{}, len(row))
+	for col, v := range row {
+		pv, err := plainValue(v, asDouble)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", col, err)
+		}
+		out[col] = pv
+	}
+	return out, nil
+}
+
+func plainValue(v interface{}, asDouble bool) (interface{}, error) {
+	var i int64
+	switch x := v.(type) {
+	case nil, bool, string, []byte, float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case int:
+		i = int64(x)
+	case int8:
+		i = int64(x)
+	case int16:
+		i = int64(x)
+	case int32:
+		i = int64(x)
+	case int64:
+		i = x
+	case uint8:
+		i = int64(x)
+	case uint16:
+		i = int64(x)
+	case uint32:
+		i = int64(x)
+	case uint:
+		if uint64(x) > math.MaxInt64 {
+			return strconv.FormatUint(uint64(x), 10), nil
+		}
+		i = int64(x)
+	case uint64:
+		if x > math.MaxInt64 {
+			return strconv.FormatUint(x, 10), nil
+		}
+		i = int64(x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+	if asDouble && (i > maxSafeInt || i < -maxSafeInt) {
+		return strconv.FormatInt(i, 10), nil
+	}
+	return i, nil
+}
@@ -0,0 +1,137 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func newTestKafkaSink(t *testing.T, cfg config.KafkaTarget) (*KafkaSink, []string) {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.AllowAutoTopicCreation(), kfake.DefaultNumPartitions(3))
+	if err != nil {
+		t.Fatalf("Failed to start fake kafka cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+
+	cfg.Brokers = cluster.ListenAddrs()
+	if cfg.TopicPattern == "" {
+		cfg.TopicPattern = "{{.schema}}.{{.table}}"
+	}
+	s, err := NewKafkaSink(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create kafka sink: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, cfg.Brokers
+}
+
+// consume reads n records from topic.
+func consume(t *testing.T, brokers []string, topic string, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...), kgo.ConsumeTopics(topic), kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	if err != nil {
+		t.Fatalf("Failed to create consumer: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("Timed out after %d of %d records", len(records), n)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func TestKafkaSinkJSON(t *testing.T) {
+	s, brokers := newTestKafkaSink(t, config.KafkaTarget{})
+
+	events := []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "a"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 10},
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(2), "name": "b"}, Identity: map[string]interface{}{"id": int64(2)}, LSN: 11},
+		{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "c"}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 12},
+		{Type: types.EventDelete, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 13},
+	}
+	if err := s.Write(context.Background(), &types.Batch{Events: events}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Changes of one row share a key, and so a partition, in LSN order
+	var ops []string
+	for _, r := range consume(t, brokers, "public.users", len(events)) {
+		var rec changeRecord
+		if err := json.Unmarshal(r.Value, &rec); err != nil {
+			t.Fatalf("Invalid record value %s: %v", r.Value, err)
+		}
+		if string(r.Key) == `{"id":1}` {
+			ops = append(ops, rec.Op)
+		}
+		if rec.Op == "DELETE" && rec.Data != nil {
+			t.Errorf("Expected no data for delete, got %v", rec.Data)
+		}
+	}
+	if want := []string{"INSERT", "UPDATE", "DELETE"}; len(ops) != 3 || ops[0] != want[0] || ops[1] != want[1] || ops[2] != want[2] {
+		t.Errorf("Expected ops %v for key id=1, got %v", want, ops)
+	}
+}
+
+func TestKafkaSinkFormats(t *testing.T) {
+	event := &types.Event{
+		Type:      types.EventInsert,
+		Schema:    "public",
+		Table:     "orders",
+		Columns:   map[string]interface{}{"id": int32(5), "total": 9.5, "paid": true, "note": nil, "created": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		Identity:  map[string]interface{}{"id": int32(5)},
+		LSN:       0x20,
+		Timestamp: time.UnixMilli(1700000000000),
+	}
+
+	t.Run("avro", func(t *testing.T) {
+		s, brokers := newTestKafkaSink(t, config.KafkaTarget{Format: config.KafkaFormatAvro, TopicPattern: "cdc.{{.table}}"})
+		if err := s.Write(context.Background(), &types.Batch{Events: []*types.Event{event}}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		r := consume(t, brokers, "cdc.orders", 1)[0]
+		var rec changeRecord
+		if err := avro.Unmarshal(changeAvroSchema, r.Value, &rec); err != nil {
+			t.Fatalf("Invalid avro value: %v", err)
+		}
+		if rec.Op != "INSERT" || rec.LSN != "0/20" || rec.TsMs != 1700000000000 {
+			t.Errorf("Unexpected envelope: %+v", rec)
+		}
+		if rec.Data["id"] != int64(5) || rec.Data["created"] != "2024-01-02T03:04:05Z" || rec.Data["note"] != nil {
+			t.Errorf("Unexpected data: %v", rec.Data)
+		}
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		s, brokers := newTestKafkaSink(t, config.KafkaTarget{Format: config.KafkaFormatProtobuf})
+		if err := s.Write(context.Background(), &types.Batch{Events: []*types.Event{event}}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		r := consume(t, brokers, "public.orders", 1)[0]
+		var msg structpb.Struct
+		if err := proto.Unmarshal(r.Value, &msg); err != nil {
+			t.Fatalf("Invalid protobuf value: %v", err)
+		}
+		rec := msg.AsMap()
+		data, _ := rec["data"].(map[string]interface{})
+		if rec["op"] != "INSERT" || data["total"] != 9.5 || data["paid"] != true {
+			t.Errorf("Unexpected record: %v", rec)
+		}
+	})
+}
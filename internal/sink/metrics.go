@@ -0,0 +1,100 @@
+package sink
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labels identify a target in metrics and logs.
+type Labels struct {
+	Pipeline string
+	Name     string
+	Type     string // Target type, e.g. "postgres" or "kafka"
+}
+
+// ByteCounter is implemented by sinks that know how many bytes they have
+// written to their target: encoded messages, request bodies or files.
+type ByteCounter interface {
+	BytesWritten() uint64
+}
+
+// byteCount implements ByteCounter for the sinks that embed it.
+type byteCount struct {
+	n atomic.Uint64
+}
+
+func (c *byteCount) addBytes(n int) {
+	c.n.Add(uint64(n))
+}
+
+func (c *byteCount) BytesWritten() uint64 {
+	return c.n.Load()
+}
+
+// sinkMetrics records the metrics of one target.
+type sinkMetrics struct {
+	labels    Labels
+	latency   prometheus.Observer
+	batchSize prometheus.Observer
+	retries   prometheus.Counter
+	permanent prometheus.Counter
+	bytes     prometheus.Counter
+
+	counter ByteCounter // nil if the sink does not count bytes
+	mu      sync.Mutex
+	written uint64 // BytesWritten already added to bytes
+}
+
+func newSinkMetrics(labels Labels, s Sink) *sinkMetrics {
+	values := []string{labels.Pipeline, labels.Name, labels.Type}
+	m := &sinkMetrics{
+		labels:    labels,
+		latency:   telemetry.SinkLatency.WithLabelValues(values...),
+		batchSize: telemetry.BatchSize.WithLabelValues(values...),
+		retries:   telemetry.SinkRetries.WithLabelValues(values...),
+		permanent: telemetry.SinkPermanentFailures.WithLabelValues(values...),
+		bytes:     telemetry.SinkBytesWritten.WithLabelValues(values...),
+	}
+	if c, ok := s.(ByteCounter); ok {
+		m.counter = c
+		m.written = c.BytesWritten()
+	}
+	return m
+}
+
+// write records the size of a batch once, however many attempts it takes.
+func (m *sinkMetrics) write(batch *types.Batch) {
+	m.batchSize.Observe(float64(len(batch.Events)))
+}
+
+// attempt records one write attempt that started at start.
+func (m *sinkMetrics) attempt(start time.Time) {
+	m.latency.Observe(time.Since(start).Seconds())
+	if m.counter != nil {
+		// Workers write concurrently; add each byte once
+		m.mu.Lock()
+		if n := m.counter.BytesWritten(); n > m.written {
+			m.bytes.Add(float64(n - m.written))
+			m.written = n
+		}
+		m.mu.Unlock()
+	}
+}
+
+// events counts the events of batch by table and operation.
+func (m *sinkMetrics) events(batch *types.Batch, status string) {
+	type key struct{ table, op string }
+	counts := make(map[key]int)
+	for _, e := range batch.Events {
+		counts[key{e.Schema + "." + e.Table, strings.ToLower(string(e.Type))}]++
+	}
+	for k, n := range counts {
+		telemetry.EventsProcessed.WithLabelValues(m.labels.Pipeline, m.labels.Name, m.labels.Type, k.table, k.op, status).Add(float64(n))
+	}
+}
@@ -0,0 +1,200 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// mysqlMaxPlaceholders keeps multi-row statements below MySQL's limit of
+// 65535 placeholders per prepared statement.
+const mysqlMaxPlaceholders = 65535
+
+// MySQLSink applies changes to MySQL or MariaDB: inserts and updates as
+// INSERT ... ON DUPLICATE KEY UPDATE upserts, deletes by replica identity.
+// Each batch is applied in one transaction.
+type MySQLSink struct {
+	db     *sql.DB
+	dbName string
+
+	mu      sync.Mutex
+	schemas map[string]mysqlSchema // Column types per table
+}
+
+func NewMySQLSink(cfg config.MySQLTarget) (*MySQLSink, error) {
+	dsn, err := mysql.ParseDSN(cfg.ConnectionString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mysql connection string: %w", err)
+	}
+	if dsn.DBName == "" {
+		return nil, errors.New("mysql connection string must name a database")
+	}
+	// Times are converted to UTC before they are written
+	dsn.Loc = time.UTC
+
+	connector, err := mysql.NewConnector(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mysql connector: %w", err)
+	}
+	db := sql.OpenDB(connector)
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	return &MySQLSink{
+		db:      db,
+		dbName:  dsn.DBName,
+		schemas: make(map[string]mysqlSchema),
+	}, nil
+}
+
+// mysqlStatement is one multi-row statement: upserts of rows sharing a
+// column set, or deletes of rows sharing an identity column set.
+type mysqlStatement struct {
+	table  string
+	delete bool
+	cols   []string
+	rows   [][]interface{}
+}
+
+func (s *MySQLSink) Write(ctx context.Context, batch *types.Batch) error {
+	stmts := mysqlStatements(batch.Events)
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	for _, st := range stmts {
+		if err := s.convertRows(ctx, st); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("mysql begin failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, st := range stmts {
+		query, args := st.sql()
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			// The table may have been altered since its schema was read
+			s.forgetSchema(st.table)
+			return fmt.Errorf("mysql write to %s failed: %w", st.table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("mysql commit failed: %w", err)
+	}
+	return nil
+}
+
+// mysqlStatements turns events into statements, merging consecutive
+// changes of a table into multi-row statements while keeping their order.
+func mysqlStatements(events []*types.Event) []*mysqlStatement {
+	var stmts []*mysqlStatement
+	add := func(table string, del bool, row map[string]interface{}) {
+		cols := sortedKeys(row)
+		if n := len(stmts); n > 0 {
+			last := stmts[n-1]
+			if last.table == table && last.delete == del && sameColumns(last.cols, cols) &&
+				(len(last.rows)+1)*len(cols) <= mysqlMaxPlaceholders {
+				last.rows = append(last.rows, values(row, cols))
+				return
+			}
+		}
+		stmts = append(stmts, &mysqlStatement{table: table, delete: del, cols: cols, rows: [][]interface{}{values(row, cols)}})
+	}
+
+	for _, e := range events {
+		switch e.Type {
+		case types.EventInsert, types.EventUpdate:
+			if len(e.Columns) == 0 {
+				continue
+			}
+			// An update that changed the key moves the row: the old row is
+			// deleted before the new one is written.
+			if e.Type == types.EventUpdate && keyChanged(e) {
+				add(e.Table, true, e.Identity)
+			}
+			add(e.Table, false, e.Columns)
+		case types.EventDelete:
+			if len(e.Identity) == 0 {
+				continue // Cannot delete without identity
+			}
+			add(e.Table, true, e.Identity)
+		}
+	}
+	return stmts
+}
+
+// keyChanged reports whether an update's new row has other identity values
+// than the old row.
+func keyChanged(e *types.Event) bool {
+	for col, old := range e.Identity {
+		v, ok := e.Columns[col]
+		if ok && fmt.Sprint(v) != fmt.Sprint(old) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sql renders the statement and its arguments.
+func (st *mysqlStatement) sql() (string, []interface{}) {
+	quoted := make([]string, len(st.cols))
+	for i, col := range st.cols {
+		quoted[i] = quoteMySQL(col)
+	}
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(st.cols)), ", ") + ")"
+	tuples := strings.TrimSuffix(strings.Repeat(tuple+", ", len(st.rows)), ", ")
+
+	args := make([]interface{}, 0, len(st.rows)*len(st.cols))
+	for _, row := range st.rows {
+		args = append(args, row...)
+	}
+
+	var sb strings.Builder
+	if st.delete {
+		fmt.Fprintf(&sb, "DELETE FROM %s WHERE (%s) IN (%s)", quoteMySQL(st.table), strings.Join(quoted, ", "), tuples)
+		return sb.String(), args
+	}
+
+	// VALUES() is deprecated in MySQL 8.0.20 in favour of row aliases,
+	// which MariaDB does not support.
+	updates := make([]string, len(quoted))
+	for i, col := range quoted {
+		updates[i] = fmt.Sprintf("%s = VALUES(%s)", col, col)
+	}
+	fmt.Fprintf(&sb, "INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE %s",
+		quoteMySQL(st.table), strings.Join(quoted, ", "), tuples, strings.Join(updates, ", "))
+	return sb.String(), args
+}
+
+// quoteMySQL quotes an identifier with backticks.
+func quoteMySQL(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (s *MySQLSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,122 @@
+package sink
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func TestMySQLStatements(t *testing.T) {
+	row := func(typ types.EventType, id int64, cols map[string]interface{}) *types.Event {
+		return &types.Event{Type: typ, Schema: "public", Table: "users", Columns: cols, Identity: map[string]interface{}{"id": id}}
+	}
+	stmts := mysqlStatements([]*types.Event{
+		row(types.EventInsert, 1, map[string]interface{}{"id": int64(1), "name": "a"}),
+		row(types.EventInsert, 2, map[string]interface{}{"id": int64(2), "name": "b"}),
+		row(types.EventDelete, 1, nil),
+		row(types.EventDelete, 2, nil),
+		// The key changed from 3 to 4
+		{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(4), "name": "c"}, Identity: map[string]interface{}{"id": int64(3)}},
+		{Type: types.EventInsert, Table: "group`s", Columns: map[string]interface{}{"id": int64(1)}},
+	})
+
+	want := []struct {
+		query string
+		args  []interface{}
+	}{
+		{
+			"INSERT INTO `users` (`id`, `name`) VALUES (?, ?), (?, ?) ON DUPLICATE KEY UPDATE `id` = VALUES(`id`), `name` = VALUES(`name`)",
+			[]interface{}{int64(1), "a", int64(2), "b"},
+		},
+		{"DELETE FROM `users` WHERE (`id`) IN ((?), (?), (?))", []interface{}{int64(1), int64(2), int64(3)}},
+		{
+			"INSERT INTO `users` (`id`, `name`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `id` = VALUES(`id`), `name` = VALUES(`name`)",
+			[]interface{}{int64(4), "c"},
+		},
+		{"INSERT INTO `group``s` (`id`) VALUES (?) ON DUPLICATE KEY UPDATE `id` = VALUES(`id`)", []interface{}{int64(1)}},
+	}
+	if len(stmts) != len(want) {
+		t.Fatalf("Expected %d statements, got %d", len(want), len(stmts))
+	}
+	for i, st := range stmts {
+		query, args := st.sql()
+		if query != want[i].query {
+			t.Errorf("Statement %d:\nexpected %s\ngot      %s", i, want[i].query, query)
+		}
+		if !reflect.DeepEqual(args, want[i].args) {
+			t.Errorf("Statement %d: expected args %v, got %v", i, want[i].args, args)
+		}
+	}
+}
+
+func TestConvertMySQL(t *testing.T) {
+	id := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 678901000, time.FixedZone("", 3*3600))
+
+	tests := []struct {
+		name string
+		col  mysqlColumn
+		in   interface{}
+		want interface{}
+	}{
+		{"int from string", mysqlColumn{dataType: "int", columnType: "int"}, "42", int64(42)},
+		{"bool to tinyint", mysqlColumn{dataType: "tinyint", columnType: "tinyint(1)"}, true, int64(1)},
+		{"pg bool text to tinyint", mysqlColumn{dataType: "tinyint", columnType: "tinyint(1)"}, "f", int64(0)},
+		{"unsigned bigint", mysqlColumn{dataType: "bigint", columnType: "bigint unsigned"}, "18446744073709551615", uint64(18446744073709551615)},
+		{"decimal keeps precision", mysqlColumn{dataType: "decimal", columnType: "decimal(30,10)"}, "12345678901234567890.0123456789", "12345678901234567890.0123456789"},
+		{"timestamptz to datetime in utc", mysqlColumn{dataType: "datetime", columnType: "datetime(6)"}, ts, ts.UTC()},
+		{"timestamptz text", mysqlColumn{dataType: "datetime", columnType: "datetime(6)"}, "2024-01-02 03:04:05.5+03", time.Date(2024, 1, 2, 0, 4, 5, 500000000, time.UTC)},
+		{"jsonb text", mysqlColumn{dataType: "json", columnType: "json"}, `{"a": 1}`, `{"a": 1}`},
+		{"json from map", mysqlColumn{dataType: "json", columnType: "json"}, map[string]interface{}{"a": 1}, `{"a":1}`},
+		{"uuid to char", mysqlColumn{dataType: "char", columnType: "char(36)"}, id, id},
+		{"nullable nil", mysqlColumn{dataType: "int", columnType: "int", nullable: true}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convertMySQL(tt.col, tt.in)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if want, ok := tt.want.(time.Time); ok {
+				if got, ok := got.(time.Time); !ok || !got.Equal(want) || got.Location() != time.UTC {
+					t.Errorf("Expected %v, got %v", want, got)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v (%T), got %v (%T)", tt.want, tt.want, got, got)
+			}
+		})
+	}
+
+	t.Run("uuid to binary(16)", func(t *testing.T) {
+		got, err := convertMySQL(mysqlColumn{dataType: "binary", columnType: "binary(16)"}, id)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		want := uuid.MustParse(id)
+		if b, ok := got.([]byte); !ok || !bytes.Equal(b, want[:]) {
+			t.Errorf("Expected %x, got %v", want[:], got)
+		}
+	})
+
+	t.Run("bytea to blob", func(t *testing.T) {
+		got, err := convertMySQL(mysqlColumn{dataType: "blob", columnType: "blob"}, `\x0a0b`)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if b, ok := got.([]byte); !ok || !bytes.Equal(b, []byte{0x0a, 0x0b}) {
+			t.Errorf("Expected 0a0b, got %v", got)
+		}
+	})
+
+	t.Run("null for not null column", func(t *testing.T) {
+		if _, err := convertMySQL(mysqlColumn{dataType: "int", columnType: "int"}, nil); err == nil {
+			t.Error("Expected error")
+		}
+	})
+}
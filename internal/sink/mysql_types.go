@@ -0,0 +1,210 @@
+package sink
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// mysqlColumn is the type of a MySQL column as listed in
+// information_schema.COLUMNS, e.g. DATA_TYPE "binary" and COLUMN_TYPE
+// "binary(16)".
+type mysqlColumn struct {
+	dataType   string
+	columnType string
+	nullable   bool
+}
+
+// mysqlSchema maps column names of a MySQL table to their types.
+type mysqlSchema map[string]mysqlColumn
+
+// tableSchema returns the cached column types of table, reading them from
+// information_schema on first use.
+func (s *MySQLSink) tableSchema(ctx context.Context, table string) (mysqlSchema, error) {
+	s.mu.Lock()
+	schema, ok := s.schemas[table]
+	s.mu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		"SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?",
+		s.dbName, table)
+	if err != nil {
+		return nil, fmt.Errorf("schema lookup failed for %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	schema = make(mysqlSchema)
+	for rows.Next() {
+		var name, dataType, columnType, nullable string
+		if err := rows.Scan(&name, &dataType, &columnType, &nullable); err != nil {
+			return nil, fmt.Errorf("schema lookup scan failed for %s: %w", table, err)
+		}
+		schema[name] = mysqlColumn{
+			dataType:   strings.ToLower(dataType),
+			columnType: strings.ToLower(columnType),
+			nullable:   nullable == "YES",
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("schema lookup failed for %s: %w", table, err)
+	}
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("table %s does not exist in MySQL database %s", table, s.dbName)
+	}
+
+	s.mu.Lock()
+	s.schemas[table] = schema
+	s.mu.Unlock()
+	return schema, nil
+}
+
+// forgetSchema drops a cached schema so that it is read again.
+func (s *MySQLSink) forgetSchema(table string) {
+	s.mu.Lock()
+	delete(s.schemas, table)
+	s.mu.Unlock()
+}
+
+// convertRows converts the values of a statement in place to the types of
+// its table's columns.
+func (s *MySQLSink) convertRows(ctx context.Context, st *mysqlStatement) error {
+	schema, err := s.tableSchema(ctx, st.table)
+	if err != nil {
+		return err
+	}
+	cols := make([]mysqlColumn, len(st.cols))
+	for i, name := range st.cols {
+		col, ok := schema[name]
+		if !ok {
+			return fmt.Errorf("column %q does not exist in MySQL table %s", name, st.table)
+		}
+		cols[i] = col
+	}
+
+	for _, row := range st.rows {
+		for i := range row {
+			v, err := convertMySQL(cols[i], row[i])
+			if err != nil {
+				return fmt.Errorf("column %s.%s (%s): %w", st.table, st.cols[i], cols[i].columnType, err)
+			}
+			row[i] = v
+		}
+	}
+	return nil
+}
+
+// convertMySQL converts a decoded source value to a value the MySQL driver
+// writes correctly into col:
+//   - json/jsonb text to JSON
+//   - timestamps to DATETIME/TIMESTAMP in UTC
+//   - uuid to CHAR(36) as text or to BINARY(16) as its 16 bytes
+//   - bytea ("\x..." hex) to binary and blob columns
+func convertMySQL(col mysqlColumn, v interface{}) (interface{}, error) {
+	if v == nil {
+		if !col.nullable {
+			return nil, errNotNullable
+		}
+		return nil, nil
+	}
+
+	switch col.dataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year":
+		// Postgres booleans are written to TINYINT(1) as 0 or 1
+		if x, ok := v.(string); ok && (x == "t" || x == "f") {
+			v = x == "t"
+		}
+		if strings.Contains(col.columnType, "unsigned") {
+			n, err := strconv.ParseUint(numberString(v), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+			}
+			return n, nil
+		}
+		n, err := strconv.ParseInt(numberString(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		return n, nil
+	case "float", "double", "real":
+		f, err := strconv.ParseFloat(numberString(v), 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %v (%T): %w", v, v, err)
+		}
+		return f, nil
+	case "decimal", "numeric":
+		return numberString(v), nil
+	case "datetime", "timestamp":
+		t, err := timeValue(v, time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		return t.(time.Time).UTC(), nil
+	case "date":
+		t, err := timeValue(v, time.UTC)
+		if err != nil {
+			return nil, err
+		}
+		return t.(time.Time).Format("2006-01-02"), nil
+	case "json":
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case []byte:
+			return string(x), nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode %T as JSON: %w", v, err)
+		}
+		return string(data), nil
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		if col.columnType == "binary(16)" {
+			if u, err := uuidValue(v); err == nil {
+				return u[:], nil
+			}
+		}
+		return binaryValue(v)
+	case "char", "varchar", "tinytext", "text", "mediumtext", "longtext", "enum", "set":
+		return stringValue(v)
+	default:
+		return v, nil
+	}
+}
+
+func uuidValue(v interface{}) (uuid.UUID, error) {
+	switch x := v.(type) {
+	case uuid.UUID:
+		return x, nil
+	case [16]byte:
+		return uuid.UUID(x), nil
+	}
+	return uuid.Parse(fmt.Sprint(stringOrBytes(v)))
+}
+
+// binaryValue returns the bytes of a value, decoding Postgres bytea hex
+// output ("\x0a0b").
+func binaryValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case string:
+		if strings.HasPrefix(x, `\x`) {
+			b, err := hex.DecodeString(x[2:])
+			if err != nil {
+				return nil, fmt.Errorf("cannot decode bytea %q: %w", x, err)
+			}
+			return b, nil
+		}
+		return []byte(x), nil
+	}
+	return nil, fmt.Errorf("cannot convert %v (%T) to bytes", v, v)
+}
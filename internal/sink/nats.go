@@ -0,0 +1,141 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// NatsSink publishes one JetStream message per change to
+// "<prefix>.<schema>.<table>.<op>". Messages carry the pipeline and the
+// change's table, key and LSN as their deduplication ID, so a batch retried
+// within the stream's duplicate window is not stored twice, while pipelines
+// reading different databases into one stream do not collide.
+type NatsSink struct {
+	conn       *nats.Conn
+	js         jetstream.JetStream
+	pipeline   string
+	prefix     string
+	ackTimeout time.Duration
+	byteCount
+}
+
+func NewNatsSink(ctx context.Context, cfg config.NATSTarget, pipeline string) (*NatsSink, error) {
+	opts := []nats.Option{nats.Name("replicator " + cfg.Name)}
+	if cfg.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.CredentialsFile))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+	conn, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	prefix := cfg.SubjectPrefix
+	if prefix == "" {
+		prefix = "cdc"
+	}
+	if cfg.Stream != "" {
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:       cfg.Stream,
+			Subjects:   []string{prefix + ".>"},
+			Duplicates: cfg.DuplicateWindow,
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create stream %s: %w", cfg.Stream, err)
+		}
+	}
+
+	ackTimeout := cfg.AckTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = 10 * time.Second
+	}
+	return &NatsSink{
+		conn:       conn,
+		js:         js,
+		pipeline:   pipeline,
+		prefix:     prefix,
+		ackTimeout: ackTimeout,
+	}, nil
+}
+
+// Write publishes the batch asynchronously and waits for every publish ack,
+// so the batch is only acknowledged (and checkpointed) once the stream
+// stored it.
+func (s *NatsSink) Write(ctx context.Context, batch *types.Batch) error {
+	ctx, cancel := context.WithTimeout(ctx, s.ackTimeout)
+	defer cancel()
+
+	var futures []jetstream.PubAckFuture
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		data, err := encodeChangeJSON(e)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+		}
+		msg := nats.NewMsg(s.subject(e))
+		msg.Data = data
+		msg.Header.Set("op", string(e.Type))
+		msg.Header.Set("lsn", e.LSN.String())
+
+		f, err := s.js.PublishMsgAsync(msg, jetstream.WithMsgID(natsMsgID(s.pipeline, e)))
+		if err != nil {
+			return fmt.Errorf("nats publish to %s failed: %w", msg.Subject, err)
+		}
+		futures = append(futures, f)
+	}
+
+	var errs []error
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+			s.addBytes(len(f.Msg().Data))
+		case err := <-f.Err():
+			errs = append(errs, fmt.Errorf("nats publish to %s failed: %w", f.Msg().Subject, err))
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for nats publish acks: %w", ctx.Err())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// subject builds "<prefix>.<schema>.<table>.<op>". Characters with a meaning
+// in subjects are replaced so every name stays a single token.
+func (s *NatsSink) subject(e *types.Event) string {
+	return s.prefix + "." + natsToken(e.Schema) + "." + natsToken(e.Table) + "." + strings.ToLower(string(e.Type))
+}
+
+var natsTokenReplacer = strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_")
+
+func natsToken(name string) string {
+	return natsTokenReplacer.Replace(name)
+}
+
+// natsMsgID is the deduplication ID of a change. The LSN alone is not
+// unique: every row of a snapshot shares one, and pipelines reading other
+// databases reuse it.
+func natsMsgID(pipeline string, e *types.Event) string {
+	return fmt.Sprintf("%s:%s.%s:%s:%016X", pipeline, e.Schema, e.Table, documentID(e.Identity), uint64(e.LSN))
+}
+
+func (s *NatsSink) Close() error {
+	s.conn.Close()
+	return nil
+}
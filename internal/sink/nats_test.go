@@ -0,0 +1,213 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func startNatsServer(t *testing.T) *server.Server {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("Failed to create nats server: %v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestNatsSink(t *testing.T) {
+	srv := startNatsServer(t)
+	ctx := context.Background()
+
+	s, err := NewNatsSink(ctx, config.NATSTarget{
+		TargetBase: config.TargetBase{Name: "nats"},
+		URL:        srv.ClientURL(),
+		Stream:     "CDC",
+	}, "orders")
+	if err != nil {
+		t.Fatalf("Failed to create nats sink: %v", err)
+	}
+	defer s.Close()
+
+	events := []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1)}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 10},
+		{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1)}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 11},
+		{Type: types.EventDelete, Schema: "public", Table: "order.items", Identity: map[string]interface{}{"id": int64(3)}, LSN: 12},
+	}
+	if err := s.Write(ctx, &types.Batch{Events: events}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// A retried batch is dropped by the stream's deduplication
+	if err := s.Write(ctx, &types.Batch{Events: events}); err != nil {
+		t.Fatalf("Retried write failed: %v", err)
+	}
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("Failed to create jetstream context: %v", err)
+	}
+	stream, err := js.Stream(ctx, "CDC")
+	if err != nil {
+		t.Fatalf("Failed to get stream: %v", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stream info: %v", err)
+	}
+	if info.State.Msgs != 3 {
+		t.Errorf("Expected 3 messages after deduplication, got %d", info.State.Msgs)
+	}
+
+	tests := []struct {
+		seq     uint64
+		subject string
+		op      string
+	}{
+		{1, "cdc.public.users.insert", "INSERT"},
+		{2, "cdc.public.users.update", "UPDATE"},
+		{3, "cdc.public.order_items.delete", "DELETE"},
+	}
+	for _, tt := range tests {
+		msg, err := stream.GetMsg(ctx, tt.seq)
+		if err != nil {
+			t.Fatalf("Failed to get message %d: %v", tt.seq, err)
+		}
+		if msg.Subject != tt.subject {
+			t.Errorf("Expected subject %s, got %s", tt.subject, msg.Subject)
+		}
+		var rec changeRecord
+		if err := json.Unmarshal(msg.Data, &rec); err != nil {
+			t.Fatalf("Invalid message %s: %v", msg.Data, err)
+		}
+		if rec.Op != tt.op || msg.Header.Get("op") != tt.op {
+			t.Errorf("Expected op %s, got %s (header %s)", tt.op, rec.Op, msg.Header.Get("op"))
+		}
+		if msg.Header.Get(jetstream.MsgIDHeader) == "" {
+			t.Error("Expected a deduplication ID")
+		}
+	}
+}
+
+func TestNatsSinkNoStream(t *testing.T) {
+	srv := startNatsServer(t)
+
+	s, err := NewNatsSink(context.Background(), config.NATSTarget{
+		TargetBase: config.TargetBase{Name: "nats"},
+		URL:        srv.ClientURL(),
+		AckTimeout: time.Second,
+	}, "orders")
+	if err != nil {
+		t.Fatalf("Failed to create nats sink: %v", err)
+	}
+	defer s.Close()
+
+	// Without a stream capturing the subject the publish is not acknowledged,
+	// so the batch must fail rather than be checkpointed.
+	batch := &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 10},
+	}}
+	if err := s.Write(context.Background(), batch); err == nil {
+		t.Error("Expected error without a stream")
+	}
+}
+
+func TestNatsSinkSnapshotRows(t *testing.T) {
+	srv := startNatsServer(t)
+	ctx := context.Background()
+
+	s, err := NewNatsSink(ctx, config.NATSTarget{
+		TargetBase: config.TargetBase{Name: "nats"},
+		URL:        srv.ClientURL(),
+		Stream:     "CDC",
+	}, "orders")
+	if err != nil {
+		t.Fatalf("Failed to create nats sink: %v", err)
+	}
+	defer s.Close()
+
+	// Snapshot rows share one LSN; each must still be stored
+	var events []*types.Event
+	for id := int64(1); id <= 3; id++ {
+		events = append(events, &types.Event{Type: types.EventInsert, Schema: "public", Table: "users", LSN: 10, Snapshot: true,
+			Columns: map[string]interface{}{"id": id}, Identity: map[string]interface{}{"id": id}})
+	}
+	if err := s.Write(ctx, &types.Batch{Events: events}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	js, err := jetstream.New(s.conn)
+	if err != nil {
+		t.Fatalf("Failed to create jetstream context: %v", err)
+	}
+	stream, err := js.Stream(ctx, "CDC")
+	if err != nil {
+		t.Fatalf("Failed to get stream: %v", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stream info: %v", err)
+	}
+	if info.State.Msgs != 3 {
+		t.Errorf("Expected 3 snapshot messages, got %d", info.State.Msgs)
+	}
+}
+
+func TestNatsSinkPipelinesShareStream(t *testing.T) {
+	srv := startNatsServer(t)
+	ctx := context.Background()
+
+	// Two pipelines reading different databases see the same LSNs
+	var sinks []*NatsSink
+	for _, pipeline := range []string{"eu", "us"} {
+		s, err := NewNatsSink(ctx, config.NATSTarget{
+			TargetBase: config.TargetBase{Name: "nats"},
+			URL:        srv.ClientURL(),
+			Stream:     "CDC",
+		}, pipeline)
+		if err != nil {
+			t.Fatalf("Failed to create nats sink: %v", err)
+		}
+		defer s.Close()
+		sinks = append(sinks, s)
+	}
+	for _, s := range sinks {
+		batch := &types.Batch{Events: []*types.Event{{Type: types.EventInsert, Schema: "public", Table: "users", LSN: 10,
+			Columns: map[string]interface{}{"id": int64(1)}, Identity: map[string]interface{}{"id": int64(1)}}}}
+		if err := s.Write(ctx, batch); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	js, err := jetstream.New(sinks[0].conn)
+	if err != nil {
+		t.Fatalf("Failed to create jetstream context: %v", err)
+	}
+	stream, err := js.Stream(ctx, "CDC")
+	if err != nil {
+		t.Fatalf("Failed to get stream: %v", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stream info: %v", err)
+	}
+	if info.State.Msgs != 2 {
+		t.Errorf("Expected a message per pipeline, got %d", info.State.Msgs)
+	}
+}
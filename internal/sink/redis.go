@@ -1,108 +1,451 @@
 package sink
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"sync/atomic"
 	"text/template"
 	"time"
 
 	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/debezium"
+	"github.com/nikolay-makurin/replicator/internal/keytemplate"
 	"github.com/nikolay-makurin/replicator/pkg/types"
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisSink struct {
-	client     *redis.Client
-	keyTmpl    *template.Template
+	client       redis.UniversalClient
+	cluster      bool
+	keyTmpl      *template.Template
+	expiration   time.Duration
+	mode         string
+	streamMaxLen int64
+	envelope     *debezium.Encoder // Stream entry layout; nil for native fields
+	versionGuard bool
+	tombstoneTTL time.Duration // Expiration of the LSN of a deleted row without ttl
+	tables       map[string]redisTable
+	channelTmpl  *template.Template // nil disables notifications
+	publishRow   bool
+
+	scriptsLoaded atomic.Bool
+}
+
+// redisNotification is the change message published on the notification
+// channel.
+type redisNotification struct {
+	Op     types.EventType        `json:"op"`
+	Schema string                 `json:"schema"`
+	Table  string                 `json:"table"`
+	Key    string                 `json:"key"`
+	LSN    string                 `json:"lsn"`
+	Row    map[string]interface{} `json:"row,omitempty"`
+}
+
+// redisTable holds the per-table settings of a RedisSink.
+type redisTable struct {
+	keyTmpl    *template.Template // nil uses the target key pattern
 	expiration time.Duration
+	indexes    []redisIndex
+}
+
+type redisIndex struct {
+	keyTmpl *template.Template
+	typ     string
+	score   string
 }
 
 func NewRedisSink(cfg config.RedisTarget) (*RedisSink, error) {
-	opt, err := redis.ParseURL(cfg.ConnectionString)
+	client, err := newRedisClient(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("invalid redis connection string: %w", err)
+		return nil, err
 	}
+	_, cluster := client.(*redis.ClusterClient)
 
-	client := redis.NewClient(opt)
+	mode := cfg.Mode
+	switch mode {
+	case "":
+		mode = config.RedisModeString
+	case config.RedisModeString, config.RedisModeHash, config.RedisModeJSON, config.RedisModeStream:
+	default:
+		client.Close()
+		return nil, fmt.Errorf("invalid redis mode %q", cfg.Mode)
+	}
 
 	// Parse key pattern template
-	tmpl, err := template.New("key").Parse(cfg.KeyPattern)
+	tmpl, err := keytemplate.Parse("key", cfg.KeyPattern)
 	if err != nil {
+		client.Close()
 		return nil, fmt.Errorf("invalid key pattern: %w", err)
 	}
 
+	var channelTmpl *template.Template
+	if cfg.PublishChannel != "" {
+		channelTmpl, err = keytemplate.Parse("channel", cfg.PublishChannel)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("invalid publish channel pattern: %w", err)
+		}
+	}
+
+	tables := make(map[string]redisTable, len(cfg.Tables))
+	for table, tc := range cfg.Tables {
+		rt := redisTable{expiration: tc.TTL}
+		if tc.KeyPattern != "" {
+			if rt.keyTmpl, err = keytemplate.Parse("key", tc.KeyPattern); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("invalid key pattern for table %s: %w", table, err)
+			}
+		}
+		for i, idx := range tc.Indexes {
+			idxTmpl, err := keytemplate.Parse("index", idx.KeyPattern)
+			if err != nil {
+				client.Close()
+				return nil, fmt.Errorf("invalid index key pattern for table %s: %w", table, err)
+			}
+			typ := idx.Type
+			switch typ {
+			case "":
+				typ = "set"
+			case "set", "zset":
+			default:
+				client.Close()
+				return nil, fmt.Errorf("invalid index type %q for table %s index %d", idx.Type, table, i)
+			}
+			rt.indexes = append(rt.indexes, redisIndex{keyTmpl: idxTmpl, typ: typ, score: idx.Score})
+		}
+		tables[table] = rt
+	}
+
 	return &RedisSink{
-		client:     client,
-		keyTmpl:    tmpl,
-		expiration: 0, // No expiration by default
+		client:       client,
+		cluster:      cluster,
+		keyTmpl:      tmpl,
+		expiration:   cfg.TTL,
+		mode:         mode,
+		streamMaxLen: cfg.StreamMaxLen,
+		envelope:     newEnvelopeEncoder(cfg.Envelope),
+		versionGuard: cfg.VersionGuard,
+		tombstoneTTL: cfg.TombstoneTTL,
+		tables:       tables,
+		channelTmpl:  channelTmpl,
+		publishRow:   cfg.PublishRow,
 	}, nil
 }
 
+// newRedisClient connects to a standalone node from the connection string,
+// or to a cluster or sentinel-monitored master from the listed addresses.
+func newRedisClient(cfg config.RedisTarget) (redis.UniversalClient, error) {
+	if len(cfg.Addrs) == 0 {
+		opt, err := redis.ParseURL(cfg.ConnectionString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis connection string: %w", err)
+		}
+		return redis.NewClient(opt), nil
+	}
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:            cfg.Addrs,
+		IsClusterMode:    cfg.Cluster,
+		MasterName:       cfg.MasterName,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelPassword: cfg.SentinelPassword,
+		DB:               cfg.DB,
+		MaxRedirects:     cfg.MaxRedirects,
+	}), nil
+}
+
 func (s *RedisSink) Write(ctx context.Context, batch *types.Batch) error {
 	slog.Info("RedisSink received batch", "count", len(batch.Events))
+
+	// Scripts are loaded on first use, and again after Redis reports them
+	// missing, e.g. after a restart
+	if (s.versionGuard || s.hasIndexes()) && !s.scriptsLoaded.Load() {
+		if err := s.loadScripts(ctx); err != nil {
+			return err
+		}
+		s.scriptsLoaded.Store(true)
+	}
+
+	// A cluster pipeline is split per node by hash slot and follows
+	// MOVED/ASK redirects; other errors surface to RetrySink.
 	pipe := s.client.Pipeline()
+	var indexUpdates []*indexUpdate
 
 	for _, e := range batch.Events {
-		// Only handle INSERT and UPDATE for now (SET)
-		// DELETE could be DEL
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+
+		// Deletes only carry the identity columns
+		row := e.Columns
 		if e.Type == types.EventDelete {
+			row = e.Identity
+		}
+
 		// Build template data including table name
 		templateData := make(map[string]interface{})
-		for k, v := range e.Identity {
+		for k, v := range row {
 			templateData[k] = v
 		}
 		templateData["table"] = e.Table
 		templateData["schema"] = e.Schema
 
-		key, err := s.generateKey(templateData)
+		// A change whose key cannot be built, e.g. a delete whose identity
+		// lacks a key column, fails the batch before any of it is sent;
+		// retrying cannot fix it, so it waits for the change to be skipped
+		key, err := s.generateKey(e, templateData)
 		if err != nil {
-			return err
+			return Permanent(err)
+		}
+
+		var channel string
+		var n []byte
+		if s.channelTmpl != nil {
+			if channel, n, err = s.notification(templateData, key, e); err != nil {
+				return Permanent(err)
+			}
+		}
+
+		ttl := s.ttl(e.Table)
+		var queueErr error
+		switch {
+		case s.mode == config.RedisModeStream:
+			queueErr = s.queueStream(ctx, pipe, key, e)
+		case s.versionGuard:
+			// The guard script publishes the notification itself
+			queueErr = s.queueGuarded(ctx, pipe, key, e, ttl, channel, n)
+			channel = ""
+		case s.mode == config.RedisModeHash:
+			queueErr = s.queueHash(ctx, pipe, key, e, ttl)
+		case s.mode == config.RedisModeJSON:
+			queueErr = s.queueJSON(ctx, pipe, key, e, ttl)
+		default:
+			queueErr = s.queueString(ctx, pipe, key, e, ttl)
+		}
+		if queueErr != nil {
+			return queueErr
 		}
+		if channel != "" {
+			pipe.Publish(ctx, channel, n)
+		}
+
+		if indexes := s.tables[e.Table].indexes; len(indexes) > 0 && s.mode != config.RedisModeStream {
+			update, err := s.queueIndexes(ctx, pipe, key, e, indexes, ttl)
+			if err != nil {
+				return err
+			}
+			if update != nil {
+				indexUpdates = append(indexUpdates, update)
+			}
+		}
+	}
+
+	cmds, err := pipe.Exec(ctx)
+	if err != nil {
+		s.checkScripts(cmds)
+		return fmt.Errorf("redis pipeline failed: %w", err)
+	}
+
+	if len(indexUpdates) > 0 {
+		return s.applyIndexes(ctx, indexUpdates)
+	}
+	return nil
+}
+
+// queueString stores the whole row as a JSON string.
+func (s *RedisSink) queueString(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event, ttl time.Duration) error {
+	if e.Type == types.EventDelete {
 		pipe.Del(ctx, key)
-		continue
+		return nil
+	}
+	data, err := json.Marshal(e.Columns)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event data: %w", err)
 	}
+	pipe.Set(ctx, key, data, ttl)
+	return nil
+}
 
-		// For Insert/Update, we store the whole row as JSON
-		// Build template data including table name
-		templateData := make(map[string]interface{})
-		for k, v := range e.Columns {
-			templateData[k] = v
+// queueHash stores one hash field per column, so that updates carrying a
+// subset of columns merge into the existing hash. NULL columns are removed.
+func (s *RedisSink) queueHash(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event, ttl time.Duration) error {
+	if e.Type == types.EventDelete {
+		pipe.Del(ctx, key)
+		return nil
+	}
+	fields := make(map[string]interface{}, len(e.Columns))
+	var nulls []string
+	for col, v := range e.Columns {
+		if v == nil {
+			nulls = append(nulls, col)
+			continue
 		}
-		templateData["table"] = e.Table
-		templateData["schema"] = e.Schema
-
-		key, err := s.generateKey(templateData)
+		fv, err := redisFieldValue(v)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to encode column %s: %w", col, err)
 		}
+		fields[col] = fv
+	}
+	if len(nulls) > 0 {
+		pipe.HDel(ctx, key, nulls...)
+	}
+	if len(fields) > 0 {
+		pipe.HSet(ctx, key, fields)
+	}
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	}
+	return nil
+}
 
+// queueJSON stores the row as a RedisJSON document.
+func (s *RedisSink) queueJSON(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event, ttl time.Duration) error {
+	if e.Type == types.EventDelete {
+		pipe.Del(ctx, key)
+		return nil
+	}
+	data, err := json.Marshal(e.Columns)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event data: %w", err)
+	}
+	pipe.JSONSet(ctx, key, "$", data)
+	if ttl > 0 {
+		pipe.PExpire(ctx, key, ttl)
+	}
+	return nil
+}
+
+// queueStream appends a change record to the stream named by key.
+func (s *RedisSink) queueStream(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event) error {
+	if s.envelope != nil {
+		return s.queueEnvelope(ctx, pipe, key, e)
+	}
+	values := map[string]interface{}{
+		"op":     string(e.Type),
+		"schema": e.Schema,
+		"table":  e.Table,
+		"lsn":    e.LSN.String(),
+		"ts":     e.Timestamp.UnixMilli(),
+	}
+	if e.Columns != nil {
 		data, err := json.Marshal(e.Columns)
 		if err != nil {
 			return fmt.Errorf("failed to marshal event data: %w", err)
 		}
+		values["data"] = data
+	}
+	if e.Identity != nil {
+		identity, err := json.Marshal(e.Identity)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event identity: %w", err)
+		}
+		values["identity"] = identity
+	}
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: s.streamMaxLen,
+		Approx: true,
+		Values: values,
+	})
+	return nil
+}
 
-		pipe.Set(ctx, key, data, s.expiration)
+// queueEnvelope appends a Debezium change event to the stream named by
+// key, with the row identity as "key" and the envelope as "value" field.
+func (s *RedisSink) queueEnvelope(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event) error {
+	value, err := s.envelope.Encode(e)
+	if err != nil {
+		return err
 	}
+	identity, err := json.Marshal(e.Identity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event identity: %w", err)
+	}
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: key,
+		MaxLen: s.streamMaxLen,
+		Approx: true,
+		Values: []interface{}{"key", identity, "value", value},
+	})
+	return nil
+}
 
-	_, err := pipe.Exec(ctx)
+// notification renders the channel and change message of an event.
+func (s *RedisSink) notification(data map[string]interface{}, key string, e *types.Event) (string, []byte, error) {
+	channel, err := keytemplate.Execute(s.channelTmpl, data)
 	if err != nil {
-		return fmt.Errorf("redis pipeline failed: %w", err)
+		return "", nil, fmt.Errorf("cannot build publish channel for %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+	}
+	msg := redisNotification{
+		Op:     e.Type,
+		Schema: e.Schema,
+		Table:  e.Table,
+		Key:    key,
+		LSN:    e.LSN.String(),
+	}
+	if s.publishRow && e.Type != types.EventDelete {
+		msg.Row = e.Columns
 	}
+	n, err := json.Marshal(msg)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal change notification: %w", err)
+	}
+	return channel, n, nil
+}
 
-	return nil
+// ttl returns the key expiration for a table.
+func (s *RedisSink) ttl(table string) time.Duration {
+	if t, ok := s.tables[table]; ok && t.expiration > 0 {
+		return t.expiration
+	}
+	return s.expiration
+}
+
+func (s *RedisSink) hasIndexes() bool {
+	for _, t := range s.tables {
+		if len(t.indexes) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *RedisSink) Close() error {
 	return s.client.Close()
 }
 
-func (s *RedisSink) generateKey(data map[string]interface{}) (string, error) {
-	var buf bytes.Buffer
-	if err := s.keyTmpl.Execute(&buf, data); err != nil {
-		return "", fmt.Errorf("failed to execute key template: %w", err)
+// generateKey renders the key of an event's row. An event whose key cannot
+// be built, because a column is missing or NULL, is rejected rather than
+// written to a wrong key.
+func (s *RedisSink) generateKey(e *types.Event, data map[string]interface{}) (string, error) {
+	tmpl := s.keyTmpl
+	if t := s.tables[e.Table].keyTmpl; t != nil {
+		tmpl = t
+	}
+	key, err := keytemplate.Execute(tmpl, data)
+	if err != nil {
+		return "", fmt.Errorf("cannot build redis key for %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+	}
+	return key, nil
+}
+
+// redisFieldValue renders a column value as a hash field value.
+func redisFieldValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string, []byte, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return x, nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	case time.Time:
+		return x.Format(time.RFC3339Nano), nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
 	}
-	return buf.String(), nil
+	return data, nil
 }
@@ -0,0 +1,413 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/keytemplate"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/redis/go-redis/v9"
+)
+
+// guardScript applies a write only if it is not older than the LSN stored
+// next to the value in "{<key>}:lsn". The LSN key outlives deletes as a
+// tombstone, so a replayed older insert cannot resurrect a deleted row; it
+// expires after the tombstone TTL.
+//
+// The change notification is published by the script, so a skipped write
+// is not announced.
+//
+// KEYS[1] value key, KEYS[2] LSN key
+// ARGV[1] LSN as 16 hex digits, ARGV[2] TTL in ms (0 = none; for DEL the
+// tombstone's TTL),
+// ARGV[3] notification channel ("" = none), ARGV[4] notification message,
+// ARGV[5] SET, JSON.SET, HSET or DEL, ARGV[6...] operation arguments:
+// the value for SET and JSON.SET; for HSET the number of NULL fields,
+// the NULL fields, then field/value pairs.
+var guardScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[2])
+if cur and cur > ARGV[1] then
+  return 0
+end
+local op = ARGV[5]
+if op == 'DEL' then
+  redis.call('DEL', KEYS[1])
+elseif op == 'SET' then
+  redis.call('SET', KEYS[1], ARGV[6])
+elseif op == 'JSON.SET' then
+  redis.call('JSON.SET', KEYS[1], '$', ARGV[6])
+elseif op == 'HSET' then
+  local n = tonumber(ARGV[6])
+  if n > 0 then
+    redis.call('HDEL', KEYS[1], unpack(ARGV, 7, 6 + n))
+  end
+  if #ARGV > 6 + n then
+    redis.call('HSET', KEYS[1], unpack(ARGV, 7 + n))
+  end
+end
+redis.call('SET', KEYS[2], ARGV[1])
+local ttl = tonumber(ARGV[2])
+if ttl > 0 then
+  if op ~= 'DEL' then
+    redis.call('PEXPIRE', KEYS[1], ttl)
+  end
+  redis.call('PEXPIRE', KEYS[2], ttl)
+end
+if ARGV[3] ~= '' then
+  redis.call('PUBLISH', ARGV[3], ARGV[4])
+end
+return 1
+`)
+
+// indexScript moves a row key between secondary index sets. The index keys
+// a row is currently in are kept in the hash "{<key>}:idx" (index key -> type),
+// so an update removes the row from indexes whose value changed.
+//
+// In cluster mode index keys live in other slots, so the script only updates
+// "{<key>}:idx" and returns the index key/type pairs the row left; the caller
+// then updates the sets. Until the caller confirms the removals with
+// unindexScript they stay in "{<key>}:idx" with their type prefixed by "-",
+// and are returned again, so a retried write removes them too. It returns
+// 0 if the version guard skipped the write.
+//
+// With a TTL, index sets expire along with the last row added to them, so
+// the members of expired rows do not outlive the set.
+//
+// KEYS[1] "{<key>}:idx", KEYS[2] LSN key (checked only if ARGV[2] is set)
+// ARGV[1] row key, ARGV[2] LSN or "", ARGV[3] TTL in ms (0 = none),
+// ARGV[4] "1" to update the index sets, ARGV[5...] index key, type
+// (set or zset), score triples.
+var indexScript = redis.NewScript(`
+if ARGV[2] ~= '' then
+  local cur = redis.call('GET', KEYS[2])
+  if cur and cur > ARGV[2] then
+    return 0
+  end
+end
+local apply = ARGV[4] == '1'
+local ttl = tonumber(ARGV[3])
+local new = {}
+for i = 5, #ARGV, 3 do
+  new[ARGV[i]] = true
+end
+local removed = {}
+local old = redis.call('HGETALL', KEYS[1])
+for i = 1, #old, 2 do
+  if not new[old[i]] then
+    local typ = string.gsub(old[i + 1], '^-', '')
+    if not apply then
+      table.insert(removed, old[i])
+      table.insert(removed, typ)
+    elseif typ == 'zset' then
+      redis.call('ZREM', old[i], ARGV[1])
+    else
+      redis.call('SREM', old[i], ARGV[1])
+    end
+  end
+end
+redis.call('DEL', KEYS[1])
+for i = 1, #removed, 2 do
+  redis.call('HSET', KEYS[1], removed[i], '-' .. removed[i + 1])
+end
+for i = 5, #ARGV, 3 do
+  if apply then
+    if ARGV[i + 1] == 'zset' then
+      redis.call('ZADD', ARGV[i], ARGV[i + 2], ARGV[1])
+    else
+      redis.call('SADD', ARGV[i], ARGV[1])
+    end
+    if ttl > 0 then
+      redis.call('PEXPIRE', ARGV[i], ttl)
+    end
+  end
+  redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+if ttl > 0 and #ARGV >= 5 then
+  redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return removed
+`)
+
+// unindexScript forgets the index keys ARGV that a row left once the
+// caller removed it from them, unless a later write added it back.
+//
+// KEYS[1] "{<key>}:idx"
+var unindexScript = redis.NewScript(`
+for i = 1, #ARGV do
+  local typ = redis.call('HGET', KEYS[1], ARGV[i])
+  if typ and string.sub(typ, 1, 1) == '-' then
+    redis.call('HDEL', KEYS[1], ARGV[i])
+  end
+end
+return 1
+`)
+
+// indexUpdate is the index maintenance of one row that the caller finishes
+// after the pipeline ran, in cluster mode.
+type indexUpdate struct {
+	cmd    *redis.Cmd
+	member string
+	add    []indexEntry
+	ttl    time.Duration
+}
+
+type indexEntry struct {
+	key   string
+	typ   string
+	score float64
+}
+
+func (s *RedisSink) loadScripts(ctx context.Context) error {
+	if err := guardScript.Load(ctx, s.client).Err(); err != nil {
+		return fmt.Errorf("failed to load redis version guard script: %w", err)
+	}
+	if err := indexScript.Load(ctx, s.client).Err(); err != nil {
+		return fmt.Errorf("failed to load redis index script: %w", err)
+	}
+	if err := unindexScript.Load(ctx, s.client).Err(); err != nil {
+		return fmt.Errorf("failed to load redis unindex script: %w", err)
+	}
+	return nil
+}
+
+// checkScripts has the scripts loaded again by the next Write if cmds
+// failed because Redis no longer has them.
+func (s *RedisSink) checkScripts(cmds []redis.Cmder) {
+	for _, cmd := range cmds {
+		if redis.HasErrorPrefix(cmd.Err(), "NOSCRIPT") {
+			s.scriptsLoaded.Store(false)
+			return
+		}
+	}
+}
+
+// lsnArg renders an LSN so that string comparison in Lua orders it.
+func lsnArg(lsn types.LSN) string {
+	return fmt.Sprintf("%016X", uint64(lsn))
+}
+
+// queueGuarded queues a version-guarded write of the row in the sink's mode,
+// publishing the notification n on channel if the write is applied.
+func (s *RedisSink) queueGuarded(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event, ttl time.Duration, channel string, n []byte) error {
+	if e.Type == types.EventDelete && ttl == 0 {
+		ttl = s.tombstoneTTL
+	}
+	args := []interface{}{lsnArg(e.LSN), ttl.Milliseconds(), channel, n}
+
+	switch {
+	case e.Type == types.EventDelete:
+		args = append(args, "DEL")
+	case s.mode == config.RedisModeHash:
+		var nulls, pairs []interface{}
+		for col, v := range e.Columns {
+			if v == nil {
+				nulls = append(nulls, col)
+				continue
+			}
+			fv, err := redisFieldValue(v)
+			if err != nil {
+				return fmt.Errorf("failed to encode column %s: %w", col, err)
+			}
+			pairs = append(pairs, col, fv)
+		}
+		args = append(args, "HSET", len(nulls))
+		args = append(args, nulls...)
+		args = append(args, pairs...)
+	default:
+		data, err := json.Marshal(e.Columns)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event data: %w", err)
+		}
+		op := "SET"
+		if s.mode == config.RedisModeJSON {
+			op = "JSON.SET"
+		}
+		args = append(args, op, data)
+	}
+
+	pipe.EvalSha(ctx, guardScript.Hash(), []string{key, sideKey(key, "lsn")}, args...)
+	return nil
+}
+
+// queueIndexes queues the secondary index maintenance of a row. In cluster
+// mode it returns the update to finish with applyIndexes.
+func (s *RedisSink) queueIndexes(ctx context.Context, pipe redis.Pipeliner, key string, e *types.Event, indexes []redisIndex, ttl time.Duration) (*indexUpdate, error) {
+	lsn := ""
+	if s.versionGuard {
+		lsn = lsnArg(e.LSN)
+	}
+	apply := "1"
+	if s.cluster {
+		apply = "0"
+	}
+	args := []interface{}{key, lsn, ttl.Milliseconds(), apply}
+	update := &indexUpdate{member: key, ttl: ttl}
+
+	// A deleted row is removed from every index
+	if e.Type != types.EventDelete {
+		data := make(map[string]interface{}, len(e.Columns)+2)
+		for k, v := range e.Columns {
+			data[k] = v
+		}
+		data["table"] = e.Table
+		data["schema"] = e.Schema
+
+		for _, idx := range indexes {
+			idxKey, err := keytemplate.Execute(idx.keyTmpl, data)
+			// Rows whose indexed column is NULL are not indexed
+			if errors.Is(err, keytemplate.ErrNullValue) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("cannot build redis index key for %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err)
+			}
+			score, err := indexScore(idx, e)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, idxKey, idx.typ, score)
+			update.add = append(update.add, indexEntry{key: idxKey, typ: idx.typ, score: score})
+		}
+	}
+
+	update.cmd = pipe.EvalSha(ctx, indexScript.Hash(), []string{sideKey(key, "idx"), sideKey(key, "lsn")}, args...)
+	if !s.cluster {
+		return nil, nil
+	}
+	return update, nil
+}
+
+// applyIndexes updates the index sets after the index script ran in cluster
+// mode, where one script cannot reach keys in other slots, then confirms
+// the removals.
+func (s *RedisSink) applyIndexes(ctx context.Context, updates []*indexUpdate) error {
+	pipe := s.client.Pipeline()
+	confirm := s.client.Pipeline()
+	for _, u := range updates {
+		removed, ok := u.cmd.Val().([]interface{})
+		if !ok {
+			continue // Skipped by the version guard
+		}
+		var left []interface{}
+		for i := 0; i+1 < len(removed); i += 2 {
+			key, _ := removed[i].(string)
+			if typ, _ := removed[i+1].(string); typ == "zset" {
+				pipe.ZRem(ctx, key, u.member)
+			} else {
+				pipe.SRem(ctx, key, u.member)
+			}
+			left = append(left, key)
+		}
+		if len(left) > 0 {
+			confirm.EvalSha(ctx, unindexScript.Hash(), []string{sideKey(u.member, "idx")}, left...)
+		}
+		for _, a := range u.add {
+			if a.typ == "zset" {
+				pipe.ZAdd(ctx, a.key, redis.Z{Score: a.score, Member: u.member})
+			} else {
+				pipe.SAdd(ctx, a.key, u.member)
+			}
+			if u.ttl > 0 {
+				pipe.PExpire(ctx, a.key, u.ttl)
+			}
+		}
+	}
+	if pipe.Len() == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("redis index update failed: %w", err)
+	}
+	if confirm.Len() == 0 {
+		return nil
+	}
+	if cmds, err := confirm.Exec(ctx); err != nil {
+		s.checkScripts(cmds)
+		return fmt.Errorf("redis index update failed: %w", err)
+	}
+	return nil
+}
+
+// sideKey names a key stored next to key, such as its LSN, in the same
+// cluster slot so that both can be used by one script. A key with a hash
+// tag shares it; otherwise Redis hashes the whole key, which is used as the
+// tag if it can be one.
+func sideKey(key, suffix string) string {
+	if tag := hashTag(key); tag != key {
+		return key + ":" + suffix
+	}
+	if !strings.Contains(key, "}") {
+		return "{" + key + "}:" + suffix
+	}
+	// No tag can contain '}'; use another tag that maps to the same slot
+	return "{" + slotTag(keySlot(key)) + "}:" + key + ":" + suffix
+}
+
+// hashTag returns the part of key Redis Cluster hashes: the text between
+// the first '{' and the next '}' if that is not empty, otherwise key.
+func hashTag(key string) string {
+	if open := strings.IndexByte(key, '{'); open >= 0 {
+		if end := strings.IndexByte(key[open+1:], '}'); end > 0 {
+			return key[open+1 : open+1+end]
+		}
+	}
+	return key
+}
+
+// keySlot returns the cluster slot of key.
+func keySlot(key string) uint16 {
+	var crc uint16 // CRC16/XMODEM
+	for _, b := range []byte(hashTag(key)) {
+		crc ^= uint16(b) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+var slotTags sync.Map // slot -> tag
+
+// slotTag returns a short hash tag that maps to slot.
+func slotTag(slot uint16) string {
+	if tag, ok := slotTags.Load(slot); ok {
+		return tag.(string)
+	}
+	for n := 0; ; n++ {
+		if tag := strconv.Itoa(n); keySlot(tag) == slot {
+			slotTags.Store(slot, tag)
+			return tag
+		}
+	}
+}
+
+// indexScore returns the sorted set score of a row: the score column if
+// configured, otherwise the commit time in milliseconds.
+func indexScore(idx redisIndex, e *types.Event) (float64, error) {
+	if idx.typ != "zset" {
+		return 0, nil
+	}
+	v, ok := e.Columns[idx.score]
+	if idx.score == "" || !ok || v == nil {
+		return float64(e.Timestamp.UnixMilli()), nil
+	}
+	if t, ok := v.(time.Time); ok {
+		return float64(t.UnixMilli()), nil
+	}
+	f, err := strconv.ParseFloat(numberString(v), 64)
+	if err != nil {
+		return 0, fmt.Errorf("index score column %s: cannot convert %v (%T) to a number", idx.score, v, v)
+	}
+	return f, nil
+}
@@ -0,0 +1,466 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisSink(t *testing.T, cfg config.RedisTarget) (*RedisSink, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	cfg.ConnectionString = "redis://" + mr.Addr()
+	if cfg.KeyPattern == "" {
+		cfg.KeyPattern = "{{.table}}:{{.id}}"
+	}
+	s, err := NewRedisSink(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create redis sink: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, mr
+}
+
+func TestRedisSinkModes(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("string mode sets and deletes json rows", func(t *testing.T) {
+		s, mr := newTestRedisSink(t, config.RedisTarget{})
+		err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+			{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "a"}},
+			{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(2), "name": "b"}},
+			{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(2)}},
+		}})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if got, _ := mr.Get("users:1"); got != `{"id":1,"name":"a"}` {
+			t.Errorf("Unexpected value for users:1: %s", got)
+		}
+		if mr.Exists("users:2") {
+			t.Error("Expected users:2 to be deleted")
+		}
+	})
+
+	t.Run("hash mode merges partial updates", func(t *testing.T) {
+		s, mr := newTestRedisSink(t, config.RedisTarget{Mode: config.RedisModeHash})
+		err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+			{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "a", "email": "a@x"}},
+			{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "b", "email": nil}},
+		}})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if got := mr.HGet("users:1", "name"); got != "b" {
+			t.Errorf("Expected name b, got %q", got)
+		}
+		if got := mr.HGet("users:1", "id"); got != "1" {
+			t.Errorf("Expected id 1, got %q", got)
+		}
+		if fields, _ := mr.HKeys("users:1"); len(fields) != 2 {
+			t.Errorf("Expected NULL email to be removed, got fields %v", fields)
+		}
+	})
+
+	t.Run("stream mode appends change records", func(t *testing.T) {
+		s, mr := newTestRedisSink(t, config.RedisTarget{
+			Mode:         config.RedisModeStream,
+			KeyPattern:   "changes:{{.table}}",
+			StreamMaxLen: 100,
+		})
+		err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+			{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 10},
+			{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 11},
+		}})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		entries, err := mr.Stream("changes:users")
+		if err != nil {
+			t.Fatalf("Failed to read stream: %v", err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 stream entries, got %d", len(entries))
+		}
+		if op := streamField(entries[1].Values, "op"); op != "DELETE" {
+			t.Errorf("Expected op DELETE, got %q", op)
+		}
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		if _, err := NewRedisSink(config.RedisTarget{ConnectionString: "redis://localhost:6379", Mode: "list"}); err == nil {
+			t.Error("Expected error for invalid mode")
+		}
+	})
+}
+
+func streamField(values []string, field string) string {
+	for i := 0; i+1 < len(values); i += 2 {
+		if values[i] == field {
+			return values[i+1]
+		}
+	}
+	return ""
+}
+
+func TestRedisSinkVersionGuard(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisSink(t, config.RedisTarget{VersionGuard: true, TTL: time.Minute})
+
+	write := func(e *types.Event) {
+		t.Helper()
+		if err := s.Write(ctx, &types.Batch{Events: []*types.Event{e}}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	write(&types.Event{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "v": int64(2)}, LSN: 20})
+	// Replayed older change is skipped
+	write(&types.Event{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(1), "v": int64(1)}, LSN: 10})
+	if got, _ := mr.Get("users:1"); got != `{"id":1,"v":2}` {
+		t.Errorf("Expected newer value to be kept, got %s", got)
+	}
+	if mr.TTL("users:1") != time.Minute {
+		t.Errorf("Expected TTL of 1m, got %v", mr.TTL("users:1"))
+	}
+
+	// A delete leaves the LSN behind, so an older insert cannot resurrect the row
+	write(&types.Event{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 30})
+	write(&types.Event{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "v": int64(1)}, LSN: 25})
+	if mr.Exists("users:1") {
+		t.Error("Expected users:1 to stay deleted")
+	}
+}
+
+func TestRedisSinkTombstones(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisSink(t, config.RedisTarget{VersionGuard: true, TombstoneTTL: time.Hour})
+
+	write := func(e *types.Event) {
+		t.Helper()
+		if err := s.Write(ctx, &types.Batch{Events: []*types.Event{e}}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Without a TTL the LSN lives as long as the row, and then expires
+	write(&types.Event{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 10})
+	if ttl := mr.TTL("{users:1}:lsn"); ttl != 0 {
+		t.Errorf("Expected the LSN of a live row not to expire, got %v", ttl)
+	}
+	write(&types.Event{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 20})
+	if ttl := mr.TTL("{users:1}:lsn"); ttl != time.Hour {
+		t.Errorf("Expected the tombstone to expire after 1h, got %v", ttl)
+	}
+
+	// A new row keeps its LSN again
+	write(&types.Event{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 30})
+	if ttl := mr.TTL("{users:1}:lsn"); ttl != 0 {
+		t.Errorf("Expected the LSN of a reinserted row not to expire, got %v", ttl)
+	}
+}
+
+func TestRedisSinkReloadsScripts(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestRedisSink(t, config.RedisTarget{VersionGuard: true})
+
+	batch := &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 10},
+	}}
+	if err := s.Write(ctx, batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// A restarted Redis has forgotten the scripts; the write fails once and
+	// the retry loads them again
+	if _, err := s.client.ScriptFlush(ctx).Result(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(ctx, batch); err == nil {
+		t.Fatal("Expected the write to fail without the scripts")
+	}
+	if err := s.Write(ctx, batch); err != nil {
+		t.Fatalf("Expected the retry to load the scripts, got: %v", err)
+	}
+}
+
+func TestRedisSinkIndexes(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisSink(t, config.RedisTarget{
+		Tables: map[string]config.RedisTableConfig{
+			"users": {
+				TTL: time.Hour,
+				Indexes: []config.RedisIndex{
+					{KeyPattern: "users:by_email:{{.email}}"},
+					{KeyPattern: "users:by_team:{{.team}}", Type: "zset", Score: "rank"},
+				},
+			},
+		},
+	})
+
+	err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "a@x", "team": "t1", "rank": int64(5)}},
+		{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "b@x", "team": "t1", "rank": int64(7)}},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if mr.Exists("users:by_email:a@x") {
+		t.Error("Expected old email index entry to be removed")
+	}
+	if ok, _ := mr.SIsMember("users:by_email:b@x", "users:1"); !ok {
+		t.Error("Expected users:1 in users:by_email:b@x")
+	}
+	if score, _ := mr.ZScore("users:by_team:t1", "users:1"); score != 7 {
+		t.Errorf("Expected score 7, got %v", score)
+	}
+	if mr.TTL("users:1") != time.Hour {
+		t.Errorf("Expected per-table TTL of 1h, got %v", mr.TTL("users:1"))
+	}
+	// Index sets expire with the last row added to them
+	if ttl := mr.TTL("users:by_email:b@x"); ttl != time.Hour {
+		t.Errorf("Expected the index set to expire after 1h, got %v", ttl)
+	}
+
+	err = s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(1)}},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if mr.Exists("users:by_email:b@x") || mr.Exists("users:by_team:t1") {
+		t.Error("Expected index entries to be removed on delete")
+	}
+}
+
+func TestRedisSinkTwoPhaseIndexes(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisSink(t, config.RedisTarget{
+		VersionGuard: true,
+		Tables: map[string]config.RedisTableConfig{
+			"users": {TTL: time.Hour, Indexes: []config.RedisIndex{{KeyPattern: "users:by_email:{{.email}}"}}},
+		},
+	})
+	// Index sets are updated by the client as they would be against a cluster
+	s.cluster = true
+
+	err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "a@x"}, LSN: 10},
+		{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "b@x"}, LSN: 20},
+		{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "c@x"}, LSN: 15},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if mr.Exists("users:by_email:a@x") || mr.Exists("users:by_email:c@x") {
+		t.Error("Expected only the newest index entry to remain")
+	}
+	if ok, _ := mr.SIsMember("users:by_email:b@x", "users:1"); !ok {
+		t.Error("Expected users:1 in users:by_email:b@x")
+	}
+	if ttl := mr.TTL("users:by_email:b@x"); ttl != time.Hour {
+		t.Errorf("Expected the index set to expire after 1h, got %v", ttl)
+	}
+	if !mr.Exists("{users:1}:idx") || !mr.Exists("{users:1}:lsn") {
+		t.Error("Expected side keys to share the row key's hash slot")
+	}
+}
+
+// failRemovals fails the first pipeline that removes a row from an index.
+type failRemovals struct {
+	failed bool
+}
+
+func (h *failRemovals) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *failRemovals) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h *failRemovals) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			if cmd.Name() == "srem" && !h.failed {
+				h.failed = true
+				return errors.New("connection reset")
+			}
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestRedisSinkTwoPhaseIndexesRetry(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisSink(t, config.RedisTarget{
+		VersionGuard: true,
+		Tables: map[string]config.RedisTableConfig{
+			"users": {Indexes: []config.RedisIndex{{KeyPattern: "users:by_email:{{.email}}"}}},
+		},
+	})
+	s.cluster = true
+
+	err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "a@x"}, LSN: 10},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The index update fails after the script already updated "{users:1}:idx"
+	s.client.AddHook(&failRemovals{})
+	update := &types.Batch{Events: []*types.Event{
+		{Type: types.EventUpdate, Table: "users", Columns: map[string]interface{}{"id": int64(1), "email": "b@x"}, LSN: 20},
+	}}
+	if err := s.Write(ctx, update); err == nil {
+		t.Fatal("Expected the index update to fail")
+	}
+	if err := s.Write(ctx, update); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+
+	if mr.Exists("users:by_email:a@x") {
+		t.Error("Expected the retry to remove the old index entry")
+	}
+	if ok, _ := mr.SIsMember("users:by_email:b@x", "users:1"); !ok {
+		t.Error("Expected users:1 in users:by_email:b@x")
+	}
+	if keys, _ := mr.HKeys("{users:1}:idx"); len(keys) != 1 || keys[0] != "users:by_email:b@x" {
+		t.Errorf("Expected the confirmed removal to be forgotten, got %v", keys)
+	}
+}
+
+func TestSideKey(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"users:1", "{users:1}:lsn"},
+		{"{users}:1", "{users}:1:lsn"},
+		{"users:{a}{b}", "users:{a}{b}:lsn"},
+		{"users:{}:1", "{" + slotTag(keySlot("users:{}:1")) + "}:users:{}:1:lsn"},
+		{"users:1}", "{" + slotTag(keySlot("users:1}")) + "}:users:1}:lsn"},
+	}
+	for _, tt := range tests {
+		got := sideKey(tt.key, "lsn")
+		if got != tt.want {
+			t.Errorf("sideKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if keySlot(got) != keySlot(tt.key) {
+			t.Errorf("sideKey(%q) = %q is in slot %d, want %d", tt.key, got, keySlot(got), keySlot(tt.key))
+		}
+	}
+
+	// Known slots from the Redis Cluster specification
+	if slot := keySlot("123456789"); slot != 0x31C3%16384 {
+		t.Errorf("Expected slot %d, got %d", 0x31C3%16384, slot)
+	}
+	for key, tag := range map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{{bar}}zap":        "{bar",
+		"foo{bar}{zap}":        "bar",
+	} {
+		if got := hashTag(key); got != tag {
+			t.Errorf("hashTag(%q) = %q, want %q", key, got, tag)
+		}
+	}
+}
+
+func TestRedisSinkPublish(t *testing.T) {
+	ctx := context.Background()
+
+	for _, guard := range []bool{false, true} {
+		t.Run(fmt.Sprintf("version_guard=%v", guard), func(t *testing.T) {
+			s, mr := newTestRedisSink(t, config.RedisTarget{
+				VersionGuard:   guard,
+				PublishChannel: "changes:{{.table}}",
+				PublishRow:     true,
+			})
+			sub := mr.NewSubscriber()
+			defer sub.Close()
+			sub.Subscribe("changes:users")
+
+			done := make(chan []redisNotification)
+			go func() {
+				var got []redisNotification
+				for m := range sub.Messages() {
+					var n redisNotification
+					if err := json.Unmarshal([]byte(m.Message), &n); err != nil {
+						t.Errorf("Invalid notification %q: %v", m.Message, err)
+					}
+					got = append(got, n)
+					if len(got) == 2 {
+						break
+					}
+				}
+				done <- got
+			}()
+
+			err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+				{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 0x10},
+				{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 0x20},
+			}})
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			select {
+			case got := <-done:
+				if got[0].Op != types.EventInsert || got[0].Key != "users:1" || got[0].LSN != "0/10" || got[0].Row["id"] != float64(1) {
+					t.Errorf("Unexpected insert notification: %+v", got[0])
+				}
+				if got[1].Op != types.EventDelete || got[1].Row != nil {
+					t.Errorf("Unexpected delete notification: %+v", got[1])
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Timed out waiting for notifications")
+			}
+		})
+	}
+}
+
+func TestRedisSinkKeys(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisSink(t, config.RedisTarget{
+		KeyPattern: `{{.table}}:{{join ":" .tenant_id .id}}`,
+		Tables: map[string]config.RedisTableConfig{
+			"users": {KeyPattern: "user:{{lower .email}}"},
+		},
+	})
+
+	err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Table: "users", Columns: map[string]interface{}{"email": "A@X"}},
+		{Type: types.EventInsert, Table: "orders", Columns: map[string]interface{}{"tenant_id": "acme", "id": int64(3)}},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if !mr.Exists("user:a@x") || !mr.Exists("orders:acme:3") {
+		t.Errorf("Expected keys user:a@x and orders:acme:3, got %v", mr.Keys())
+	}
+
+	// A row missing a key column fails its batch permanently instead of
+	// sharing a "<no value>" key, before any of the batch is written
+	for _, bad := range []*types.Event{
+		{Type: types.EventInsert, Table: "orders", Columns: map[string]interface{}{"id": int64(4)}},
+		{Type: types.EventInsert, Table: "orders", Columns: map[string]interface{}{"tenant_id": nil, "id": int64(4)}},
+		{Type: types.EventDelete, Table: "users", Identity: map[string]interface{}{"id": int64(1)}},
+	} {
+		err = s.Write(ctx, &types.Batch{Events: []*types.Event{
+			{Type: types.EventInsert, Table: "orders", Columns: map[string]interface{}{"tenant_id": "acme", "id": int64(5)}},
+			bad,
+		}})
+		var perm *permanentError
+		if !errors.As(err, &perm) {
+			t.Errorf("Expected a permanent error for %v, got %v", bad.Columns, err)
+		}
+	}
+	if len(mr.Keys()) != 2 {
+		t.Errorf("Expected nothing of the failed batches to be written, got keys %v", mr.Keys())
+	}
+}
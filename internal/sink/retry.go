@@ -2,21 +2,28 @@ package sink
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
 	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
 	"github.com/nikolay-makurin/replicator/pkg/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// RetrySink retries failed writes with exponential backoff and records the
+// metrics of the target it wraps.
 type RetrySink struct {
-	next Sink
-	cfg  config.RetryConfig
-	name string
+	next    Sink
+	cfg     config.RetryConfig
+	name    string
+	metrics *sinkMetrics
 }
 
-func NewRetrySink(name string, next Sink, cfg config.RetryConfig) *RetrySink {
+func NewRetrySink(labels Labels, next Sink, cfg config.RetryConfig) *RetrySink {
 	if cfg.MaxAttempts <= 0 {
 		cfg.MaxAttempts = 3
 	}
@@ -24,18 +31,72 @@ func NewRetrySink(name string, next Sink, cfg config.RetryConfig) *RetrySink {
 		cfg.Backoff = 100 * time.Millisecond
 	}
 	return &RetrySink{
-		next: next,
-		cfg:  cfg,
-		name: name,
+		next:    next,
+		cfg:     cfg,
+		name:    labels.Name,
+		metrics: newSinkMetrics(labels, next),
 	}
 }
 
-func (r *RetrySink) Write(ctx context.Context, batch *types.Batch) error {
-	var err error
+// permanentError marks a failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that RetrySink returns it without retrying.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retryAfterError carries the delay a target asked for before the next
+// attempt, e.g. from an HTTP Retry-After header.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter wraps err so that RetrySink waits at least delay before the
+// next attempt.
+func RetryAfter(err error, delay time.Duration) error {
+	return &retryAfterError{err: err, delay: delay}
+}
+
+func (r *RetrySink) Write(ctx context.Context, batch *types.Batch) (err error) {
+	ctx, span := telemetry.Tracer().Start(ctx, "write", trace.WithAttributes(
+		attribute.String("replicator.pipeline", r.metrics.labels.Pipeline),
+		attribute.String("replicator.sink", r.name),
+		attribute.String("replicator.sink_type", r.metrics.labels.Type),
+		attribute.Int("replicator.events", len(batch.Events)),
+	))
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	r.metrics.write(batch)
 	for i := 0; i < r.cfg.MaxAttempts; i++ {
-		if err = r.next.Write(ctx, batch); err == nil {
+		start := time.Now()
+		err = r.next.Write(ctx, batch)
+		r.metrics.attempt(start)
+		if err == nil {
+			r.metrics.events(batch, "success")
 			return nil
 		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			r.metrics.permanent.Inc()
+			r.metrics.events(batch, "failure")
+			return fmt.Errorf("sink %s failed permanently: %w", r.name, err)
+		}
+		if i+1 < r.cfg.MaxAttempts {
+			r.metrics.retries.Inc()
+		}
+		span.AddEvent("attempt failed", trace.WithAttributes(
+			attribute.Int("replicator.attempt", i+1),
+			attribute.String("error", err.Error()),
+		))
 		
 		slog.Warn("Sink write failed, retrying", 
 			"sink", r.name, 
@@ -43,12 +104,20 @@ func (r *RetrySink) Write(ctx context.Context, batch *types.Batch) error {
 			"max_attempts", r.cfg.MaxAttempts, 
 			"error", err)
 
+		backoff := r.cfg.Backoff * time.Duration(1<<i) // Exponential backoff
+		var ra *retryAfterError
+		if errors.As(err, &ra) && ra.delay > backoff {
+			backoff = ra.delay
+		}
+
 		select {
 		case <-ctx.Done():
+			r.metrics.events(batch, "failure")
 			return ctx.Err()
-		case <-time.After(r.cfg.Backoff * time.Duration(1<<i)): // Exponential backoff
+		case <-time.After(backoff):
 		}
 	}
+	r.metrics.events(batch, "failure")
 	return fmt.Errorf("sink %s failed after %d attempts: %w", r.name, r.cfg.MaxAttempts, err)
 }
 
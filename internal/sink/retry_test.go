@@ -7,7 +7,15 @@ import (
 	"time"
 
 	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
 	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestRetrySink(t *testing.T) {
@@ -20,7 +28,7 @@ func TestRetrySink(t *testing.T) {
 			},
 		}
 
-		rs := NewRetrySink("test", mock, config.RetryConfig{
+		rs := NewRetrySink(Labels{Name: "test"}, mock, config.RetryConfig{
 			MaxAttempts: 3,
 			Backoff:     10 * time.Millisecond,
 		})
@@ -46,7 +54,7 @@ func TestRetrySink(t *testing.T) {
 			},
 		}
 
-		rs := NewRetrySink("test", mock, config.RetryConfig{
+		rs := NewRetrySink(Labels{Name: "test"}, mock, config.RetryConfig{
 			MaxAttempts: 5,
 			Backoff:     10 * time.Millisecond,
 		})
@@ -76,7 +84,7 @@ func TestRetrySink(t *testing.T) {
 			},
 		}
 
-		rs := NewRetrySink("test", mock, config.RetryConfig{
+		rs := NewRetrySink(Labels{Name: "test"}, mock, config.RetryConfig{
 			MaxAttempts: 3,
 			Backoff:     10 * time.Millisecond,
 		})
@@ -97,7 +105,7 @@ func TestRetrySink(t *testing.T) {
 			},
 		}
 
-		rs := NewRetrySink("test", mock, config.RetryConfig{
+		rs := NewRetrySink(Labels{Name: "test"}, mock, config.RetryConfig{
 			MaxAttempts: 10,
 			Backoff:     100 * time.Millisecond,
 		})
@@ -110,4 +118,149 @@ func TestRetrySink(t *testing.T) {
 			t.Error("Expected context error")
 		}
 	})
+	t.Run("stop on permanent error", func(t *testing.T) {
+		var attempts int
+		mock := &mockSink{
+			writeFunc: func(ctx context.Context, batch *types.Batch) error {
+				attempts++
+				return Permanent(errors.New("bad request"))
+			},
+		}
+
+		rs := NewRetrySink(Labels{Name: "test"}, mock, config.RetryConfig{
+			MaxAttempts: 3,
+			Backoff:     10 * time.Millisecond,
+		})
+
+		if err := rs.Write(context.Background(), &types.Batch{}); err == nil {
+			t.Error("Expected error")
+		}
+		if attempts != 1 {
+			t.Errorf("Expected 1 attempt, got %d", attempts)
+		}
+	})
+
+	t.Run("wait for retry after", func(t *testing.T) {
+		var attempts int
+		mock := &mockSink{
+			writeFunc: func(ctx context.Context, batch *types.Batch) error {
+				attempts++
+				if attempts == 1 {
+					return RetryAfter(errors.New("throttled"), 50*time.Millisecond)
+				}
+				return nil
+			},
+		}
+
+		rs := NewRetrySink(Labels{Name: "test"}, mock, config.RetryConfig{
+			MaxAttempts: 3,
+			Backoff:     time.Millisecond,
+		})
+
+		start := time.Now()
+		if err := rs.Write(context.Background(), &types.Batch{}); err != nil {
+			t.Errorf("Expected success, got: %v", err)
+		}
+		if time.Since(start) < 50*time.Millisecond {
+			t.Error("Expected to wait for the retry after delay")
+		}
+	})
+}
+
+// countingSink fails its first writes and counts the bytes of the others.
+type countingSink struct {
+	mockSink
+	failures int
+	byteCount
+}
+
+func (c *countingSink) Write(ctx context.Context, batch *types.Batch) error {
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("unavailable")
+	}
+	c.addBytes(100 * len(batch.Events))
+	return nil
+}
+
+func TestRetrySinkMetrics(t *testing.T) {
+	labels := Labels{Pipeline: "metrics", Name: "kafka1", Type: "kafka"}
+	next := &countingSink{failures: 1}
+	rs := NewRetrySink(labels, next, config.RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+
+	batch := &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users"},
+		{Type: types.EventInsert, Schema: "public", Table: "users"},
+		{Type: types.EventDelete, Schema: "public", Table: "orders"},
+	}}
+	if err := rs.Write(context.Background(), batch); err != nil {
+		t.Fatalf("Expected success after a retry, got: %v", err)
+	}
+
+	counter := func(name string, got float64, want float64) {
+		t.Helper()
+		if got != want {
+			t.Errorf("Expected %s %v, got %v", name, want, got)
+		}
+	}
+	counter("retries", testutil.ToFloat64(telemetry.SinkRetries.WithLabelValues("metrics", "kafka1", "kafka")), 1)
+	counter("batch sizes", float64(sampleCount(t, telemetry.BatchSize.WithLabelValues("metrics", "kafka1", "kafka"))), 1)
+	counter("latencies", float64(sampleCount(t, telemetry.SinkLatency.WithLabelValues("metrics", "kafka1", "kafka"))), 2)
+	counter("bytes", testutil.ToFloat64(telemetry.SinkBytesWritten.WithLabelValues("metrics", "kafka1", "kafka")), 300)
+	counter("users inserts", testutil.ToFloat64(telemetry.EventsProcessed.WithLabelValues("metrics", "kafka1", "kafka", "public.users", "insert", "success")), 2)
+	counter("orders deletes", testutil.ToFloat64(telemetry.EventsProcessed.WithLabelValues("metrics", "kafka1", "kafka", "public.orders", "delete", "success")), 1)
+
+	perm := NewRetrySink(Labels{Pipeline: "metrics", Name: "hook1", Type: "webhook"}, &mockSink{
+		writeFunc: func(ctx context.Context, batch *types.Batch) error {
+			return Permanent(errors.New("bad request"))
+		},
+	}, config.RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+	if err := perm.Write(context.Background(), batch); err == nil {
+		t.Fatal("Expected a permanent failure")
+	}
+	counter("permanent failures", testutil.ToFloat64(telemetry.SinkPermanentFailures.WithLabelValues("metrics", "hook1", "webhook")), 1)
+	counter("failed inserts", testutil.ToFloat64(telemetry.EventsProcessed.WithLabelValues("metrics", "hook1", "webhook", "public.users", "insert", "failure")), 2)
+}
+
+// sampleCount returns the number of observations of a histogram.
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRetrySinkTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(prev)
+
+	rs := NewRetrySink(Labels{Pipeline: "tracing", Name: "pg1", Type: "postgres"}, &mockSink{
+		writeFunc: func(ctx context.Context, batch *types.Batch) error {
+			return errors.New("unavailable")
+		},
+	}, config.RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond})
+	if err := rs.Write(context.Background(), &types.Batch{}); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "write" {
+		t.Fatalf("Expected one write span, got %v", spans)
+	}
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("Expected an error status, got %v", spans[0].Status)
+	}
+	var attempts int
+	for _, e := range spans[0].Events {
+		if e.Name == "attempt failed" {
+			attempts++
+		}
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 failed attempts, got %d", attempts)
+	}
 }
@@ -0,0 +1,272 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// S3Sink buffers events per table and commit date and uploads them as
+// Parquet files to S3-compatible storage. A file is uploaded once it
+// reaches the row or size limit or the maximum age; until then its events
+// are reported by PendingLSN, so the checkpoint waits for the upload.
+// Uploads run without holding the lock, so a slow upload does not block
+// other writes or PendingLSN.
+type S3Sink struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	maxRows  int
+	maxBytes int64
+	maxAge   time.Duration
+	codec    compress.Codec
+
+	mu        sync.Mutex
+	files     map[s3FileKey]*s3File
+	uploading map[*s3File]bool // Detached from files while uploaded
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	byteCount
+}
+
+// s3FileKey identifies the partition a buffered file belongs to.
+type s3FileKey struct {
+	schema, table, date string
+}
+
+type s3File struct {
+	events []*types.Event
+	size   int64 // Estimated encoded size
+	opened time.Time
+	minLSN types.LSN
+	maxLSN types.LSN
+}
+
+func NewS3Sink(cfg config.S3Target) (*S3Sink, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	var codec compress.Codec
+	switch cfg.Compression {
+	case "", "snappy":
+		codec = &parquet.Snappy
+	case "zstd":
+		codec = &parquet.Zstd
+	case "gzip":
+		codec = &parquet.Gzip
+	case "none":
+		codec = &parquet.Uncompressed
+	default:
+		return nil, fmt.Errorf("invalid parquet compression %q", cfg.Compression)
+	}
+
+	s := &S3Sink{
+		client:    client,
+		bucket:    cfg.Bucket,
+		prefix:    cfg.Prefix,
+		maxRows:   cfg.BatchSize,
+		maxBytes:  cfg.RollSize,
+		maxAge:    cfg.BatchInterval,
+		codec:     codec,
+		files:     make(map[s3FileKey]*s3File),
+		uploading: make(map[*s3File]bool),
+		stop:      make(chan struct{}),
+	}
+	if s.maxAge > 0 {
+		s.wg.Add(1)
+		go s.rollLoop()
+	}
+	return s, nil
+}
+
+// Write buffers the batch. A batch with a change that cannot be encoded
+// fails permanently before any of it is buffered, so that it is never
+// acknowledged. Files that are already full are uploaded first, so that a
+// failed upload fails the batch before any of it is buffered and RetrySink
+// can safely write it again.
+func (s *S3Sink) Write(ctx context.Context, batch *types.Batch) error {
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		if err := checkParquet(e); err != nil {
+			return Permanent(fmt.Errorf("cannot encode %s.%s change at %s: %w", e.Schema, e.Table, e.LSN, err))
+		}
+	}
+	if err := s.roll(ctx, s.full); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		key := s3FileKey{schema: e.Schema, table: e.Table, date: e.Timestamp.UTC().Format("2006-01-02")}
+		f, ok := s.files[key]
+		if !ok {
+			f = &s3File{opened: time.Now(), minLSN: e.LSN}
+			s.files[key] = f
+		}
+		f.events = append(f.events, e)
+		f.size += estimateSize(e)
+		if e.LSN < f.minLSN {
+			f.minLSN = e.LSN
+		}
+		if e.LSN > f.maxLSN {
+			f.maxLSN = e.LSN
+		}
+	}
+	s.mu.Unlock()
+
+	// Upload what this batch filled; on failure the files stay buffered and
+	// are retried by the next Write or the roll loop.
+	if err := s.roll(ctx, s.full); err != nil {
+		slog.Warn("S3 upload failed, will retry", "error", err)
+	}
+	return nil
+}
+
+func (s *S3Sink) full(f *s3File) bool {
+	return (s.maxRows > 0 && len(f.events) >= s.maxRows) || (s.maxBytes > 0 && f.size >= s.maxBytes)
+}
+
+func (s *S3Sink) expired(f *s3File) bool {
+	return s.full(f) || time.Since(f.opened) >= s.maxAge
+}
+
+// roll uploads the buffered files selected by due. They are detached
+// while uploading; a failed upload puts them back to be retried.
+func (s *S3Sink) roll(ctx context.Context, due func(*s3File) bool) error {
+	type detached struct {
+		key s3FileKey
+		f   *s3File
+	}
+	var files []detached
+	s.mu.Lock()
+	for key, f := range s.files {
+		if due(f) {
+			delete(s.files, key)
+			s.uploading[f] = true
+			files = append(files, detached{key, f})
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, d := range files {
+		err := s.upload(ctx, d.key, d.f)
+		s.mu.Lock()
+		delete(s.uploading, d.f)
+		if err != nil {
+			s.restore(d.key, d.f)
+			errs = append(errs, err)
+		}
+		s.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// restore puts back a file whose upload failed, merging it with a file of
+// the same partition started in the meantime. s.mu must be held.
+func (s *S3Sink) restore(key s3FileKey, f *s3File) {
+	cur, ok := s.files[key]
+	if !ok {
+		s.files[key] = f
+		return
+	}
+	cur.events = append(f.events, cur.events...)
+	cur.size += f.size
+	cur.opened = f.opened
+	cur.minLSN = min(cur.minLSN, f.minLSN)
+	cur.maxLSN = max(cur.maxLSN, f.maxLSN)
+}
+
+func (s *S3Sink) rollLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(min(s.maxAge, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.roll(context.Background(), s.expired); err != nil {
+				slog.Warn("S3 upload failed, will retry", "error", err)
+			}
+		}
+	}
+}
+
+// objectName places a file under <prefix><schema>.<table>/date=<day>/,
+// named after its LSN range so that a re-upload replaces the same object.
+func (s *S3Sink) objectName(key s3FileKey, f *s3File) string {
+	name := fmt.Sprintf("%016X-%016X.parquet", uint64(f.minLSN), uint64(f.maxLSN))
+	return s.prefix + path.Join(key.schema+"."+key.table, "date="+key.date, name)
+}
+
+func (s *S3Sink) upload(ctx context.Context, key s3FileKey, f *s3File) error {
+	var buf bytes.Buffer
+	if err := writeParquet(&buf, f.events, s.codec); err != nil {
+		return fmt.Errorf("failed to write parquet file for %s.%s: %w", key.schema, key.table, err)
+	}
+	name, size := s.objectName(key, f), buf.Len()
+	_, err := s.client.PutObject(ctx, s.bucket, name, &buf, int64(size), minio.PutObjectOptions{
+		ContentType: "application/vnd.apache.parquet",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	s.addBytes(size)
+	slog.Info("Uploaded parquet file", "object", name, "rows", len(f.events), "bytes", size)
+	return nil
+}
+
+// PendingLSN returns the lowest LSN buffered but not yet uploaded.
+func (s *S3Sink) PendingLSN() (types.LSN, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lsn types.LSN
+	found := false
+	for _, f := range s.files {
+		if !found || f.minLSN < lsn {
+			lsn, found = f.minLSN, true
+		}
+	}
+	for f := range s.uploading {
+		if !found || f.minLSN < lsn {
+			lsn, found = f.minLSN, true
+		}
+	}
+	return lsn, found
+}
+
+// Close uploads the remaining files.
+func (s *S3Sink) Close() error {
+	close(s.stop)
+	s.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return s.roll(ctx, func(*s3File) bool { return true })
+}
@@ -0,0 +1,236 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// Metadata columns written with every row
+const (
+	parquetOpColumn       = "_op"
+	parquetLSNColumn      = "_lsn"
+	parquetCommitTsColumn = "_commit_ts"
+)
+
+// parquetKind is the Parquet type chosen for a row column.
+type parquetKind int
+
+const (
+	kindNone parquetKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindString
+	kindBytes
+	kindTime
+	kindJSON
+)
+
+// writeParquet writes events as one Parquet file. Row columns are typed
+// from the values found in the events: columns whose values disagree on a
+// type, e.g. an integer in one row and a string in another, are written as
+// strings. Deletes carry only their identity columns.
+func writeParquet(w io.Writer, events []*types.Event, codec compress.Codec) error {
+	kinds := make(map[string]parquetKind)
+	for _, e := range events {
+		for col, v := range eventRow(e) {
+			kinds[col] = mergeKind(kinds[col], kindOf(v))
+		}
+	}
+
+	group := parquet.Group{
+		parquetOpColumn:       parquet.String(),
+		parquetLSNColumn:      parquet.Int(64),
+		parquetCommitTsColumn: parquet.Timestamp(parquet.Millisecond),
+	}
+	for col, kind := range kinds {
+		group[col] = parquet.Optional(kindNode(kind))
+	}
+	// Leaf columns are ordered by name
+	names := make([]string, 0, len(group))
+	for name := range group {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	schema := parquet.NewSchema("change", group)
+	pw := parquet.NewWriter(w, schema, parquet.Compression(codec))
+
+	rows := make([]parquet.Row, 0, len(events))
+	for _, e := range events {
+		values := eventRow(e)
+		row := make(parquet.Row, len(names))
+		for i, name := range names {
+			switch name {
+			case parquetOpColumn:
+				row[i] = parquet.ByteArrayValue([]byte(e.Type)).Level(0, 0, i)
+			case parquetLSNColumn:
+				row[i] = parquet.Int64Value(int64(e.LSN)).Level(0, 0, i)
+			case parquetCommitTsColumn:
+				row[i] = parquet.Int64Value(e.Timestamp.UnixMilli()).Level(0, 0, i)
+			default:
+				v, ok := values[name]
+				if !ok || v == nil {
+					row[i] = parquet.NullValue().Level(0, 0, i)
+					continue
+				}
+				pv, err := parquetValue(kinds[name], v)
+				if err != nil {
+					return fmt.Errorf("column %s: %w", name, err)
+				}
+				row[i] = pv.Level(0, 1, i)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if _, err := pw.WriteRows(rows); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
+// checkParquet returns an error if a value of e cannot be written. Values
+// that fit no Parquet type are written as JSON whatever the other rows of
+// the file hold, so an event that passes can be written in any file.
+func checkParquet(e *types.Event) error {
+	for col, v := range eventRow(e) {
+		if v == nil {
+			continue
+		}
+		if _, err := parquetValue(kindOf(v), v); err != nil {
+			return fmt.Errorf("column %s: %w", col, err)
+		}
+	}
+	return nil
+}
+
+func eventRow(e *types.Event) map[string]interface{} {
+	if e.Type == types.EventDelete {
+		return e.Identity
+	}
+	return e.Columns
+}
+
+func kindOf(v interface{}) parquetKind {
+	switch v.(type) {
+	case nil:
+		return kindNone
+	case bool:
+		return kindBool
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return kindInt
+	case float32, float64:
+		return kindFloat
+	case string:
+		return kindString
+	case []byte:
+		return kindBytes
+	case time.Time:
+		return kindTime
+	}
+	return kindJSON
+}
+
+func mergeKind(a, b parquetKind) parquetKind {
+	switch {
+	case a == kindNone:
+		return b
+	case b == kindNone, a == b:
+		return a
+	case a == kindInt && b == kindFloat, a == kindFloat && b == kindInt:
+		return kindFloat
+	}
+	return kindString
+}
+
+func kindNode(k parquetKind) parquet.Node {
+	switch k {
+	case kindBool:
+		return parquet.Leaf(parquet.BooleanType)
+	case kindInt:
+		return parquet.Int(64)
+	case kindFloat:
+		return parquet.Leaf(parquet.DoubleType)
+	case kindBytes:
+		return parquet.Leaf(parquet.ByteArrayType)
+	case kindTime:
+		return parquet.Timestamp(parquet.Microsecond)
+	case kindJSON:
+		return parquet.JSON()
+	}
+	// All NULL columns are written as strings
+	return parquet.String()
+}
+
+func parquetValue(k parquetKind, v interface{}) (parquet.Value, error) {
+	switch k {
+	case kindBool:
+		return parquet.BooleanValue(v.(bool)), nil
+	case kindInt:
+		i, err := strconv.ParseInt(numberString(v), 10, 64)
+		if err != nil {
+			return parquet.Value{}, err
+		}
+		return parquet.Int64Value(i), nil
+	case kindFloat:
+		f, err := strconv.ParseFloat(numberString(v), 64)
+		if err != nil {
+			return parquet.Value{}, err
+		}
+		return parquet.DoubleValue(f), nil
+	case kindBytes:
+		return parquet.ByteArrayValue(v.([]byte)), nil
+	case kindTime:
+		return parquet.Int64Value(v.(time.Time).UnixMicro()), nil
+	case kindJSON:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return parquet.Value{}, err
+		}
+		return parquet.ByteArrayValue(data), nil
+	}
+	switch x := v.(type) {
+	case string:
+		return parquet.ByteArrayValue([]byte(x)), nil
+	case []byte:
+		return parquet.ByteArrayValue(x), nil
+	case time.Time:
+		return parquet.ByteArrayValue([]byte(x.Format(time.RFC3339Nano))), nil
+	case bool, int, int8, int16, int32, int64, uint8, uint16, uint32, float32, float64:
+		return parquet.ByteArrayValue([]byte(fmt.Sprint(x))), nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return parquet.Value{}, err
+	}
+	return parquet.ByteArrayValue(data), nil
+}
+
+// estimateSize approximates the encoded size of an event, before
+// compression, to decide when a file is large enough to upload.
+func estimateSize(e *types.Event) int64 {
+	size := int64(len(e.Type)) + 16
+	for _, v := range eventRow(e) {
+		switch x := v.(type) {
+		case nil:
+		case string:
+			size += int64(len(x))
+		case []byte:
+			size += int64(len(x))
+		case bool:
+			size++
+		default:
+			size += 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,206 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"github.com/minio/minio-go/v7"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/parquet-go/parquet-go"
+)
+
+func newTestS3Sink(t *testing.T, cfg config.S3Target) *S3Sink {
+	t.Helper()
+	backend := s3mem.New()
+	if err := backend.CreateBucket("lake"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(srv.Close)
+
+	cfg.Endpoint = strings.TrimPrefix(srv.URL, "http://")
+	cfg.Bucket = "lake"
+	cfg.AccessKeyID = "key"
+	cfg.SecretAccessKey = "secret"
+	cfg.Region = "us-east-1"
+	s, err := NewS3Sink(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create s3 sink: %v", err)
+	}
+	return s
+}
+
+// readObjects returns the rows of every Parquet object, keyed by object
+// name, as column name -> value maps.
+func readObjects(t *testing.T, s *S3Sink) map[string][]map[string]parquet.Value {
+	t.Helper()
+	ctx := context.Background()
+	out := make(map[string][]map[string]parquet.Value)
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			t.Fatalf("List failed: %v", obj.Err)
+		}
+		r, err := s.client.GetObject(ctx, s.bucket, obj.Key, minio.GetObjectOptions{})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		pr := parquet.NewReader(bytes.NewReader(data))
+		columns := pr.Schema().Columns()
+		rows := make([]parquet.Row, pr.NumRows())
+		if n, err := pr.ReadRows(rows); n != len(rows) {
+			t.Fatalf("Read %d of %d rows from %s: %v", n, len(rows), obj.Key, err)
+		}
+		for _, row := range rows {
+			m := make(map[string]parquet.Value)
+			for _, v := range row {
+				m[columns[v.Column()][0]] = v
+			}
+			out[obj.Key] = append(out[obj.Key], m)
+		}
+	}
+	return out
+}
+
+func TestS3SinkRollsOnRowLimit(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3Sink(t, config.S3Target{
+		TargetBase: config.TargetBase{BatchSize: 2, BatchInterval: time.Hour},
+		Prefix:     "cdc/",
+	})
+
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	write := func(events ...*types.Event) {
+		t.Helper()
+		if err := s.Write(ctx, &types.Batch{Events: events}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	write(
+		&types.Event{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": "a"}, LSN: 0x10, Timestamp: ts},
+		&types.Event{Type: types.EventUpdate, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1), "name": nil}, LSN: 0x20, Timestamp: ts},
+		&types.Event{Type: types.EventInsert, Schema: "public", Table: "orders", Columns: map[string]interface{}{"id": int64(9)}, LSN: 0x30, Timestamp: ts},
+	)
+
+	// The users file reached the row limit; orders is still buffered
+	objects := readObjects(t, s)
+	rows, ok := objects["cdc/public.users/date=2024-03-01/0000000000000010-0000000000000020.parquet"]
+	if !ok || len(objects) != 1 {
+		t.Fatalf("Expected one users object, got %v", objects)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	if s.BytesWritten() == 0 {
+		t.Error("Expected the uploaded bytes to be counted")
+	}
+	if op := rows[1]["_op"].String(); op != "UPDATE" {
+		t.Errorf("Expected _op UPDATE, got %s", op)
+	}
+	if lsn := rows[1]["_lsn"].Int64(); lsn != 0x20 {
+		t.Errorf("Expected _lsn 0x20, got %#x", lsn)
+	}
+	if ms := rows[0]["_commit_ts"].Int64(); ms != ts.UnixMilli() {
+		t.Errorf("Expected _commit_ts %d, got %d", ts.UnixMilli(), ms)
+	}
+	if !rows[1]["name"].IsNull() || rows[0]["name"].String() != "a" {
+		t.Errorf("Unexpected name values %v, %v", rows[0]["name"], rows[1]["name"])
+	}
+
+	if lsn, ok := s.PendingLSN(); !ok || lsn != 0x30 {
+		t.Errorf("Expected pending LSN 0x30, got %v %v", lsn, ok)
+	}
+
+	// Close uploads the rest
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, ok := s.PendingLSN(); ok {
+		t.Error("Expected nothing pending after close")
+	}
+	if len(readObjects(t, s)) != 2 {
+		t.Error("Expected the orders file to be uploaded on close")
+	}
+}
+
+func TestS3SinkRollsOnAge(t *testing.T) {
+	s := newTestS3Sink(t, config.S3Target{TargetBase: config.TargetBase{BatchSize: 1000, BatchInterval: 50 * time.Millisecond}})
+	defer s.Close()
+
+	err := s.Write(context.Background(), &types.Batch{Events: []*types.Event{
+		{Type: types.EventDelete, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 0x40, Timestamp: time.Now()},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := s.PendingLSN(); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the file to roll")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(readObjects(t, s)) != 1 {
+		t.Error("Expected one uploaded object")
+	}
+}
+
+func TestS3SinkRejectsUnencodableBatch(t *testing.T) {
+	ctx := context.Background()
+	s := newTestS3Sink(t, config.S3Target{TargetBase: config.TargetBase{BatchSize: 2, BatchInterval: time.Hour}})
+	defer s.Close()
+
+	err := s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1)}, LSN: 0x10, Timestamp: time.Now()},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// A channel cannot be encoded as JSON. The batch fails on its own,
+	// without buffering its other change
+	err = s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(2)}, LSN: 0x20, Timestamp: time.Now()},
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(3), "bad": make(chan int)}, LSN: 0x30, Timestamp: time.Now()},
+	}})
+	var perm *permanentError
+	if !errors.As(err, &perm) {
+		t.Fatalf("Expected a permanent error, got %v", err)
+	}
+	if lsn, ok := s.PendingLSN(); !ok || lsn != 0x10 {
+		t.Errorf("Expected the first batch to stay pending at 0x10, got %s (%v)", lsn, ok)
+	}
+
+	// The buffered file is unaffected
+	err = s.Write(ctx, &types.Batch{Events: []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(4)}, LSN: 0x40, Timestamp: time.Now()},
+	}})
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	objects := readObjects(t, s)
+	if len(objects) != 1 {
+		t.Fatalf("Expected one uploaded object, got %d", len(objects))
+	}
+	for _, rows := range objects {
+		if len(rows) != 2 {
+			t.Errorf("Expected the changes at 0x10 and 0x40, got %d rows", len(rows))
+		}
+	}
+}
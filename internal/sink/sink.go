@@ -9,3 +9,10 @@ type Sink interface {
 	Write(ctx context.Context, batch *types.Batch) error
 	Close() error
 }
+
+// Buffering is implemented by sinks that keep events after Write returns,
+// e.g. to roll them into larger files. PendingLSN reports the lowest LSN
+// that is not yet durable, so that the checkpoint does not pass it.
+type Buffering interface {
+	PendingLSN() (types.LSN, bool)
+}
@@ -0,0 +1,450 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStateTable holds the LSN of the last applied change, written in the
+// same transaction as the changes, so readers of the file can tell how far
+// it is. It does not position the source, which resumes from its slot.
+const sqliteStateTable = "_replicator_state"
+
+// sqliteTablesTable holds the LSN of the last applied change per table.
+// Workers write different tables concurrently, so their batches arrive out
+// of LSN order and a single LSN cannot tell which changes a table holds.
+// A copy of the file handed to another replicator skips the changes its
+// tables already contain.
+const sqliteTablesTable = "_replicator_tables"
+
+// SQLiteSink replicates tables into a local SQLite file for read-only
+// consumers. Tables are named "schema.table" and created from the source's
+// column definitions, and each batch is applied in one transaction. The
+// file uses WAL journaling, so readers are not blocked while a batch is
+// written.
+type SQLiteSink struct {
+	db     *sql.DB
+	filter map[string]bool // "table" or "schema.table"; nil replicates everything
+
+	mu        sync.Mutex
+	applied   types.LSN               // Highest LSN written to the file
+	tableLSNs map[string]types.LSN    // Highest LSN written per table, by sqliteName
+	floor     types.LSN               // Applied LSN of a file from before per-table state, for tables without their own
+	tables    map[string]*sqliteTable // By sqliteName
+}
+
+// sqliteTable is the known layout of a replicated table.
+type sqliteTable struct {
+	columns map[string]bool
+	key     []string // Primary key columns
+}
+
+func NewSQLiteSink(ctx context.Context, cfg config.SQLiteTarget) (*SQLiteSink, error) {
+	dsn := "file:" + cfg.Path + "?" + url.Values{
+		"_pragma": {"journal_mode(WAL)", "busy_timeout(5000)", "synchronous(NORMAL)"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", cfg.Path, err)
+	}
+	// SQLite has a single writer
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteSink{db: db, tableLSNs: make(map[string]types.LSN), tables: make(map[string]*sqliteTable)}
+	if len(cfg.Tables) > 0 {
+		s.filter = make(map[string]bool, len(cfg.Tables))
+		for _, t := range cfg.Tables {
+			s.filter[t] = true
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY CHECK (id = 1), lsn TEXT NOT NULL, updated_at TEXT NOT NULL)",
+		quoteSQLite(sqliteStateTable))); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create %s: %w", sqliteStateTable, err)
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (name TEXT PRIMARY KEY, lsn TEXT NOT NULL)",
+		quoteSQLite(sqliteTablesTable))); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create %s: %w", sqliteTablesTable, err)
+	}
+	if err := s.readTableLSNs(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	var lsn string
+	err = db.QueryRowContext(ctx, fmt.Sprintf("SELECT lsn FROM %s WHERE id = 1", quoteSQLite(sqliteStateTable))).Scan(&lsn)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		db.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", sqliteStateTable, err)
+	default:
+		if s.applied, err = types.ParseLSN(lsn); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("invalid %s: %w", sqliteStateTable, err)
+		}
+		if len(s.tableLSNs) == 0 {
+			s.floor = s.applied
+		}
+		slog.Info("Resuming SQLite replica", "path", cfg.Path, "applied_lsn", s.applied)
+	}
+	return s, nil
+}
+
+func (s *SQLiteSink) readTableLSNs(ctx context.Context) error {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT name, lsn FROM %s", quoteSQLite(sqliteTablesTable)))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", sqliteTablesTable, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, lsn string
+		if err := rows.Scan(&name, &lsn); err != nil {
+			return fmt.Errorf("failed to read %s: %w", sqliteTablesTable, err)
+		}
+		if s.tableLSNs[name], err = types.ParseLSN(lsn); err != nil {
+			return fmt.Errorf("invalid %s for %s: %w", sqliteTablesTable, name, err)
+		}
+	}
+	return rows.Err()
+}
+
+// sqliteName names the SQLite table of an event's table, so that tables
+// of the same name in different schemas are kept apart.
+func sqliteName(e *types.Event) string {
+	if e.Schema == "" {
+		return e.Table
+	}
+	return e.Schema + "." + e.Table
+}
+
+// tableLSN returns the LSN up to which table's changes are in the file.
+func (s *SQLiteSink) tableLSN(table string) types.LSN {
+	if lsn, ok := s.tableLSNs[table]; ok {
+		return lsn
+	}
+	return s.floor
+}
+
+// AppliedLSN returns the LSN of the last change in the file.
+func (s *SQLiteSink) AppliedLSN() types.LSN {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applied
+}
+
+func (s *SQLiteSink) Write(ctx context.Context, batch *types.Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlite begin failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	applied := s.applied
+	written := make(map[string]types.LSN)
+	snapshot := false
+	for _, e := range batch.Events {
+		if e.Type != types.EventInsert && e.Type != types.EventUpdate && e.Type != types.EventDelete {
+			continue
+		}
+		// Already in the file, e.g. replayed after a crash. Snapshot rows
+		// are not ordered by LSN and always applied
+		if !e.Snapshot && e.LSN <= s.tableLSN(sqliteName(e)) {
+			continue
+		}
+		if !e.Snapshot && e.LSN > applied {
+			applied = e.LSN
+		}
+		if s.filter != nil && !s.filter[e.Table] && !s.filter[e.Schema+"."+e.Table] {
+			continue
+		}
+		if err := s.apply(ctx, tx, e); err != nil {
+			// Created tables are rolled back with the transaction
+			s.tables = make(map[string]*sqliteTable)
+			return err
+		}
+		if e.Snapshot {
+			snapshot = true
+		} else if name := sqliteName(e); e.LSN > written[name] {
+			written[name] = e.LSN
+		}
+	}
+	if applied == s.applied && len(written) == 0 && !snapshot {
+		return nil
+	}
+
+	for table, lsn := range written {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+			"INSERT INTO %s (name, lsn) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET lsn = excluded.lsn",
+			quoteSQLite(sqliteTablesTable)), table, lsn.String()); err != nil {
+			s.tables = make(map[string]*sqliteTable)
+			return fmt.Errorf("failed to update %s: %w", sqliteTablesTable, err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(
+		"INSERT INTO %s (id, lsn, updated_at) VALUES (1, ?, ?) ON CONFLICT (id) DO UPDATE SET lsn = excluded.lsn, updated_at = excluded.updated_at",
+		quoteSQLite(sqliteStateTable)), applied.String(), time.Now().UTC().Format(time.RFC3339)); err != nil {
+		s.tables = make(map[string]*sqliteTable)
+		return fmt.Errorf("failed to update %s: %w", sqliteStateTable, err)
+	}
+	if err := tx.Commit(); err != nil {
+		s.tables = make(map[string]*sqliteTable)
+		return fmt.Errorf("sqlite commit failed: %w", err)
+	}
+	s.applied = applied
+	for table, lsn := range written {
+		s.tableLSNs[table] = lsn
+	}
+	return nil
+}
+
+func (s *SQLiteSink) apply(ctx context.Context, tx *sql.Tx, e *types.Event) error {
+	t, err := s.ensureTable(ctx, tx, e)
+	if err != nil {
+		return err
+	}
+	name := sqliteName(e)
+	table := quoteSQLite(name)
+
+	if e.Type == types.EventDelete || (e.Type == types.EventUpdate && keyChanged(e)) {
+		if len(e.Identity) > 0 {
+			cols := sortedKeys(e.Identity)
+			where := make([]string, len(cols))
+			for i, col := range cols {
+				where[i] = quoteSQLite(col) + " = ?"
+			}
+			args, err := sqliteValues(e, e.Identity, cols)
+			if err != nil {
+				return err
+			}
+			query := fmt.Sprintf("DELETE FROM %s WHERE %s", table, strings.Join(where, " AND "))
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("sqlite delete from %s failed: %w", name, err)
+			}
+		}
+		if e.Type == types.EventDelete {
+			return nil
+		}
+	}
+	if len(e.Columns) == 0 {
+		return nil
+	}
+
+	cols := sortedKeys(e.Columns)
+	quoted := make([]string, len(cols))
+	for i, col := range cols {
+		quoted[i] = quoteSQLite(col)
+	}
+	args, err := sqliteValues(e, e.Columns, cols)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", "))
+	if len(t.key) > 0 {
+		key := make([]string, len(t.key))
+		for i, col := range t.key {
+			key[i] = quoteSQLite(col)
+		}
+		updates := make([]string, len(quoted))
+		for i, col := range quoted {
+			updates[i] = col + " = excluded." + col
+		}
+		query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(key, ", "), strings.Join(updates, ", "))
+	}
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fmt.Errorf("sqlite upsert into %s failed: %w", name, err)
+	}
+	return nil
+}
+
+// ensureTable creates the event's table, or adds columns it lacks, from
+// the event's column definitions. Without them, as for replayed events,
+// columns are created without a type and the key is the identity.
+func (s *SQLiteSink) ensureTable(ctx context.Context, tx *sql.Tx, e *types.Event) (*sqliteTable, error) {
+	name := sqliteName(e)
+	t := s.tables[name]
+	if t == nil {
+		var err error
+		if t, err = readSQLiteTable(ctx, tx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	if t == nil {
+		t = &sqliteTable{columns: make(map[string]bool)}
+		var defs []string
+		if e.Relation != nil {
+			for _, col := range e.Relation.Columns {
+				defs = append(defs, strings.TrimSpace(quoteSQLite(col.Name)+" "+sqliteType(col.Type)))
+				t.columns[col.Name] = true
+				if col.Key {
+					t.key = append(t.key, col.Name)
+				}
+			}
+		} else {
+			for _, col := range sortedKeys(e.Columns) {
+				defs = append(defs, quoteSQLite(col))
+				t.columns[col] = true
+			}
+			t.key = sortedKeys(e.Identity)
+		}
+		if len(t.key) > 0 {
+			key := make([]string, len(t.key))
+			for i, col := range t.key {
+				key[i] = quoteSQLite(col)
+				if !t.columns[col] {
+					defs = append(defs, key[i])
+					t.columns[col] = true
+				}
+			}
+			defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(key, ", ")))
+		}
+		query := fmt.Sprintf("CREATE TABLE %s (%s)", quoteSQLite(name), strings.Join(defs, ", "))
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to create sqlite table %s: %w", name, err)
+		}
+		slog.Info("Created SQLite table", "table", name, "columns", len(t.columns))
+	}
+
+	// Columns added to the source table since
+	oids := make(map[string]uint32)
+	if e.Relation != nil {
+		for _, col := range e.Relation.Columns {
+			oids[col.Name] = col.Type
+		}
+	}
+	for col := range e.Columns {
+		if t.columns[col] {
+			continue
+		}
+		query := strings.TrimSpace(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteSQLite(name), quoteSQLite(col), sqliteType(oids[col])))
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to add column %s to sqlite table %s: %w", col, name, err)
+		}
+		t.columns[col] = true
+	}
+
+	s.tables[name] = t
+	return t, nil
+}
+
+// readSQLiteTable returns the layout of an existing table, or nil.
+func readSQLiteTable(ctx context.Context, tx *sql.Tx, table string) (*sqliteTable, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name, pk FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sqlite table %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	t := &sqliteTable{columns: make(map[string]bool)}
+	pk := make(map[int]string)
+	for rows.Next() {
+		var name string
+		var pos int
+		if err := rows.Scan(&name, &pos); err != nil {
+			return nil, fmt.Errorf("failed to read sqlite table %s: %w", table, err)
+		}
+		t.columns[name] = true
+		if pos > 0 {
+			pk[pos] = name
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read sqlite table %s: %w", table, err)
+	}
+	if len(t.columns) == 0 {
+		return nil, nil
+	}
+	for i := 1; i <= len(pk); i++ {
+		t.key = append(t.key, pk[i])
+	}
+	return t, nil
+}
+
+// sqliteType maps a Postgres type OID to a column type, which in SQLite
+// sets the column's affinity. Unknown types (0) get no declared type.
+func sqliteType(oid uint32) string {
+	switch oid {
+	case 0:
+		return ""
+	case 16, 20, 21, 23, 26: // bool, int8, int2, int4, oid
+		return "INTEGER"
+	case 700, 701: // float4, float8
+		return "REAL"
+	case 1700: // numeric
+		return "NUMERIC"
+	case 17: // bytea
+		return "BLOB"
+	}
+	return "TEXT"
+}
+
+// sqliteValues returns the values of cols in row as SQLite arguments.
+func sqliteValues(e *types.Event, row map[string]interface{}, cols []string) ([]interface{}, error) {
+	oids := make(map[string]uint32)
+	if e.Relation != nil {
+		for _, col := range e.Relation.Columns {
+			oids[col.Name] = col.Type
+		}
+	}
+	args := make([]interface{}, len(cols))
+	for i, col := range cols {
+		v, err := sqliteValue(oids[col], row[col])
+		if err != nil {
+			return nil, fmt.Errorf("column %s.%s: %w", e.Table, col, err)
+		}
+		args[i] = v
+	}
+	return args, nil
+}
+
+func sqliteValue(oid uint32, v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if x {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case time.Time:
+		// Understood by SQLite's date and time functions
+		return x.UTC().Format("2006-01-02 15:04:05.999999Z07:00"), nil
+	case string:
+		if oid == 17 {
+			return binaryValue(x)
+		}
+		return x, nil
+	case []byte, int64, int32, float64:
+		return x, nil
+	}
+	return stringValue(v)
+}
+
+// quoteSQLite quotes an identifier with double quotes.
+func quoteSQLite(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (s *SQLiteSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,207 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func TestSQLiteSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "edge.db")
+	cfg := config.SQLiteTarget{TargetBase: config.TargetBase{Name: "edge"}, Path: path, Tables: []string{"public.users"}}
+
+	users := &types.Relation{Schema: "public", Table: "users", Columns: []types.Column{
+		{Name: "id", Type: 20, Key: true},
+		{Name: "name", Type: 25},
+		{Name: "active", Type: 16},
+		{Name: "avatar", Type: 17},
+		{Name: "created", Type: 1184},
+	}}
+	row := func(typ types.EventType, lsn types.LSN, id int64, name string) *types.Event {
+		e := &types.Event{Type: typ, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": id}, LSN: lsn, Relation: users}
+		if typ != types.EventDelete {
+			e.Columns = map[string]interface{}{
+				"id": id, "name": name, "active": true, "avatar": `\x0102`,
+				"created": time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			}
+		}
+		return e
+	}
+
+	s, err := NewSQLiteSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create sqlite sink: %v", err)
+	}
+	moved := row(types.EventUpdate, 14, 4, "d")
+	moved.Identity = map[string]interface{}{"id": int64(3)}
+	batch := &types.Batch{Events: []*types.Event{
+		row(types.EventInsert, 10, 1, "a"),
+		row(types.EventInsert, 11, 2, "b"),
+		row(types.EventUpdate, 12, 1, "c"),
+		row(types.EventDelete, 13, 2, ""),
+		row(types.EventInsert, 13, 3, "x"),
+		moved,
+		{Type: types.EventInsert, Schema: "public", Table: "orders", Columns: map[string]interface{}{"id": int64(1)}, LSN: 15},
+	}}
+	if err := s.Write(ctx, batch); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %q (%v)", mode, err)
+	}
+	var lsn string
+	if err := db.QueryRow("SELECT lsn FROM _replicator_state").Scan(&lsn); err != nil || lsn != types.LSN(15).String() {
+		t.Errorf("Expected applied LSN %s, got %q (%v)", types.LSN(15), lsn, err)
+	}
+	var orders int
+	db.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'public.orders'").Scan(&orders)
+	if orders != 0 {
+		t.Error("Expected tables outside the filter to be skipped")
+	}
+
+	rows, err := db.Query(`SELECT id, name, active, avatar, typeof(id) FROM "public.users" ORDER BY id`)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var got []string
+	for rows.Next() {
+		var id, active int64
+		var name, idType string
+		var avatar []byte
+		if err := rows.Scan(&id, &name, &active, &avatar, &idType); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if active != 1 || len(avatar) != 2 || idType != "integer" {
+			t.Errorf("Unexpected values for id %d: active=%d avatar=%x id type=%s", id, active, avatar, idType)
+		}
+		got = append(got, name)
+	}
+	rows.Close()
+	if len(got) != 2 || got[0] != "c" || got[1] != "d" {
+		t.Errorf("Expected rows [c d], got %v", got)
+	}
+
+	// A new instance resumes from the file and skips what it already holds
+	s, err = NewSQLiteSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen sqlite sink: %v", err)
+	}
+	defer s.Close()
+	if s.AppliedLSN() != 15 {
+		t.Errorf("Expected applied LSN 15, got %s", s.AppliedLSN())
+	}
+	added := row(types.EventInsert, 16, 5, "e")
+	added.Columns["email"] = "e@example.com"
+	if err := s.Write(ctx, &types.Batch{Events: []*types.Event{row(types.EventDelete, 13, 1, ""), added}}); err != nil {
+		t.Fatalf("Write after reopen failed: %v", err)
+	}
+	var n int
+	db.QueryRow(`SELECT count(*) FROM "public.users"`).Scan(&n)
+	if n != 3 {
+		t.Errorf("Expected the replayed delete to be skipped and a new row added, got %d rows", n)
+	}
+	var email string
+	if err := db.QueryRow(`SELECT email FROM "public.users" WHERE id = 5`).Scan(&email); err != nil || email != "e@example.com" {
+		t.Errorf("Expected the new column to be added, got %q (%v)", email, err)
+	}
+}
+
+func TestSQLiteSinkTablesOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.SQLiteTarget{TargetBase: config.TargetBase{Name: "edge"}, Path: filepath.Join(t.TempDir(), "edge.db")}
+	insert := func(table string, lsn types.LSN, id int64) *types.Event {
+		return &types.Event{Type: types.EventInsert, Schema: "public", Table: table, LSN: lsn,
+			Columns: map[string]interface{}{"id": id}, Identity: map[string]interface{}{"id": id}}
+	}
+
+	s, err := NewSQLiteSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create sqlite sink: %v", err)
+	}
+	// Workers write tables concurrently: a later table's batch can commit
+	// before an earlier one of another table
+	if err := s.Write(ctx, &types.Batch{Events: []*types.Event{insert("orders", 2000, 1)}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := s.Write(ctx, &types.Batch{Events: []*types.Event{insert("users", 1000, 1), insert("users", 1500, 2)}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	count := func(table string) int {
+		var n int
+		if err := s.db.QueryRow("SELECT count(*) FROM " + quoteSQLite(table)).Scan(&n); err != nil {
+			t.Fatalf("Count of %s failed: %v", table, err)
+		}
+		return n
+	}
+	if n := count("public.users"); n != 2 {
+		t.Errorf("Expected the earlier users batch to be applied, got %d rows", n)
+	}
+	s.Close()
+
+	// After a restart each table skips only what it holds itself
+	s, err = NewSQLiteSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen sqlite sink: %v", err)
+	}
+	defer s.Close()
+	if s.AppliedLSN() != 2000 {
+		t.Errorf("Expected applied LSN 2000, got %s", s.AppliedLSN())
+	}
+	replay := &types.Batch{Events: []*types.Event{insert("users", 1500, 3), insert("users", 1600, 4), insert("orders", 1900, 2)}}
+	if err := s.Write(ctx, replay); err != nil {
+		t.Fatalf("Write after reopen failed: %v", err)
+	}
+	if users, orders := count("public.users"), count("public.orders"); users != 3 || orders != 1 {
+		t.Errorf("Expected 3 users and 1 order, got %d and %d", users, orders)
+	}
+}
+
+func TestSQLiteSinkSchemas(t *testing.T) {
+	ctx := context.Background()
+	cfg := config.SQLiteTarget{TargetBase: config.TargetBase{Name: "edge"}, Path: filepath.Join(t.TempDir(), "edge.db")}
+	insert := func(schema string, lsn types.LSN, id int64) *types.Event {
+		return &types.Event{Type: types.EventInsert, Schema: schema, Table: "users", LSN: lsn,
+			Columns: map[string]interface{}{"id": id}, Identity: map[string]interface{}{"id": id}}
+	}
+
+	s, err := NewSQLiteSink(ctx, cfg)
+	if err != nil {
+		t.Fatalf("Failed to create sqlite sink: %v", err)
+	}
+	defer s.Close()
+	if err := s.Write(ctx, &types.Batch{Events: []*types.Event{insert("a", 2000, 1)}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// An earlier change of another schema's table is not already applied
+	if err := s.Write(ctx, &types.Batch{Events: []*types.Event{insert("b", 1000, 1), insert("b", 1100, 2)}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	for table, want := range map[string]int{"a.users": 1, "b.users": 2} {
+		var n int
+		if err := s.db.QueryRow("SELECT count(*) FROM " + quoteSQLite(table)).Scan(&n); err != nil || n != want {
+			t.Errorf("Expected %d rows in %s, got %d (%v)", want, table, n, err)
+		}
+	}
+	var lsn string
+	if err := s.db.QueryRow("SELECT lsn FROM _replicator_tables WHERE name = 'b.users'").Scan(&lsn); err != nil || lsn != types.LSN(1100).String() {
+		t.Errorf("Expected b.users at %s, got %q (%v)", types.LSN(1100), lsn, err)
+	}
+}
@@ -0,0 +1,37 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// Reporter receives the outcome of a sink's writes, e.g. for the status
+// endpoint.
+type Reporter interface {
+	Flushed(lsn types.LSN)
+	Failed(err error)
+}
+
+// StatusSink reports every write of the sink it wraps.
+type StatusSink struct {
+	next     Sink
+	reporter Reporter
+}
+
+func NewStatusSink(next Sink, reporter Reporter) *StatusSink {
+	return &StatusSink{next: next, reporter: reporter}
+}
+
+func (s *StatusSink) Write(ctx context.Context, batch *types.Batch) error {
+	if err := s.next.Write(ctx, batch); err != nil {
+		s.reporter.Failed(err)
+		return err
+	}
+	s.reporter.Flushed(batch.MaxLSN)
+	return nil
+}
+
+func (s *StatusSink) Close() error {
+	return s.next.Close()
+}
@@ -0,0 +1,37 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+type recordingReporter struct {
+	flushed []types.LSN
+	errs    []error
+}
+
+func (r *recordingReporter) Flushed(lsn types.LSN) { r.flushed = append(r.flushed, lsn) }
+func (r *recordingReporter) Failed(err error)      { r.errs = append(r.errs, err) }
+
+func TestStatusSink(t *testing.T) {
+	fail := errors.New("unreachable")
+	var writeErr error
+	rep := &recordingReporter{}
+	s := NewStatusSink(&mockSink{writeFunc: func(ctx context.Context, batch *types.Batch) error {
+		return writeErr
+	}}, rep)
+
+	if err := s.Write(context.Background(), &types.Batch{MaxLSN: 42}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	writeErr = fail
+	if err := s.Write(context.Background(), &types.Batch{MaxLSN: 43}); !errors.Is(err, fail) {
+		t.Errorf("Expected the sink's error, got %v", err)
+	}
+	if len(rep.flushed) != 1 || rep.flushed[0] != 42 || len(rep.errs) != 1 {
+		t.Errorf("Unexpected reports: flushed %v, errors %v", rep.flushed, rep.errs)
+	}
+}
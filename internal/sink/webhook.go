@@ -0,0 +1,284 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/debezium"
+	"github.com/nikolay-makurin/replicator/internal/keytemplate"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// Request headers set by the webhook sink
+const (
+	webhookSignatureHeader = "X-Replicator-Signature"
+	webhookTimestampHeader = "X-Replicator-Timestamp"
+	webhookIdempotencyKey  = "Idempotency-Key"
+)
+
+// WebhookSink sends batches of changes to an HTTP endpoint, either the
+// whole batch in one request or one request per table. 5xx and 429
+// responses are retried (honouring Retry-After), other 4xx responses fail
+// the batch permanently.
+type WebhookSink struct {
+	name     string
+	url      string
+	method   string
+	format   string
+	mode     string
+	secret   []byte
+	headers  map[string]*template.Template
+	envelope *debezium.Encoder // nil sends native change records
+	client   *http.Client
+	sem      chan struct{} // Limits requests in flight across Write calls
+	byteCount
+}
+
+func NewWebhookSink(cfg config.WebhookTarget) (*WebhookSink, error) {
+	headers := make(map[string]*template.Template, len(cfg.Headers))
+	for name, value := range cfg.Headers {
+		t, err := keytemplate.Parse("header", value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook header %s: %w", name, err)
+		}
+		headers[name] = t
+	}
+	method := cfg.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	concurrency := cfg.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &WebhookSink{
+		name:     cfg.Name,
+		url:      cfg.URL,
+		method:   strings.ToUpper(method),
+		format:   cfg.Format,
+		mode:     cfg.Mode,
+		secret:   []byte(cfg.Secret),
+		headers:  headers,
+		envelope: newEnvelopeEncoder(cfg.Envelope),
+		client:   &http.Client{Timeout: cfg.Timeout},
+		sem:      make(chan struct{}, concurrency),
+	}, nil
+}
+
+func (s *WebhookSink) Write(ctx context.Context, batch *types.Batch) error {
+	var events []*types.Event
+	for _, e := range batch.Events {
+		if e.Type == types.EventInsert || e.Type == types.EventUpdate || e.Type == types.EventDelete {
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	if s.mode != config.WebhookModeTable {
+		return s.send(ctx, events)
+	}
+
+	// One request per table, in order of first appearance
+	var order []string
+	groups := make(map[string][]*types.Event)
+	for _, e := range events {
+		key := e.Schema + "." + e.Table
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
+
+	errs := make([]error, len(order))
+	var wg sync.WaitGroup
+	for i, key := range order {
+		wg.Add(1)
+		go func(i int, events []*types.Event) {
+			defer wg.Done()
+			errs[i] = s.send(ctx, events)
+		}(i, groups[key])
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// send posts one request with events, which are in LSN order.
+func (s *WebhookSink) send(ctx context.Context, events []*types.Event) error {
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.sem }()
+
+	body, contentType, err := s.encode(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, s.method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to create webhook request: %w", err))
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	first, last := events[0], events[len(events)-1]
+	schema, table := first.Schema, first.Table
+	for _, e := range events {
+		if e.Schema != schema || e.Table != table {
+			schema, table = "", "" // Mixed batch
+			break
+		}
+	}
+	data := map[string]interface{}{
+		"schema":    schema,
+		"table":     table,
+		"count":     len(events),
+		"first_lsn": first.LSN.String(),
+		"last_lsn":  last.LSN.String(),
+	}
+	for name, t := range s.headers {
+		var value strings.Builder
+		if err := t.Execute(&value, data); err != nil {
+			return Permanent(fmt.Errorf("cannot build webhook header %s: %w", name, err))
+		}
+		if value.Len() > 0 {
+			req.Header.Set(name, value.String())
+		}
+	}
+
+	// The key stays the same when the batch is retried or replayed
+	req.Header.Set(webhookIdempotencyKey, fmt.Sprintf("%s:%s.%s:%s-%s", s.name, schema, table, first.LSN, last.LSN))
+
+	if len(s.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(s.secret, ts, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode < 300:
+		s.addBytes(len(body))
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		err := fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return RetryAfter(err, delay)
+		}
+		return err
+	default:
+		return Permanent(fmt.Errorf("webhook returned %s: %s", resp.Status, bytes.TrimSpace(msg)))
+	}
+}
+
+// webhookSignature is the hex HMAC-SHA256 of "<timestamp>.<body>". Signing
+// the timestamp lets receivers reject replayed requests.
+func webhookSignature(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// cloudEvent is a change in the CloudEvents 1.0 JSON format.
+type cloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject"`
+	Time            string      `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+func (s *WebhookSink) encode(events []*types.Event) ([]byte, string, error) {
+	var v interface{}
+	contentType := "application/json"
+
+	records := make([]interface{}, len(events))
+	for i, e := range events {
+		if s.envelope == nil {
+			records[i] = newChangeRecord(e)
+			continue
+		}
+		env, err := s.envelope.Encode(e)
+		if err != nil {
+			return nil, "", Permanent(err)
+		}
+		records[i] = json.RawMessage(env)
+	}
+
+	if s.format == config.WebhookFormatCloudEvents {
+		batch := make([]cloudEvent, len(events))
+		for i, e := range events {
+			batch[i] = cloudEvent{
+				SpecVersion:     "1.0",
+				ID:              e.LSN.String(),
+				Source:          "replicator/" + s.name,
+				Type:            "replicator.change." + string(e.Type),
+				Subject:         e.Schema + "." + e.Table,
+				Time:            e.Timestamp.UTC().Format(time.RFC3339Nano),
+				DataContentType: "application/json",
+				Data:            records[i],
+			}
+		}
+		v = batch
+		contentType = "application/cloudevents-batch+json"
+	} else {
+		v = map[string]interface{}{"events": records}
+	}
+
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, "", Permanent(fmt.Errorf("failed to marshal webhook payload: %w", err))
+	}
+	return body, contentType, nil
+}
+
+func (s *WebhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
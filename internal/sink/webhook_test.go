@@ -0,0 +1,230 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/debezium"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func webhookTestEvents() []*types.Event {
+	return []*types.Event{
+		{Type: types.EventInsert, Schema: "public", Table: "users", Columns: map[string]interface{}{"id": int64(1)}, Identity: map[string]interface{}{"id": int64(1)}, LSN: 10},
+		{Type: types.EventInsert, Schema: "public", Table: "orders", Columns: map[string]interface{}{"id": int64(7)}, Identity: map[string]interface{}{"id": int64(7)}, LSN: 11},
+		{Type: types.EventDelete, Schema: "public", Table: "users", Identity: map[string]interface{}{"id": int64(1)}, LSN: 12},
+	}
+}
+
+func TestWebhookSinkSigned(t *testing.T) {
+	var got struct {
+		Events []changeRecord `json:"events"`
+	}
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		header = r.Header
+		want := "sha256=" + webhookSignature([]byte("s3cret"), r.Header.Get(webhookTimestampHeader), body)
+		if r.Header.Get(webhookSignatureHeader) != want {
+			t.Errorf("Expected signature %s, got %s", want, r.Header.Get(webhookSignatureHeader))
+		}
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Errorf("Invalid body %s: %v", body, err)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(config.WebhookTarget{
+		TargetBase: config.TargetBase{Name: "hook"},
+		URL:        srv.URL,
+		Secret:     "s3cret",
+		Headers:    map[string]string{"X-Count": "{{.count}}", "X-Range": "{{.first_lsn}}-{{.last_lsn}}", "X-Table": "{{.table}}"},
+		Mode:       config.WebhookModeBatch,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhook sink: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), &types.Batch{Events: webhookTestEvents()}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(got.Events) != 3 || got.Events[2].Op != "DELETE" {
+		t.Errorf("Expected 3 events ending with a delete, got %+v", got.Events)
+	}
+	if header.Get("X-Count") != "3" || header.Get("X-Range") != "0/A-0/C" {
+		t.Errorf("Unexpected templated headers: %v", header)
+	}
+	if _, ok := header["X-Table"]; ok {
+		t.Errorf("Expected no table header for a mixed batch, got %q", header.Get("X-Table"))
+	}
+	if header.Get(webhookIdempotencyKey) == "" {
+		t.Error("Expected an idempotency key")
+	}
+}
+
+func TestWebhookSinkPerTableCloudEvents(t *testing.T) {
+	var mu sync.Mutex
+	subjects := make(map[string][]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/cloudevents-batch+json" {
+			t.Errorf("Unexpected content type %s", ct)
+		}
+		var events []cloudEvent
+		if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+			t.Errorf("Invalid body: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range events {
+			subjects[r.Header.Get("X-Table")] = append(subjects[r.Header.Get("X-Table")], e.Subject+" "+e.Type)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(config.WebhookTarget{
+		TargetBase:  config.TargetBase{Name: "hook"},
+		URL:         srv.URL,
+		Format:      config.WebhookFormatCloudEvents,
+		Mode:        config.WebhookModeTable,
+		Headers:     map[string]string{"X-Table": "{{.table}}"},
+		Concurrency: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhook sink: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), &types.Batch{Events: webhookTestEvents()}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var tables []string
+	for table := range subjects {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	if len(tables) != 2 || tables[0] != "orders" || tables[1] != "users" {
+		t.Fatalf("Expected one request per table, got %v", subjects)
+	}
+	if users := subjects["users"]; len(users) != 2 || users[1] != "public.users replicator.change.DELETE" {
+		t.Errorf("Unexpected users events %v", users)
+	}
+}
+
+func TestWebhookSinkDebeziumEnvelope(t *testing.T) {
+	var got struct {
+		Events []debezium.Envelope `json:"events"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("Invalid body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(config.WebhookTarget{
+		TargetBase: config.TargetBase{Name: "hook"},
+		URL:        srv.URL,
+		Envelope:   config.EnvelopeConfig{Type: config.EnvelopeDebezium, Name: "shop", Database: "app"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create webhook sink: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), &types.Batch{Events: webhookTestEvents()}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if len(got.Events) != 3 {
+		t.Fatalf("Expected 3 envelopes, got %+v", got.Events)
+	}
+	if e := got.Events[0]; e.Op != debezium.OpCreate || e.After["id"] != 1.0 || e.Source.Name != "shop" || e.Source.DB != "app" {
+		t.Errorf("Unexpected insert envelope %+v", e)
+	}
+	if e := got.Events[2]; e.Op != debezium.OpDelete || e.After != nil || e.Before["id"] != 1.0 || e.Source.LSN != 12 {
+		t.Errorf("Unexpected delete envelope %+v", e)
+	}
+}
+
+func TestWebhookSinkResponses(t *testing.T) {
+	t.Run("retry after 429", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		}))
+		defer srv.Close()
+
+		s, err := NewWebhookSink(config.WebhookTarget{TargetBase: config.TargetBase{Name: "hook"}, URL: srv.URL})
+		if err != nil {
+			t.Fatalf("Failed to create webhook sink: %v", err)
+		}
+		rs := NewRetrySink(Labels{Name: "hook"}, s, config.RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+		defer rs.Close()
+
+		start := time.Now()
+		if err := rs.Write(context.Background(), &types.Batch{Events: webhookTestEvents()}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("Expected 2 requests, got %d", calls.Load())
+		}
+		if time.Since(start) < time.Second {
+			t.Error("Expected to wait for Retry-After")
+		}
+	})
+
+	t.Run("permanent 400", func(t *testing.T) {
+		var calls atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			http.Error(w, "bad payload", http.StatusBadRequest)
+		}))
+		defer srv.Close()
+
+		s, err := NewWebhookSink(config.WebhookTarget{TargetBase: config.TargetBase{Name: "hook"}, URL: srv.URL})
+		if err != nil {
+			t.Fatalf("Failed to create webhook sink: %v", err)
+		}
+		rs := NewRetrySink(Labels{Name: "hook"}, s, config.RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond})
+		defer rs.Close()
+
+		if err := rs.Write(context.Background(), &types.Batch{Events: webhookTestEvents()}); err == nil {
+			t.Fatal("Expected error")
+		}
+		if calls.Load() != 1 {
+			t.Errorf("Expected no retries, got %d requests", calls.Load())
+		}
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"Mon, 01 Jan 2024 00:00:30 GMT", 30 * time.Second, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
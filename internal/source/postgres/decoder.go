@@ -8,6 +8,7 @@ import (
 
 	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/nikolay-makurin/replicator/pkg/types"
 )
 
 func decodeTuple(tuple *pglogrepl.TupleData, rel *pglogrepl.RelationMessage, typeMap *pgtype.Map) (map[string]interface{}, error) {
@@ -42,6 +43,41 @@ func decodeTuple(tuple *pglogrepl.TupleData, rel *pglogrepl.RelationMessage, typ
 	return values, nil
 }
 
+// newRelation converts a RelationMessage into the column definitions
+// attached to events.
+func newRelation(rel *pglogrepl.RelationMessage) *types.Relation {
+	r := &types.Relation{
+		Schema:  rel.Namespace,
+		Table:   rel.RelationName,
+		Columns: make([]types.Column, len(rel.Columns)),
+	}
+	for i, col := range rel.Columns {
+		r.Columns[i] = types.Column{
+			Name:     col.Name,
+			Type:     col.DataType,
+			Modifier: col.TypeModifier,
+			Key:      col.Flags&1 != 0,
+		}
+	}
+	return r
+}
+
+// keyValues returns the replica identity columns of a decoded tuple.
+// pgoutput flags these columns in the RelationMessage; with REPLICA
+// IDENTITY FULL every column is flagged.
+func keyValues(values map[string]interface{}, rel *pglogrepl.RelationMessage) map[string]interface{} {
+	key := make(map[string]interface{})
+	for _, col := range rel.Columns {
+		if col.Flags&1 == 0 {
+			continue
+		}
+		if v, ok := values[col.Name]; ok {
+			key[col.Name] = v
+		}
+	}
+	return key
+}
+
 func decodeText(data []byte, oid uint32) (interface{}, error) {
 	s := string(data)
 	switch oid {
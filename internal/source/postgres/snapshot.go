@@ -0,0 +1,155 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// snapshot reads every row of table in one repeatable read transaction and
+// sends them as inserts.
+//
+// Transactions still open when the snapshot is taken are not in it, yet the
+// stream delivers them afterwards with the LSNs of their changes, which may
+// be older than the snapshot. Rows are therefore versioned just below the
+// slot's restart LSN, before any change the stream can still deliver, so
+// sinks that keep the highest version (the Redis version guard,
+// Elasticsearch external versions, ClickHouse versioned engines) let those
+// changes win over the snapshot.
+func (s *Source) snapshot(ctx context.Context, table string) (int, error) {
+	schema, name := "public", table
+	if i := strings.IndexByte(table, '.'); i >= 0 {
+		schema, name = table[:i], table[i+1:]
+	}
+
+	conn, err := s.connectQuery(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx) // Ends the transaction
+
+	if err := conn.Exec(ctx, "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY").Close(); err != nil {
+		return 0, fmt.Errorf("failed to begin snapshot: %w", err)
+	}
+
+	// The first query takes the snapshot. The slot cannot advance past
+	// changes not yet streamed while the snapshot runs, as they are only
+	// confirmed once the source goroutine receives them
+	result := conn.ExecParams(ctx, "SELECT restart_lsn FROM pg_replication_slots WHERE slot_name = $1",
+		[][]byte{[]byte(s.cfg.SlotName)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return 0, fmt.Errorf("failed to read the restart LSN of slot %s: %w", s.cfg.SlotName, result.Err)
+	}
+	if len(result.Rows) == 0 || result.Rows[0][0] == nil {
+		return 0, fmt.Errorf("slot %s has no restart LSN", s.cfg.SlotName)
+	}
+	restart, err := pglogrepl.ParseLSN(string(result.Rows[0][0]))
+	if err != nil {
+		return 0, fmt.Errorf("invalid restart LSN: %w", err)
+	}
+	version := snapshotVersion(types.LSN(restart))
+
+	keys, err := s.snapshotKeys(ctx, conn, schema, name)
+	if err != nil {
+		return 0, err
+	}
+
+	ident := pgx.Identifier{schema, name}.Sanitize()
+	rr := conn.ExecParams(ctx, "SELECT * FROM "+ident, nil, nil, nil, nil)
+	fields := rr.FieldDescriptions()
+	rel := &types.Relation{Schema: schema, Table: name, Columns: make([]types.Column, len(fields))}
+	for i, f := range fields {
+		_, key := keys[f.Name]
+		rel.Columns[i] = types.Column{Name: f.Name, Type: f.DataTypeOID, Modifier: f.TypeModifier, Key: key}
+	}
+
+	n := 0
+	now := time.Now()
+	for rr.NextRow() {
+		vals := make(map[string]interface{}, len(fields))
+		for i, data := range rr.Values() {
+			if data == nil {
+				vals[fields[i].Name] = nil
+				continue
+			}
+			v, err := decodeText(data, fields[i].DataTypeOID)
+			if err != nil {
+				rr.Close()
+				return n, err
+			}
+			vals[fields[i].Name] = v
+		}
+		if err := s.emit(ctx, snapshotEvent(rel, keys, vals, version, now)); err != nil {
+			rr.Close()
+			return n, err
+		}
+		n++
+	}
+	if _, err := rr.Close(); err != nil {
+		return n, fmt.Errorf("failed to read %s: %w", ident, err)
+	}
+	return n, nil
+}
+
+// snapshotVersion is the LSN of snapshot rows: below every change the
+// stream can deliver after a snapshot taken at the slot's restart LSN.
+func snapshotVersion(restart types.LSN) types.LSN {
+	if restart == 0 {
+		return 0
+	}
+	return restart - 1
+}
+
+// snapshotEvent is the insert of one snapshot row.
+func snapshotEvent(rel *types.Relation, keys map[string]struct{}, vals map[string]interface{}, version types.LSN, now time.Time) *types.Event {
+	identity := make(map[string]interface{}, len(keys))
+	for col := range keys {
+		identity[col] = vals[col]
+	}
+	return &types.Event{
+		Type:      types.EventInsert,
+		Schema:    rel.Schema,
+		Table:     rel.Table,
+		Columns:   vals,
+		Identity:  identity,
+		LSN:       version,
+		Timestamp: now,
+		Relation:  rel,
+		Snapshot:  true,
+	}
+}
+
+// snapshotKeys returns the replica identity columns of a table: those the
+// stream announced, or else the primary key.
+func (s *Source) snapshotKeys(ctx context.Context, conn *pgconn.PgConn, schema, name string) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	for _, rel := range s.relations {
+		if rel.Namespace == schema && rel.RelationName == name {
+			for _, col := range rel.Columns {
+				if col.Flags&1 != 0 {
+					keys[col.Name] = struct{}{}
+				}
+			}
+			return keys, nil
+		}
+	}
+
+	const query = `SELECT a.attname FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::regclass AND i.indisprimary`
+	ident := pgx.Identifier{schema, name}.Sanitize()
+	result := conn.ExecParams(ctx, query, [][]byte{[]byte(ident)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return nil, fmt.Errorf("failed to read the primary key of %s: %w", ident, result.Err)
+	}
+	for _, row := range result.Rows {
+		keys[string(row[0])] = struct{}{}
+	}
+	return keys, nil
+}
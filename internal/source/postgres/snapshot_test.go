@@ -0,0 +1,33 @@
+package postgres
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+func TestSnapshotEvent(t *testing.T) {
+	rel := &types.Relation{Schema: "public", Table: "users", Columns: []types.Column{
+		{Name: "id", Type: 20, Key: true},
+		{Name: "name", Type: 25},
+	}}
+	keys := map[string]struct{}{"id": {}}
+	restart := types.LSN(0x16B3748)
+
+	e := snapshotEvent(rel, keys, map[string]interface{}{"id": int64(1), "name": "a"}, snapshotVersion(restart), time.Now())
+	if !e.Snapshot || e.Type != types.EventInsert || e.Schema != "public" || e.Table != "users" {
+		t.Errorf("Unexpected snapshot event %+v", e)
+	}
+	if len(e.Identity) != 1 || e.Identity["id"] != int64(1) {
+		t.Errorf("Expected the key as identity, got %v", e.Identity)
+	}
+	// Changes still to come from the stream start at the restart LSN and
+	// must win over the snapshot in sinks that keep the highest version
+	if e.LSN >= restart {
+		t.Errorf("Expected a version below the restart LSN %s, got %s", restart, e.LSN)
+	}
+	if v := snapshotVersion(0); v != 0 {
+		t.Errorf("Expected version 0 for an unset restart LSN, got %s", v)
+	}
+}
@@ -4,33 +4,53 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgproto3"
 	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/nikolay-makurin/replicator/internal/admin"
 	"github.com/nikolay-makurin/replicator/internal/config"
 	"github.com/nikolay-makurin/replicator/internal/pipeline"
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
 	"github.com/nikolay-makurin/replicator/pkg/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Source struct {
 	cfg        config.SourceConfig
 	conn       *pgconn.PgConn
 	relations  map[uint32]*pglogrepl.RelationMessage
+	schemas    map[uint32]*types.Relation // Column definitions attached to events
+	xid        uint32                     // Transaction being received
 	typeMap    *pgtype.Map
 	checkpoint *pipeline.CheckpointManager
 	outCh      chan<- *types.Event
+	status     *telemetry.PipelineStatus
+	heartbeat  *time.Ticker
+	tx         trace.Span // Span of the transaction being received
+
+	pause     admin.Gate
+	snapshots chan string     // Tables to re-snapshot
+	confirms  chan chan error // Requests to confirm the safe LSN now
 }
 
-func NewSource(cfg config.SourceConfig, cm *pipeline.CheckpointManager, out chan<- *types.Event) *Source {
+func NewSource(cfg config.SourceConfig, cm *pipeline.CheckpointManager, out chan<- *types.Event, status *telemetry.PipelineStatus) *Source {
 	return &Source{
 		cfg:        cfg,
 		checkpoint: cm,
 		outCh:      out,
+		status:     status,
+		snapshots:  make(chan string, 16),
+		confirms:   make(chan chan error),
 		relations:  make(map[uint32]*pglogrepl.RelationMessage),
+		schemas:    make(map[uint32]*types.Relation),
 		typeMap:    pgtype.NewMap(),
+		tx:         trace.SpanFromContext(context.Background()), // No-op until the first transaction
 	}
 }
 
@@ -78,18 +98,56 @@ func (s *Source) Start(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("StartReplication failed: %w", err)
 	}
+	s.status.SetSlot(telemetry.SlotInfo{
+		Name:        s.cfg.SlotName,
+		Publication: s.cfg.Publication,
+		SystemID:    sysident.SystemID,
+		Timeline:    sysident.Timeline,
+		StartLSN:    types.LSN(startLSN),
+	})
+	s.status.SetStreaming(true)
+	defer s.status.SetStreaming(false)
+	go s.monitorSlot(ctx)
 
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	s.heartbeat = time.NewTicker(10 * time.Second)
+	defer s.heartbeat.Stop()
 
 	for {
+		// While paused, messages stay on the server and only heartbeats are
+		// sent, so the slot holds the WAL
+		if resumed := s.pause.Resumed(); resumed != nil {
+			s.status.SetSourcePaused(true)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-s.heartbeat.C:
+				if err := s.sendStandbyStatus(ctx); err != nil {
+					slog.Error("Failed to send heartbeat", "error", err)
+				}
+			case done := <-s.confirms:
+				done <- s.sendStandbyStatus(ctx)
+			case <-resumed:
+				s.status.SetSourcePaused(false)
+			}
+			continue
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-ticker.C:
+		case <-s.heartbeat.C:
 			if err := s.sendStandbyStatus(ctx); err != nil {
 				slog.Error("Failed to send heartbeat", "error", err)
 			}
+		case done := <-s.confirms:
+			done <- s.sendStandbyStatus(ctx)
+		case table := <-s.snapshots:
+			n, err := s.snapshot(ctx, table)
+			if err != nil {
+				slog.Error("Snapshot failed", "table", table, "error", err)
+				continue
+			}
+			slog.Info("Snapshot finished", "table", table, "rows", n)
 		default:
 			ctxTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
 			msg, err := conn.ReceiveMessage(ctxTimeout)
@@ -111,6 +169,7 @@ func (s *Source) Start(ctx context.Context) error {
 						slog.Error("ParsePrimaryKeepaliveMessage failed", "error", err)
 						continue
 					}
+					s.recordWALEnd(pkm.ServerWALEnd)
 					if pkm.ReplyRequested {
 						s.sendStandbyStatus(ctx)
 					}
@@ -120,7 +179,8 @@ func (s *Source) Start(ctx context.Context) error {
 						slog.Error("ParseXLogData failed", "error", err)
 						continue
 					}
-					if err := s.handleLogicalMsg(xld); err != nil {
+					s.recordWALEnd(xld.ServerWALEnd)
+					if err := s.handleLogicalMsg(ctx, xld); err != nil {
 						slog.Error("Handle logical msg failed", "error", err)
 					}
 				}
@@ -133,79 +193,298 @@ func (s *Source) Start(ctx context.Context) error {
 
 func (s *Source) sendStandbyStatus(ctx context.Context) error {
 	safeLSN := s.checkpoint.GetSafeLSN()
-	return pglogrepl.SendStandbyStatusUpdate(ctx, s.conn, pglogrepl.StandbyStatusUpdate{
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, s.conn, pglogrepl.StandbyStatusUpdate{
 		WALWritePosition: pglogrepl.LSN(safeLSN),
 		WALFlushPosition: pglogrepl.LSN(safeLSN),
 		WALApplyPosition: pglogrepl.LSN(safeLSN),
 		ClientTime:       time.Now(),
 		ReplyRequested:   false,
 	})
+	if err == nil {
+		s.status.SetConfirmed(safeLSN)
+	}
+	return err
 }
 
-func (s *Source) handleLogicalMsg(xld pglogrepl.XLogData) error {
-	logicalMsg, err := pglogrepl.Parse(xld.WALData)
+// recordWALEnd updates the lag behind the server's WAL end. With nothing in
+// flight the pipeline has caught up, whatever else the WAL holds.
+func (s *Source) recordWALEnd(end pglogrepl.LSN) {
+	s.status.SetWALEnd(types.LSN(end))
+	var lag float64
+	if s.checkpoint.Inflight() > 0 {
+		if safe := s.checkpoint.GetSafeLSN(); types.LSN(end) > safe {
+			lag = float64(types.LSN(end) - safe)
+		}
+	} else {
+		telemetry.LagSeconds.WithLabelValues(s.status.Name()).Set(0)
+	}
+	telemetry.LagBytes.WithLabelValues(s.status.Name()).Set(lag)
+}
+
+// slotCheckInterval is how often the slot's retained WAL is read.
+const slotCheckInterval = 30 * time.Second
+
+// monitorSlot records the WAL the server retains for the slot until ctx is
+// done.
+func (s *Source) monitorSlot(ctx context.Context) {
+	ticker := time.NewTicker(slotCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.checkSlot(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("Failed to read slot size", "slot", s.cfg.SlotName, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Source) checkSlot(ctx context.Context) error {
+	conn, err := s.connectQuery(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	const query = `SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn)::bigint
+		FROM pg_replication_slots WHERE slot_name = $1`
+	result := conn.ExecParams(ctx, query, [][]byte{[]byte(s.cfg.SlotName)}, nil, nil, nil).Read()
+	if result.Err != nil {
+		return result.Err
+	}
+	if len(result.Rows) == 0 || result.Rows[0][0] == nil {
+		return fmt.Errorf("slot %s not found or without restart LSN", s.cfg.SlotName)
+	}
+	retained, err := strconv.ParseInt(string(result.Rows[0][0]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid slot size: %w", err)
+	}
+	s.status.SetRetainedWAL(retained)
+	return nil
+}
+
+// connectQuery opens a regular connection for queries, which the
+// replication connection cannot run while streaming.
+func (s *Source) connectQuery(ctx context.Context) (*pgconn.PgConn, error) {
+	cfg, err := pgconn.ParseConfig(s.cfg.ConnectionString)
 	if err != nil {
+		return nil, fmt.Errorf("invalid connection string: %w", err)
+	}
+	delete(cfg.RuntimeParams, "replication")
+	conn, err := pgconn.ConnectConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	return conn, nil
+}
+
+// emit sends a change to the pipeline. Heartbeats continue while the
+// pipeline applies backpressure, e.g. with a paused sink, so that the
+// server does not time out the connection.
+func (s *Source) emit(ctx context.Context, e *types.Event) error {
+	s.status.SetReceived(e.LSN)
+	for {
+		select {
+		case s.outCh <- e:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.heartbeat.C:
+			if err := s.sendStandbyStatus(ctx); err != nil {
+				slog.Error("Failed to send heartbeat", "error", err)
+			}
+		}
+	}
+}
+
+// Pause stops receiving messages until Resume.
+func (s *Source) Pause() {
+	s.pause.Pause()
+}
+
+func (s *Source) Resume() {
+	s.pause.Resume()
+}
+
+// Resnapshot queues a snapshot of table, "table" or "schema.table". The
+// snapshot runs between messages, so it is ordered after the changes
+// received before it.
+func (s *Source) Resnapshot(table string) error {
+	select {
+	case s.snapshots <- table:
+		return nil
+	default:
+		return fmt.Errorf("too many snapshots queued")
+	}
+}
+
+// Confirm reports the safe LSN to the server now rather than with the next
+// heartbeat.
+func (s *Source) Confirm(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case s.confirms <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
 		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	s.checkpoint.Track(types.LSN(xld.WALStart))
+func (s *Source) handleLogicalMsg(ctx context.Context, xld pglogrepl.XLogData) error {
+	logicalMsg, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return err
+	}
 
 	switch logicalMsg := logicalMsg.(type) {
+	case *pglogrepl.BeginMessage:
+		s.xid = logicalMsg.Xid
+		telemetry.LagSeconds.WithLabelValues(s.status.Name()).Set(time.Since(logicalMsg.CommitTime).Seconds())
+		s.beginTx(ctx, logicalMsg)
+	case *pglogrepl.CommitMessage:
+		s.tx.End()
 	case *pglogrepl.RelationMessage:
 		s.relations[logicalMsg.RelationID] = logicalMsg
+		s.schemas[logicalMsg.RelationID] = newRelation(logicalMsg)
+	case *pglogrepl.InsertMessage, *pglogrepl.UpdateMessage, *pglogrepl.DeleteMessage:
+		return s.receive(ctx, logicalMsg, xld)
+	}
+	return nil
+}
+
+// beginTx starts the span of a transaction. The changes it contains are
+// recorded as its events and the batches they are written in link to it.
+func (s *Source) beginTx(ctx context.Context, msg *pglogrepl.BeginMessage) {
+	s.tx.End() // A transaction cut off by a reconnect
+	_, s.tx = telemetry.Tracer().Start(ctx, "transaction",
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("replicator.pipeline", s.status.Name()),
+			attribute.Int64("replicator.xid", int64(msg.Xid)),
+			attribute.String("replicator.commit_lsn", types.LSN(msg.FinalLSN).String()),
+		),
+	)
+}
+
+// receive decodes a row change, tracks it until it is written and
+// dispatches it to the workers. Only row changes are tracked: other
+// messages are never written, and share LSNs with the changes. In a
+// sampled transaction it is recorded as a change event of the transaction
+// span, with the time spent decoding it and waiting for a worker queue.
+func (s *Source) receive(ctx context.Context, msg pglogrepl.Message, xld pglogrepl.XLogData) error {
+	start := time.Now()
+	e, err := s.decode(msg, xld)
+	if err != nil {
+		s.tx.RecordError(err)
+		return err
+	}
+	s.checkpoint.Track(e.LSN)
+	if !s.tx.IsRecording() {
+		return s.emit(ctx, e)
+	}
+
+	telemetry.TraceEvent(e, s.tx.SpanContext())
+	decoded := time.Now()
+	// Blocks while the workers apply backpressure
+	if err = s.emit(ctx, e); err != nil {
+		telemetry.EventTrace(e) // Never reaches a worker
+	}
+	s.tx.AddEvent("change", trace.WithTimestamp(start), trace.WithAttributes(
+		attribute.String("replicator.lsn", e.LSN.String()),
+		attribute.String("replicator.table", e.Schema+"."+e.Table),
+		attribute.String("replicator.op", strings.ToLower(string(e.Type))),
+		attribute.Int64("replicator.decode_us", decoded.Sub(start).Microseconds()),
+		attribute.Int64("replicator.dispatch_us", time.Since(decoded).Microseconds()),
+	))
+	return err
+}
+
+// decode converts an insert, update or delete message to an event.
+func (s *Source) decode(msg pglogrepl.Message, xld pglogrepl.XLogData) (*types.Event, error) {
+	switch logicalMsg := msg.(type) {
 	case *pglogrepl.InsertMessage:
 		rel, ok := s.relations[logicalMsg.RelationID]
 		if !ok {
-			return fmt.Errorf("unknown relation ID %d", logicalMsg.RelationID)
+			return nil, fmt.Errorf("unknown relation ID %d", logicalMsg.RelationID)
 		}
 		vals, err := decodeTuple(logicalMsg.Tuple, rel, s.typeMap)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.outCh <- &types.Event{
+		return &types.Event{
 			Type:      types.EventInsert,
 			Schema:    rel.Namespace,
 			Table:     rel.RelationName,
 			Columns:   vals,
+			Identity:  keyValues(vals, rel),
 			LSN:       types.LSN(xld.WALStart),
+			XID:       s.xid,
 			Timestamp: xld.ServerTime,
-		}
+			Relation:  s.schemas[logicalMsg.RelationID],
+		}, nil
 	case *pglogrepl.UpdateMessage:
 		rel, ok := s.relations[logicalMsg.RelationID]
 		if !ok {
-			return fmt.Errorf("unknown relation ID %d", logicalMsg.RelationID)
+			return nil, fmt.Errorf("unknown relation ID %d", logicalMsg.RelationID)
 		}
 		vals, err := decodeTuple(logicalMsg.NewTuple, rel, s.typeMap)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.outCh <- &types.Event{
+		// The old tuple is only sent when the key changed (or with REPLICA
+		// IDENTITY FULL); otherwise the key is taken from the new tuple.
+		identity := keyValues(vals, rel)
+		var before map[string]interface{}
+		if logicalMsg.OldTuple != nil {
+			oldVals, err := decodeTuple(logicalMsg.OldTuple, rel, s.typeMap)
+			if err != nil {
+				return nil, err
+			}
+			identity = keyValues(oldVals, rel)
+			before = oldVals
+		}
+		return &types.Event{
 			Type:      types.EventUpdate,
 			Schema:    rel.Namespace,
 			Table:     rel.RelationName,
 			Columns:   vals,
+			Identity:  identity,
+			Before:    before,
 			LSN:       types.LSN(xld.WALStart),
+			XID:       s.xid,
 			Timestamp: xld.ServerTime,
-		}
+			Relation:  s.schemas[logicalMsg.RelationID],
+		}, nil
 	case *pglogrepl.DeleteMessage:
 		rel, ok := s.relations[logicalMsg.RelationID]
 		if !ok {
-			return fmt.Errorf("unknown relation ID %d", logicalMsg.RelationID)
+			return nil, fmt.Errorf("unknown relation ID %d", logicalMsg.RelationID)
 		}
 		// OLD tuple is usually in logicalMsg.OldTuple, but depends on REPLICA IDENTITY
 		// For now, assume we have it.
 		vals, err := decodeTuple(logicalMsg.OldTuple, rel, s.typeMap)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		s.outCh <- &types.Event{
+		return &types.Event{
 			Type:      types.EventDelete,
 			Schema:    rel.Namespace,
 			Table:     rel.RelationName,
-			Identity:  vals,
+			Identity:  keyValues(vals, rel),
+			Before:    vals,
 			LSN:       types.LSN(xld.WALStart),
+			XID:       s.xid,
 			Timestamp: xld.ServerTime,
-		}
+			Relation:  s.schemas[logicalMsg.RelationID],
+		}, nil
 	}
-	return nil
+	return nil, fmt.Errorf("unexpected message %T", msg)
 }
@@ -0,0 +1,84 @@
+package postgres
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/internal/pipeline"
+	"github.com/nikolay-makurin/replicator/internal/telemetry"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// pgoutput encodes logical replication messages as Postgres sends them.
+type pgoutput []byte
+
+func (b pgoutput) byte(v byte) pgoutput     { return append(b, v) }
+func (b pgoutput) uint16(v uint16) pgoutput { return binary.BigEndian.AppendUint16(b, v) }
+func (b pgoutput) uint32(v uint32) pgoutput { return binary.BigEndian.AppendUint32(b, v) }
+func (b pgoutput) uint64(v uint64) pgoutput { return binary.BigEndian.AppendUint64(b, v) }
+func (b pgoutput) string(v string) pgoutput { return append(append(b, v...), 0) }
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestSourceLagAfterApply(t *testing.T) {
+	ctx := context.Background()
+	cm := pipeline.NewCheckpointManager(0)
+	out := make(chan *types.Event, 10)
+	status := telemetry.NewStatus(time.Minute).Pipeline("lag")
+	s := NewSource(config.SourceConfig{}, cm, out, status)
+	s.heartbeat = time.NewTicker(time.Hour)
+	defer s.heartbeat.Stop()
+
+	// Postgres sends a relation at the LSN of the change that needs it
+	messages := []struct {
+		lsn  pglogrepl.LSN
+		data pgoutput
+	}{
+		{0x100, pgoutput{}.byte('B').uint64(0x130).uint64(0).uint32(7)},
+		{0x110, pgoutput{}.byte('R').uint32(1).string("public").string("users").byte('d').uint16(1).
+			byte(1).string("id").uint32(23).uint32(0xFFFFFFFF)},
+		{0x110, pgoutput{}.byte('I').uint32(1).byte('N').uint16(1).byte('t').uint32(1).byte('1')},
+		{0x130, pgoutput{}.byte('C').byte(0).uint64(0x120).uint64(0x130).uint64(0)},
+	}
+	for _, m := range messages {
+		if err := s.handleLogicalMsg(ctx, pglogrepl.XLogData{WALStart: m.lsn, WALData: m.data}); err != nil {
+			t.Fatalf("Failed to handle message at %s: %v", m.lsn, err)
+		}
+	}
+
+	lagBytes := telemetry.LagBytes.WithLabelValues("lag")
+	lagSeconds := telemetry.LagSeconds.WithLabelValues("lag")
+	s.recordWALEnd(0x200)
+	if lag := gaugeValue(t, lagBytes); lag != 0x200 {
+		t.Errorf("Expected 0x200 bytes of lag before the change is applied, got %v", lag)
+	}
+
+	e := <-out
+	cm.MarkDone(e.LSN)
+	s.recordWALEnd(0x200)
+	if n := cm.Inflight(); n != 0 {
+		t.Errorf("Expected nothing in flight, got %d", n)
+	}
+	if lsn := cm.GetSafeLSN(); lsn != 0x110 {
+		t.Errorf("Expected safe LSN 0/110, got %s", lsn)
+	}
+	if lag := gaugeValue(t, lagBytes); lag != 0 {
+		t.Errorf("Expected no lag once the transaction is applied, got %v bytes", lag)
+	}
+	if lag := gaugeValue(t, lagSeconds); lag != 0 {
+		t.Errorf("Expected no lag once the transaction is applied, got %v seconds", lag)
+	}
+}
@@ -0,0 +1,80 @@
+package replay
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/internal/changelog"
+	"github.com/nikolay-makurin/replicator/internal/pipeline"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+)
+
+// writeCSV writes events of one table as a file target does.
+func writeCSV(t *testing.T, path string, events ...*types.Event) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	header := changelog.CSVHeader(events[0])
+	w.Write(header)
+	for _, e := range events {
+		rec, _ := changelog.CSVRecord(header, e)
+		w.Write(rec)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSourceMergesFilesByLSN(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	event := func(table string, lsn types.LSN) *types.Event {
+		return &types.Event{Type: types.EventInsert, Schema: "public", Table: table, LSN: lsn, Timestamp: ts,
+			Columns: map[string]interface{}{"id": "1"}, Identity: map[string]interface{}{"id": "1"}}
+	}
+	// A transaction touching both tables is split across their files
+	writeCSV(t, filepath.Join(dir, "public.orders", "1.csv"), event("orders", 10), event("orders", 30))
+	writeCSV(t, filepath.Join(dir, "public.users", "1.csv"), event("users", 20), event("users", 30), event("users", 40))
+
+	cm := pipeline.NewCheckpointManager(0)
+	out := make(chan *types.Event, 10)
+	src := NewSource([]string{filepath.Join(dir, "*", "*.csv")}, cm, out)
+	if err := src.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	close(out)
+
+	type change struct {
+		table string
+		lsn   types.LSN
+	}
+	var got []change
+	for e := range out {
+		got = append(got, change{e.Table, e.LSN})
+	}
+	want := []change{{"orders", 10}, {"users", 20}, {"orders", 30}, {"users", 30}, {"users", 40}}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, got)
+			break
+		}
+	}
+	if n := cm.Inflight(); n != len(want) {
+		t.Errorf("Expected %d tracked changes, got %d", len(want), n)
+	}
+}
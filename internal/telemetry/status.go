@@ -0,0 +1,381 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Status collects the state of running pipelines for the /readyz and
+// /status endpoints.
+type Status struct {
+	// FlushTimeout is how long a sink may go without a successful flush
+	// while changes are waiting for it before it counts as not ready; 0
+	// disables the check.
+	FlushTimeout time.Duration
+
+	mu        sync.Mutex
+	pipelines []*PipelineStatus
+	now       func() time.Time
+}
+
+func NewStatus(flushTimeout time.Duration) *Status {
+	return &Status{FlushTimeout: flushTimeout, now: time.Now}
+}
+
+// Pipelines is the status served by the telemetry server.
+var Pipelines = NewStatus(time.Minute)
+
+// Pipeline returns the status of the named pipeline, registering it on
+// first use.
+func (s *Status) Pipeline(name string) *PipelineStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.pipelines {
+		if p.name == name {
+			return p
+		}
+	}
+	p := &PipelineStatus{name: name}
+	s.pipelines = append(s.pipelines, p)
+	return p
+}
+
+// PipelineStatus is updated by the source, dispatcher and sinks of one
+// pipeline.
+type PipelineStatus struct {
+	name string
+
+	mu          sync.Mutex
+	streaming   bool
+	paused      bool
+	receivedLSN types.LSN
+	walEnd      types.LSN // Server WAL end from the last message
+	slot        SlotInfo
+	safeLSN     func() types.LSN
+	queueDepths func() []int
+	sinks       []*SinkStatus
+}
+
+// SlotInfo describes the replication slot a source streams from.
+type SlotInfo struct {
+	Name         string    `json:"name"`
+	Publication  string    `json:"publication"`
+	SystemID     string    `json:"system_id,omitempty"`
+	Timeline     int32     `json:"timeline,omitempty"`
+	StartLSN     types.LSN `json:"-"`
+	ConfirmedLSN types.LSN `json:"-"` // Last LSN reported to the server as flushed
+	RetainedWAL  int64     `json:"retained_wal_bytes"`
+}
+
+// SetStreaming records whether the source is connected and streaming.
+func (p *PipelineStatus) SetStreaming(streaming bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.streaming = streaming
+}
+
+// SetSourcePaused records whether the source is paused.
+func (p *PipelineStatus) SetSourcePaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+}
+
+// Name returns the pipeline name.
+func (p *PipelineStatus) Name() string {
+	return p.name
+}
+
+// SetReceived records the LSN of the last change received from the source.
+func (p *PipelineStatus) SetReceived(lsn types.LSN) {
+	p.mu.Lock()
+	if lsn <= p.receivedLSN {
+		p.mu.Unlock()
+		return
+	}
+	p.receivedLSN = lsn
+	sinks := p.sinks
+	p.mu.Unlock()
+
+	for _, s := range sinks {
+		s.updateLag(lsn)
+	}
+}
+
+func (p *PipelineStatus) received() types.LSN {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.receivedLSN
+}
+
+// SetWALEnd records the server's WAL end.
+func (p *PipelineStatus) SetWALEnd(lsn types.LSN) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.walEnd = lsn
+}
+
+// SetRetainedWAL records the WAL the server retains for the slot.
+func (p *PipelineStatus) SetRetainedWAL(bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slot.RetainedWAL = bytes
+	SlotRetainedBytes.WithLabelValues(p.name, p.slot.Name).Set(float64(bytes))
+}
+
+// SetSlot records the slot the source streams from.
+func (p *PipelineStatus) SetSlot(slot SlotInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slot = slot
+}
+
+// SetConfirmed records the LSN last confirmed to the server.
+func (p *PipelineStatus) SetConfirmed(lsn types.LSN) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.slot.ConfirmedLSN = lsn
+}
+
+// Observe sets the functions reporting the safe LSN and the depth of each
+// worker queue.
+func (p *PipelineStatus) Observe(safeLSN func() types.LSN, queueDepths func() []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.safeLSN = safeLSN
+	p.queueDepths = queueDepths
+}
+
+// Sink returns the status of the named sink, registering it on first use.
+func (p *PipelineStatus) Sink(name string) *SinkStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sinks {
+		if s.name == name {
+			return s
+		}
+	}
+	s := &SinkStatus{
+		name:       name,
+		now:        time.Now,
+		pipeline:   p,
+		applied:    SinkAppliedLSN.WithLabelValues(p.name, name),
+		lag:        SinkLagBytes.WithLabelValues(p.name, name),
+		registered: time.Now(),
+	}
+	p.sinks = append(p.sinks, s)
+	return s
+}
+
+// SinkStatus records the outcome of a sink's writes.
+type SinkStatus struct {
+	name     string
+	now      func() time.Time
+	pipeline *PipelineStatus
+	applied  prometheus.Gauge
+	lag      prometheus.Gauge
+
+	registered time.Time // Stands in for the last flush until the first one
+
+	mu          sync.Mutex
+	paused      bool
+	appliedLSN  types.LSN
+	lastFlush   time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// Flushed records a successful write of a batch up to lsn. Workers write
+// different tables concurrently, so the applied LSN is the highest of any
+// batch written; changes below it may still be waiting in another worker.
+func (s *SinkStatus) Flushed(lsn types.LSN) {
+	received := s.pipeline.received()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lsn > s.appliedLSN {
+		s.appliedLSN = lsn
+		s.applied.Set(float64(lsn))
+	}
+	s.lastFlush = s.now()
+	s.setLag(received)
+}
+
+func (s *SinkStatus) updateLag(received types.LSN) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLag(received)
+}
+
+func (s *SinkStatus) setLag(received types.LSN) {
+	var lag float64
+	if received > s.appliedLSN {
+		lag = float64(received - s.appliedLSN)
+	}
+	s.lag.Set(lag)
+}
+
+// SetPaused records whether the sink is paused.
+func (s *SinkStatus) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+// Failed records a failed write.
+func (s *SinkStatus) Failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err.Error()
+	s.lastErrorAt = s.now()
+}
+
+type pipelineReport struct {
+	Name        string       `json:"name"`
+	Streaming   bool         `json:"streaming"`
+	Paused      bool         `json:"paused"`
+	ReceivedLSN string       `json:"received_lsn"`
+	WALEnd      string       `json:"server_wal_end"`
+	SafeLSN     string       `json:"safe_lsn"`
+	QueueDepths []int        `json:"queue_depths"`
+	Slot        slotReport   `json:"slot"`
+	Sinks       []sinkReport `json:"sinks"`
+}
+
+type slotReport struct {
+	SlotInfo
+	StartLSN     string `json:"start_lsn"`
+	ConfirmedLSN string `json:"confirmed_lsn"`
+}
+
+type sinkReport struct {
+	Name        string     `json:"name"`
+	AppliedLSN  string     `json:"applied_lsn"`
+	LagBytes    uint64     `json:"lag_bytes"`
+	Paused      bool       `json:"paused"`
+	LastFlush   *time.Time `json:"last_flush,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Ready       bool       `json:"ready"`
+
+	problem string // Why the sink is not ready
+}
+
+func (p *PipelineStatus) report(now time.Time, flushTimeout time.Duration) pipelineReport {
+	p.mu.Lock()
+	r := pipelineReport{
+		Name:        p.name,
+		Streaming:   p.streaming,
+		Paused:      p.paused,
+		ReceivedLSN: p.receivedLSN.String(),
+		WALEnd:      p.walEnd.String(),
+		Slot: slotReport{
+			SlotInfo:     p.slot,
+			StartLSN:     p.slot.StartLSN.String(),
+			ConfirmedLSN: p.slot.ConfirmedLSN.String(),
+		},
+	}
+	received, safeLSN, queueDepths, sinks := p.receivedLSN, p.safeLSN, p.queueDepths, p.sinks
+	p.mu.Unlock()
+
+	if safeLSN != nil {
+		r.SafeLSN = safeLSN().String()
+	}
+	if queueDepths != nil {
+		r.QueueDepths = queueDepths()
+	}
+	for _, s := range sinks {
+		r.Sinks = append(r.Sinks, s.report(now, received, flushTimeout))
+	}
+	return r
+}
+
+// report describes the sink. A sink is ready unless its last write failed,
+// or changes have been waiting for it longer than flushTimeout while it was
+// not paused, counting from its registration until it first flushes.
+func (s *SinkStatus) report(now time.Time, received types.LSN, flushTimeout time.Duration) sinkReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := sinkReport{Name: s.name, AppliedLSN: s.appliedLSN.String(), Paused: s.paused, LastError: s.lastError}
+	if received > s.appliedLSN {
+		r.LagBytes = uint64(received - s.appliedLSN)
+	}
+	if !s.lastFlush.IsZero() {
+		flushed := s.lastFlush
+		r.LastFlush = &flushed
+	}
+	if !s.lastErrorAt.IsZero() {
+		failed := s.lastErrorAt
+		r.LastErrorAt = &failed
+	}
+
+	since := s.lastFlush
+	if since.IsZero() {
+		since = s.registered
+	}
+	switch {
+	case !s.lastErrorAt.IsZero() && s.lastErrorAt.After(s.lastFlush):
+		r.problem = "last write failed: " + s.lastError
+	case flushTimeout > 0 && !s.paused && r.LagBytes > 0 && now.Sub(since) > flushTimeout:
+		r.problem = "no successful flush since " + since.Format(time.RFC3339)
+	}
+	r.Ready = r.problem == ""
+	return r
+}
+
+func (s *Status) reports() []pipelineReport {
+	s.mu.Lock()
+	pipelines := append([]*PipelineStatus(nil), s.pipelines...)
+	s.mu.Unlock()
+
+	reports := make([]pipelineReport, len(pipelines))
+	for i, p := range pipelines {
+		reports[i] = p.report(s.now(), s.FlushTimeout)
+	}
+	return reports
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// ServeReady reports whether every source is streaming and every sink is
+// ready, listing the reasons if not.
+func (s *Status) ServeReady(w http.ResponseWriter, r *http.Request) {
+	var problems []string
+	reports := s.reports()
+	if len(reports) == 0 {
+		problems = append(problems, "no pipelines running")
+	}
+	for _, p := range reports {
+		if !p.Streaming {
+			problems = append(problems, fmt.Sprintf("pipeline %s: source is not streaming", p.Name))
+		}
+		for _, sink := range p.Sinks {
+			if !sink.Ready {
+				problems = append(problems, fmt.Sprintf("pipeline %s: sink %s: %s", p.Name, sink.Name, sink.problem))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(problems, "\n") + "\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// ServeStatus writes the state of every pipeline as JSON.
+func (s *Status) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{"pipelines": s.reports()})
+}
@@ -0,0 +1,141 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatusReadiness(t *testing.T) {
+	status := NewStatus(time.Minute)
+	ready := func() (int, string) {
+		rec := httptest.NewRecorder()
+		status.ServeReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, _ := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without pipelines, got %d", code)
+	}
+
+	p := status.Pipeline("orders")
+	pg := p.Sink("pg1")
+	if code, body := ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, "not streaming") {
+		t.Errorf("Expected 503 before the source streams, got %d %q", code, body)
+	}
+
+	p.SetStreaming(true)
+	p.SetReceived(100)
+	pg.Flushed(100)
+	if code, body := ready(); code != http.StatusOK {
+		t.Errorf("Expected 200, got %d %q", code, body)
+	}
+
+	pg.Failed(errors.New("connection refused"))
+	if code, body := ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, "sink pg1: last write failed: connection refused") {
+		t.Errorf("Expected 503 after a failed write, got %d %q", code, body)
+	}
+	pg.Flushed(100)
+	if code, _ := ready(); code != http.StatusOK {
+		t.Errorf("Expected 200 after a successful write, got %d", code)
+	}
+
+	// An idle sink stays ready; one with waiting changes does not
+	status.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if code, _ := ready(); code != http.StatusOK {
+		t.Errorf("Expected an idle sink to be ready, got %d", code)
+	}
+	p.SetReceived(200)
+	if code, body := ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, "no successful flush since") {
+		t.Errorf("Expected 503 for a stalled sink, got %d %q", code, body)
+	}
+	// A sink that never flushed is timed from its registration
+	status.Pipeline("orders").Sink("pg2")
+	pg.Flushed(200)
+	if code, body := ready(); code != http.StatusServiceUnavailable || !strings.Contains(body, "sink pg2: no successful flush since") {
+		t.Errorf("Expected 503 for a sink that never flushed, got %d %q", code, body)
+	}
+}
+
+func TestStatusReport(t *testing.T) {
+	status := NewStatus(time.Minute)
+	p := status.Pipeline("orders")
+	p.SetStreaming(true)
+	p.SetSlot(SlotInfo{Name: "orders_slot", Publication: "orders_pub", Timeline: 1, StartLSN: 0x10})
+	p.SetConfirmed(0x20)
+	p.SetReceived(0x1_00000040)
+	p.Observe(func() types.LSN { return 0x30 }, func() []int { return []int{2, 0} })
+	p.Sink("kafka").Flushed(0x1_00000000)
+	p.Sink("pg1").Failed(errors.New("timeout"))
+
+	rec := httptest.NewRecorder()
+	status.ServeStatus(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var got struct {
+		Pipelines []struct {
+			Name        string `json:"name"`
+			Streaming   bool   `json:"streaming"`
+			ReceivedLSN string `json:"received_lsn"`
+			SafeLSN     string `json:"safe_lsn"`
+			QueueDepths []int  `json:"queue_depths"`
+			Slot        struct {
+				Name         string `json:"name"`
+				StartLSN     string `json:"start_lsn"`
+				ConfirmedLSN string `json:"confirmed_lsn"`
+			} `json:"slot"`
+			Sinks []struct {
+				Name       string `json:"name"`
+				AppliedLSN string `json:"applied_lsn"`
+				LagBytes   uint64 `json:"lag_bytes"`
+				LastError  string `json:"last_error"`
+				Ready      bool   `json:"ready"`
+			} `json:"sinks"`
+		} `json:"pipelines"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid status JSON: %v", err)
+	}
+	if len(got.Pipelines) != 1 || len(got.Pipelines[0].Sinks) != 2 {
+		t.Fatalf("Unexpected status %s", rec.Body.String())
+	}
+	pr := got.Pipelines[0]
+	if pr.ReceivedLSN != "1/40" || pr.SafeLSN != "0/30" || len(pr.QueueDepths) != 2 || pr.QueueDepths[0] != 2 {
+		t.Errorf("Unexpected pipeline status %+v", pr)
+	}
+	if pr.Slot.Name != "orders_slot" || pr.Slot.StartLSN != "0/10" || pr.Slot.ConfirmedLSN != "0/20" {
+		t.Errorf("Unexpected slot %+v", pr.Slot)
+	}
+	if kafka := pr.Sinks[0]; kafka.AppliedLSN != "1/0" || kafka.LagBytes != 0x40 || !kafka.Ready {
+		t.Errorf("Unexpected kafka status %+v", kafka)
+	}
+	if pg := pr.Sinks[1]; pg.LastError != "timeout" || pg.Ready {
+		t.Errorf("Unexpected pg1 status %+v", pg)
+	}
+}
+
+func TestSinkLagMetrics(t *testing.T) {
+	p := NewStatus(time.Minute).Pipeline("lag")
+	s := p.Sink("pg1")
+	p.SetReceived(300)
+	s.Flushed(100)
+	if got := testutil.ToFloat64(SinkAppliedLSN.WithLabelValues("lag", "pg1")); got != 100 {
+		t.Errorf("Expected applied LSN 100, got %v", got)
+	}
+	if got := testutil.ToFloat64(SinkLagBytes.WithLabelValues("lag", "pg1")); got != 200 {
+		t.Errorf("Expected lag 200, got %v", got)
+	}
+	s.Flushed(300)
+	if got := testutil.ToFloat64(SinkLagBytes.WithLabelValues("lag", "pg1")); got != 0 {
+		t.Errorf("Expected no lag once caught up, got %v", got)
+	}
+	p.SetReceived(350)
+	if got := testutil.ToFloat64(SinkLagBytes.WithLabelValues("lag", "pg1")); got != 50 {
+		t.Errorf("Expected lag 50 after new changes, got %v", got)
+	}
+}
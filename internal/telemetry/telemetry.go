@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/nikolay-makurin/replicator/internal/config"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -15,7 +16,7 @@ var (
 			Name: "replicator_events_processed_total",
 			Help: "The total number of events processed",
 		},
-		[]string{"status", "sink"},
+		[]string{"pipeline", "sink", "type", "table", "op", "status"},
 	)
 	BatchSize = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -23,39 +24,127 @@ var (
 			Help: "Distribution of batch sizes",
 			Buckets: []float64{10, 100, 500, 1000, 5000, 10000},
 		},
-		[]string{"sink"},
+		[]string{"pipeline", "sink", "type"},
 	)
 	SinkLatency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name: "replicator_sink_latency_seconds",
 			Help: "Latency of sink operations",
 		},
-		[]string{"sink"},
+		[]string{"pipeline", "sink", "type"},
 	)
-	LagBytes = prometheus.NewGauge(
+	SinkRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replicator_sink_retries_total",
+			Help: "Failed sink writes that were retried",
+		},
+		[]string{"pipeline", "sink", "type"},
+	)
+	SinkPermanentFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replicator_sink_permanent_failures_total",
+			Help: "Sink writes that failed with an error retrying cannot fix",
+		},
+		[]string{"pipeline", "sink", "type"},
+	)
+	SinkBytesWritten = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "replicator_sink_bytes_written_total",
+			Help: "Bytes a sink wrote to its target: encoded messages, request bodies or files",
+		},
+		[]string{"pipeline", "sink", "type"},
+	)
+	CompactionRatio = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "replicator_compaction_ratio",
+			Help:    "Ratio of events written to events received per compacted batch",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 0.75, 1},
+		},
+		[]string{"pipeline"},
+	)
+	LagBytes = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "replicator_lag_bytes",
 			Help: "Estimated lag in bytes behind the source",
 		},
+		[]string{"pipeline"},
+	)
+	LagSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replicator_lag_seconds",
+			Help: "Time between the commit of the last transaction received and its receipt",
+		},
+		[]string{"pipeline"},
+	)
+	SinkAppliedLSN = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replicator_sink_applied_lsn",
+			Help: "Highest LSN of any batch written by a sink",
+		},
+		[]string{"pipeline", "sink"},
+	)
+	SinkLagBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replicator_sink_lag_bytes",
+			Help: "Bytes between the last change received and the last change written by a sink",
+		},
+		[]string{"pipeline", "sink"},
+	)
+	SlotRetainedBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replicator_slot_retained_wal_bytes",
+			Help: "WAL the server retains for the replication slot",
+		},
+		[]string{"pipeline", "slot"},
+	)
+	QueueFillRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replicator_queue_fill_ratio",
+			Help: "Fill ratio of the source buffer and of each worker queue",
+		},
+		[]string{"pipeline", "queue"},
+	)
+	PipelineUp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "replicator_pipeline_up",
+			Help: "Whether a pipeline is running (1) or has stopped on an error (0)",
+		},
+		[]string{"pipeline"},
 	)
 )
 
-func Init(addr string) {
+func Init(cfg config.TelemetryConfig) {
 	// Metrics
 	prometheus.MustRegister(EventsProcessed)
 	prometheus.MustRegister(BatchSize)
 	prometheus.MustRegister(SinkLatency)
+	prometheus.MustRegister(SinkRetries)
+	prometheus.MustRegister(SinkPermanentFailures)
+	prometheus.MustRegister(SinkBytesWritten)
+	prometheus.MustRegister(CompactionRatio)
 	prometheus.MustRegister(LagBytes)
+	prometheus.MustRegister(LagSeconds)
+	prometheus.MustRegister(SinkAppliedLSN)
+	prometheus.MustRegister(SinkLagBytes)
+	prometheus.MustRegister(SlotRetainedBytes)
+	prometheus.MustRegister(QueueFillRatio)
+	prometheus.MustRegister(PipelineUp)
 
 	// Logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	slog.SetDefault(logger)
 
+	// Status
+	Pipelines.FlushTimeout = cfg.FlushTimeout
+
 	// Server
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
-		slog.Info("Starting telemetry server", "address", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
+		http.HandleFunc("/healthz", healthHandler)
+		http.HandleFunc("/readyz", Pipelines.ServeReady)
+		http.HandleFunc("/status", Pipelines.ServeStatus)
+		slog.Info("Starting telemetry server", "address", cfg.Address)
+		if err := http.ListenAndServe(cfg.Address, nil); err != nil {
 			slog.Error("Telemetry server failed", "error", err)
 		}
 	}()
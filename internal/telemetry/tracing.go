@@ -0,0 +1,96 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nikolay-makurin/replicator/internal/config"
+	"github.com/nikolay-makurin/replicator/pkg/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nikolay-makurin/replicator"
+
+// Tracer returns the tracer of the pipeline's spans: a transaction span per
+// source transaction with a change event per row, and a flush span per
+// batch with a write span per sink. Without tracing configured it is a
+// no-op.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// InitTracing exports spans over OTLP/HTTP if an endpoint is configured.
+// The returned function flushes and stops the exporter.
+func InitTracing(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(cfg.Endpoint),
+		otlptracehttp.WithHeaders(cfg.Headers),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// Spans within a sampled transaction or batch are all kept
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// Changes of traced transactions are mapped to the transaction span, so
+// that the batches they are written in can link to it.
+var (
+	eventTraces  sync.Map // *types.Event -> trace.SpanContext
+	tracedEvents atomic.Int64
+)
+
+// TraceEvent records that e belongs to the transaction span sc, if it is
+// sampled.
+func TraceEvent(e *types.Event, sc trace.SpanContext) {
+	if !sc.IsSampled() {
+		return
+	}
+	eventTraces.Store(e, sc)
+	tracedEvents.Add(1)
+}
+
+// EventTrace returns and forgets the transaction span of e, if it was traced.
+func EventTrace(e *types.Event) (trace.SpanContext, bool) {
+	if tracedEvents.Load() == 0 {
+		return trace.SpanContext{}, false
+	}
+	v, ok := eventTraces.LoadAndDelete(e)
+	if !ok {
+		return trace.SpanContext{}, false
+	}
+	tracedEvents.Add(-1)
+	return v.(trace.SpanContext), true
+}
+
+// EndSpan records err, if any, on span and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -11,6 +11,15 @@ func (l LSN) String() string {
 	return fmt.Sprintf("%X/%X", uint32(l>>32), uint32(l))
 }
 
+// ParseLSN parses an LSN in the "%X/%X" form printed by String.
+func ParseLSN(s string) (LSN, error) {
+	var hi, lo uint32
+	if _, err := fmt.Sscanf(s, "%X/%X", &hi, &lo); err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	return LSN(uint64(hi)<<32 | uint64(lo)), nil
+}
+
 type EventType string
 
 const (
@@ -26,8 +35,27 @@ type Event struct {
 	Table     string
 	Columns   map[string]interface{} // New values
 	Identity  map[string]interface{} // Key values (for Update/Delete)
+	Before    map[string]interface{} // Old row of an update or delete, if the source sent it
 	LSN       LSN
+	XID       uint32 // Source transaction ID; 0 if unknown
 	Timestamp time.Time
+	Relation  *Relation // Column definitions; nil if unknown, e.g. for replayed events
+	Snapshot  bool      // Read from a table snapshot at LSN rather than from the WAL; not checkpointed
+}
+
+// Relation describes the columns of a table as last announced by the
+// source. Events share one Relation until the table's schema changes.
+type Relation struct {
+	Schema  string
+	Table   string
+	Columns []Column
+}
+
+type Column struct {
+	Name     string
+	Type     uint32 // Postgres type OID
+	Modifier int32  // Type modifier, e.g. varchar length; -1 if none
+	Key      bool   // Part of the replica identity
 }
 
 type Batch struct {